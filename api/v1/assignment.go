@@ -0,0 +1,10 @@
+package log_v1
+
+// OwnsOffset reports whether the record at the offset of the group's log
+// falls in one of the member's ranges
+func (a *Assignment) OwnsOffset(offset uint64) bool {
+	if a.GetRangeSize() == 0 || a.GetMembers() == 0 {
+		return false
+	}
+	return uint32(offset/a.RangeSize%uint64(a.Members)) == a.Index
+}
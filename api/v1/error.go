@@ -2,8 +2,10 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 )
 
@@ -38,3 +40,361 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrNotLeader is returned for writes sent to a server that isn't the
+// leader, or stopped being it before the write was committed. Clients
+// send them again once they've found the new leader.
+type ErrNotLeader struct {
+	Reason string
+	// Set if the server refused the write without replicating it. Writes
+	// the server lost the leadership in the middle of may still be
+	// committed by the next leader, sending them again may apply them
+	// twice.
+	Refused bool
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, e.Reason)
+	if !e.Refused {
+		return st
+	}
+	d := &errdetails.ErrorInfo{
+		Reason: "NOT_LEADER",
+		Domain: "dcl_store",
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned for appends whose sequence number
+// skips ahead of the producer's next one, or is too old to tell whether
+// it was appended. Retrying it doesn't help.
+type ErrOutOfOrderSequence struct {
+	ProducerID string
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"out of order sequence for producer %s: got %d, want %d",
+			e.ProducerID,
+			e.Sequence,
+			e.Expected,
+		),
+	)
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownProducer is returned for appends past a producer's first
+// whose producer the servers don't know, because they forgot it for
+// newer ones. They can't tell whether the records were appended before,
+// so the producer starts over under a new ID.
+type ErrUnknownProducer struct {
+	ProducerID string
+	Sequence   uint64
+}
+
+func (e ErrUnknownProducer) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"unknown producer %s at sequence %d",
+			e.ProducerID,
+			e.Sequence,
+		),
+	)
+}
+
+func (e ErrUnknownProducer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnexpectedOffset is returned for conditional appends whose record
+// wouldn't get the offset the writer expected, because other records
+// were appended since it last read the log. Actual is the offset the
+// record would have got, the writer catches up to it before trying again.
+type ErrUnexpectedOffset struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrUnexpectedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"unexpected offset: expected %d, log is at %d",
+			e.Expected,
+			e.Actual,
+		),
+	)
+	d := &errdetails.ErrorInfo{
+		Reason: "UNEXPECTED_OFFSET",
+		Domain: "dcl_store",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"actual_offset":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnexpectedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTransaction is returned for transactional requests that don't fit
+// the transaction's state, like appending to or ending a transaction
+// that isn't open
+type ErrTransaction struct {
+	TransactionID string
+	Reason        string
+}
+
+func (e ErrTransaction) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction %s: %s", e.TransactionID, e.Reason),
+	)
+}
+
+func (e ErrTransaction) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogNotFound is returned for requests naming a log that wasn't
+// created, or was deleted
+type ErrLogNotFound struct {
+	Name string
+}
+
+func (e ErrLogNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("log not found: %s", e.Name))
+}
+
+func (e ErrLogNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogExists is returned for creating a log under a name that's taken
+type ErrLogExists struct {
+	Name string
+}
+
+func (e ErrLogExists) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("log already exists: %s", e.Name),
+	)
+}
+
+func (e ErrLogExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidLogName is returned for creating a log under a name that
+// can't be used as a directory name
+type ErrInvalidLogName struct {
+	Name string
+}
+
+func (e ErrInvalidLogName) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf(
+			"invalid log name %q: use letters, digits, dots, dashes and underscores",
+			e.Name,
+		),
+	)
+}
+
+func (e ErrInvalidLogName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned for requests naming a topic that wasn't
+// created, or was deleted
+type ErrTopicNotFound struct {
+	Name string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Name))
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned for creating a topic under a name that's
+// taken
+type ErrTopicExists struct {
+	Name string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %s", e.Name),
+	)
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopic is returned for creating a topic under a name that
+// can't be used as a directory name, or without partitions
+type ErrInvalidTopic struct {
+	Name   string
+	Reason string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic %q: %s", e.Name, e.Reason),
+	)
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned for requests naming a partition past
+// the topic's last one
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidGroupName is returned for committing an offset for a group
+// whose name is empty or too long
+type ErrInvalidGroupName struct {
+	Name string
+}
+
+func (e ErrInvalidGroupName) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf(
+			"invalid group name %q: use up to 255 letters, digits, dots, dashes and underscores",
+			e.Name,
+		),
+	)
+}
+
+func (e ErrInvalidGroupName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownMember is returned for members the group's coordinator
+// doesn't know, because they left, their session timed out or another
+// server took over coordinating. They join the group again.
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("unknown member of group %s: %s", e.Group, e.MemberID),
+	)
+	d := &errdetails.ErrorInfo{
+		Reason:   "UNKNOWN_MEMBER",
+		Domain:   "dcl_store",
+		Metadata: map[string]string{"group": e.Group},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStaleGeneration is returned for offsets committed by a member in a
+// generation of the group that was since rebalanced, what it consumed
+// may be another member's now
+type ErrStaleGeneration struct {
+	Group      string
+	Generation uint64
+	Current    uint64
+}
+
+func (e ErrStaleGeneration) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"stale generation of group %s: got %d, group is at %d",
+			e.Group,
+			e.Generation,
+			e.Current,
+		),
+	)
+	d := &errdetails.ErrorInfo{
+		Reason: "STALE_GENERATION",
+		Domain: "dcl_store",
+		Metadata: map[string]string{
+			"group":      e.Group,
+			"generation": strconv.FormatUint(e.Current, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrGroupMismatch is returned for joining a group under another log or
+// topic than the one its members consume
+type ErrGroupMismatch struct {
+	Group string
+}
+
+func (e ErrGroupMismatch) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("group %s consumes another log or topic", e.Group),
+	)
+}
+
+func (e ErrGroupMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,456 @@
+// Package client is the Go client for dcl_store. It discovers the
+// servers through seeds, sends writes to the leader and reads to the
+// followers, and retries requests that failed because a server went away
+// or lost the leadership.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/nickstrad/dcl_store/internal/loadbalance"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type Config struct {
+	// Servers the client discovers the others through, addresses or DNS
+	// names, only one of them has to be up
+	Seeds []string
+	// Nil connects without TLS
+	TLSConfig *tls.Config
+	// Followers trailing the most up to date server by more log entries
+	// don't get reads, 0 reads from every follower
+	MaxLag uint64
+	// Reads go to followers in this zone when there are any
+	Zone string
+	// Name of the log the client appends to and reads from, the default
+	// log if empty
+	Log string
+	// Reads skip transactions' markers and the records of open and
+	// aborted transactions, and stop at the first open transaction
+	ReadCommitted bool
+	// Deadline of requests whose context doesn't have one, defaults to
+	// 10s
+	Timeout time.Duration
+	// Plain appends, without an expected offset or a producer ID, are
+	// never retried on Unavailable, only when a server that isn't the
+	// leader refused them. Producers append with a producer ID, so their
+	// appends are retried.
+	Retry RetryPolicy
+	// Passed to grpc.Dial after the client's own
+	DialOptions []grpc.DialOption
+}
+
+// RetryPolicy decides which failed requests are sent again and how long
+// the client backs off between attempts. Appends that could end up in
+// the log twice, those without an expected offset or a producer ID, are
+// only sent again when the server refused them without appending.
+type RetryPolicy struct {
+	// Attempts per request including the first one, defaults to 5
+	MaxAttempts int
+	// Backoff before the second attempt, doubled for every other one up
+	// to MaxBackoff, defaults to 50ms and 2s
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Codes of the errors retried, defaults to Unavailable, which
+	// servers also return when they aren't the leader. Plain appends are
+	// only retried on the latter.
+	Codes []codes.Code
+}
+
+type Client struct {
+	config   Config
+	resolver *loadbalance.Resolver
+	conn     *grpc.ClientConn
+	log      api.LogClient
+}
+
+func New(config Config) (*Client, error) {
+	if len(config.Seeds) == 0 {
+		return nil, fmt.Errorf("no seeds")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Retry.MaxAttempts == 0 {
+		config.Retry.MaxAttempts = 5
+	}
+	if config.Retry.InitialBackoff == 0 {
+		config.Retry.InitialBackoff = 50 * time.Millisecond
+	}
+	if config.Retry.MaxBackoff == 0 {
+		config.Retry.MaxBackoff = 2 * time.Second
+	}
+	if config.Retry.Codes == nil {
+		config.Retry.Codes = []codes.Code{codes.Unavailable}
+	}
+
+	c := &Client{
+		config: config,
+		resolver: &loadbalance.Resolver{
+			PickerConfig: loadbalance.PickerConfig{
+				MaxLag: config.MaxLag,
+				Zone:   config.Zone,
+			},
+		},
+	}
+	creds := grpc.WithInsecure()
+	if config.TLSConfig != nil {
+		creds = grpc.WithTransportCredentials(
+			credentials.NewTLS(config.TLSConfig),
+		)
+	}
+	opts := append(
+		[]grpc.DialOption{creds, grpc.WithResolvers(c.resolver)},
+		config.DialOptions...,
+	)
+	var err error
+	c.conn, err = grpc.Dial(
+		fmt.Sprintf(
+			"%s:///%s",
+			loadbalance.Scheme,
+			strings.Join(config.Seeds, ","),
+		),
+		opts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.log = api.NewLogClient(c.conn)
+	return c, nil
+}
+
+// Log returns the generated client for requests the client doesn't wrap,
+// they go through the same balancer but aren't retried
+func (c *Client) Log() api.LogClient {
+	return c.log
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Append appends the value to the log and returns its offset. It isn't
+// sent again if the server may have appended it, Unavailable errors go
+// back to the caller.
+func (c *Client) Append(ctx context.Context, value []byte) (uint64, error) {
+	return c.AppendRecord(ctx, &api.Record{Value: value})
+}
+
+func (c *Client) AppendRecord(
+	ctx context.Context,
+	record *api.Record,
+) (uint64, error) {
+	var res *api.AppendResponse
+	err := c.retryRefused(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.Append(ctx, &api.AppendRequest{
+			Log:    c.config.Log,
+			Record: record,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// AppendAt appends the record only if it gets the expected offset, one
+// past the last offset the caller saw. If other records were appended
+// since, it fails with an error UnexpectedOffset reports the log's next
+// offset for. An append retried after its response got lost fails the
+// same way, reading the record at the expected offset tells whether it
+// was the caller's.
+func (c *Client) AppendAt(
+	ctx context.Context,
+	record *api.Record,
+	expectedOffset uint64,
+) (uint64, error) {
+	var res *api.AppendResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.Append(ctx, &api.AppendRequest{
+			Log:            c.config.Log,
+			Record:         record,
+			ExpectedOffset: &expectedOffset,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// AppendBatch appends the records in one request, they get consecutive
+// offsets. Producers batch records for callers that append them one at a
+// time.
+func (c *Client) AppendBatch(
+	ctx context.Context,
+	records []*api.Record,
+) ([]uint64, error) {
+	return c.appendBatch(ctx, &api.AppendBatchRequest{Records: records})
+}
+
+func (c *Client) appendBatch(
+	ctx context.Context,
+	req *api.AppendBatchRequest,
+) ([]uint64, error) {
+	req.Log = c.config.Log
+	// the servers append a producer's batch once however often it's sent
+	retry := c.retryRefused
+	if req.ProducerId != "" {
+		retry = c.retry
+	}
+	var res *api.AppendBatchResponse
+	err := retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.AppendBatch(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Offsets) != len(req.Records) {
+		return nil, fmt.Errorf(
+			"got %d offsets for %d records",
+			len(res.Offsets),
+			len(req.Records),
+		)
+	}
+	return res.Offsets, nil
+}
+
+// Read reads the record at the offset, offsets past the end of the log
+// fail with an error IsOffsetOutOfRange reports. Committed reads get the
+// first committed record at or after the offset.
+func (c *Client) Read(ctx context.Context, offset uint64) (*api.Record, error) {
+	var res *api.ReadResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.Read(ctx, c.readRequest(offset))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
+
+func (c *Client) readRequest(offset uint64) *api.ReadRequest {
+	req := &api.ReadRequest{Log: c.config.Log, Offset: offset}
+	if c.config.ReadCommitted {
+		req.Isolation = api.ReadRequest_READ_COMMITTED
+	}
+	return req
+}
+
+// ReadRange reads the records from offset from up to, not including, to.
+// It stops early at the end of the log.
+func (c *Client) ReadRange(
+	ctx context.Context,
+	from, to uint64,
+) ([]*api.Record, error) {
+	var records []*api.Record
+	for offset := from; offset < to; {
+		record, err := c.Read(ctx, offset)
+		if IsOffsetOutOfRange(err) {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		// committed reads skip records
+		if record.Offset >= to {
+			break
+		}
+		records = append(records, record)
+		offset = record.Offset + 1
+	}
+	return records, nil
+}
+
+// Tail calls fn with every record from the offset on, waiting for new
+// records at the end of the log, until the context is done or fn fails.
+// Broken streams are opened again from the record after the last one fn
+// was called with. It returns fn's error, or the context's.
+func (c *Client) Tail(
+	ctx context.Context,
+	offset uint64,
+	fn func(*api.Record) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		received, err := c.tail(ctx, &offset, fn)
+		if received {
+			attempt = 1
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fnErr, ok := err.(tailError); ok {
+			return fnErr.err
+		}
+		if !c.retryable(err) || attempt >= c.config.Retry.MaxAttempts {
+			return err
+		}
+		if err := c.backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// Wraps fn's errors so they're told apart from the stream's
+type tailError struct {
+	err error
+}
+
+func (e tailError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) tail(
+	ctx context.Context,
+	offset *uint64,
+	fn func(*api.Record) error,
+) (received bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.log.ReadStream(ctx, c.readRequest(*offset))
+	if err != nil {
+		return false, err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			// the stream ended without the server saying why
+			return received, status.Error(codes.Unavailable, err.Error())
+		}
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := fn(res.Record); err != nil {
+			return received, tailError{err}
+		}
+		*offset = res.Record.Offset + 1
+	}
+}
+
+// Servers describes the servers in the cluster
+func (c *Client) Servers(ctx context.Context) ([]*api.Server, error) {
+	var res *api.GetServersResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.GetServers(ctx, &api.GetServersRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Servers, nil
+}
+
+// IsOffsetOutOfRange reports whether the error says the offset is past
+// the end of the log
+func IsOffsetOutOfRange(err error) bool {
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	return err != nil && status.Code(err) == want
+}
+
+// UnexpectedOffset returns the offset the log was at when AppendAt
+// failed because it wasn't at the expected one
+func UnexpectedOffset(err error) (actual uint64, ok bool) {
+	for _, d := range status.Convert(err).Details() {
+		info, isInfo := d.(*errdetails.ErrorInfo)
+		if !isInfo || info.Reason != "UNEXPECTED_OFFSET" {
+			continue
+		}
+		actual, err := strconv.ParseUint(
+			info.Metadata["actual_offset"],
+			10,
+			64,
+		)
+		return actual, err == nil
+	}
+	return 0, false
+}
+
+// Calls fn until it succeeds, fails with an error that isn't retried or
+// the attempts run out. The attempts share the configured deadline if
+// the context doesn't have one.
+func (c *Client) retry(
+	ctx context.Context,
+	fn func(context.Context) error,
+) error {
+	return c.retryIf(ctx, c.retryable, fn)
+}
+
+// Like retry, but only sends the request again if the server refused it
+// without applying it, for requests that mustn't be applied twice
+func (c *Client) retryRefused(
+	ctx context.Context,
+	fn func(context.Context) error,
+) error {
+	return c.retryIf(ctx, func(err error) bool {
+		return c.retryable(err) && errorReason(err) == "NOT_LEADER"
+	}, fn)
+}
+
+func (c *Client) retryIf(
+	ctx context.Context,
+	retryable func(error) bool,
+	fn func(context.Context) error,
+) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || ctx.Err() != nil || !retryable(err) ||
+			attempt >= c.config.Retry.MaxAttempts {
+			return err
+		}
+		if err := c.backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) retryable(err error) bool {
+	code := status.Code(err)
+	for _, c := range c.config.Retry.Codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Waits before the attempt after the given one. The servers are resolved
+// again meanwhile, the request may have failed because the balancer
+// doesn't know about the new leader yet.
+func (c *Client) backoff(ctx context.Context, attempt int) error {
+	c.resolver.Refresh()
+	wait := c.config.Retry.InitialBackoff << (attempt - 1)
+	if wait > c.config.Retry.MaxBackoff || wait <= 0 {
+		wait = c.config.Retry.MaxBackoff
+	}
+	// jitter keeps the clients that failed together from retrying
+	// together
+	wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,606 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/nickstrad/dcl_store/client"
+	"github.com/nickstrad/dcl_store/internal/auth"
+	"github.com/nickstrad/dcl_store/internal/config"
+	"github.com/nickstrad/dcl_store/internal/log"
+	"github.com/nickstrad/dcl_store/internal/server"
+	"github.com/soheilhy/cmux"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	commitLog, addr := setupServer(t)
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	// appends are sent again when the server isn't the leader
+	commitLog.failAppends(2)
+	for i := 0; i < 3; i++ {
+		off, err := c.Append(ctx, []byte(fmt.Sprintf("record %d", i)))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	record, err := c.Read(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "record 1", string(record.Value))
+
+	_, err = c.Read(ctx, 3)
+	require.True(t, client.IsOffsetOutOfRange(err))
+
+	// ranges stop at the end of the log
+	records, err := c.ReadRange(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "record 2", string(records[1].Value))
+
+	servers, err := c.Servers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, addr, servers[0].RpcAddr)
+
+	// tailing waits for new records
+	var got []string
+	tailCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- c.Tail(tailCtx, 1, func(record *api.Record) error {
+			got = append(got, string(record.Value))
+			if len(got) == 3 {
+				return fmt.Errorf("done")
+			}
+			return nil
+		})
+	}()
+	_, err = c.Append(ctx, []byte("record 3"))
+	require.NoError(t, err)
+	select {
+	case err = <-done:
+		require.EqualError(t, err, "done")
+	case <-time.After(3 * time.Second):
+		t.Fatal("tail didn't get the new record")
+	}
+	require.Equal(t, []string{"record 1", "record 2", "record 3"}, got)
+}
+
+func TestClientGivesUp(t *testing.T) {
+	commitLog, addr := setupServer(t)
+	c := setupClient(t, addr, client.Config{
+		Retry: client.RetryPolicy{MaxAttempts: 2},
+	})
+
+	commitLog.failAppends(2)
+	_, err := c.Append(context.Background(), []byte("hello"))
+	require.Error(t, err)
+
+	// the context's deadline cuts the retries short
+	commitLog.failAppends(100)
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		100*time.Millisecond,
+	)
+	defer cancel()
+	c = setupClient(t, addr, client.Config{
+		Retry: client.RetryPolicy{
+			MaxAttempts:    100,
+			InitialBackoff: time.Second,
+		},
+	})
+	start := time.Now()
+	_, err = c.Append(ctx, []byte("hello"))
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestClientDoesntRetryLostAppends(t *testing.T) {
+	commitLog, addr := setupServer(t)
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	// the append may have been committed, so it isn't sent again
+	commitLog.loseResponses(1)
+	_, err := c.Append(ctx, []byte("hello"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	record, err := c.Read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), record.Value)
+	_, err = c.Read(ctx, 1)
+	require.True(t, client.IsOffsetOutOfRange(err))
+
+	// refused appends are
+	commitLog.failAppends(1)
+	off, err := c.Append(ctx, []byte("world"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestClientAppendAt(t *testing.T) {
+	_, addr := setupDistributedServer(t)
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	off, err := c.AppendAt(ctx, &api.Record{Value: []byte("first")}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = c.AppendAt(ctx, &api.Record{Value: []byte("second")}, 0)
+	actual, ok := client.UnexpectedOffset(err)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), actual)
+
+	// writers catch up and try again
+	off, err = c.AppendAt(ctx, &api.Record{Value: []byte("second")}, actual)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, ok = client.UnexpectedOffset(fmt.Errorf("other"))
+	require.False(t, ok)
+}
+
+func TestTransaction(t *testing.T) {
+	_, addr := setupDistributedServer(t)
+	c := setupClient(t, addr, client.Config{})
+	committed := setupClient(t, addr, client.Config{ReadCommitted: true})
+	ctx := context.Background()
+
+	txn, err := c.BeginTransaction(ctx)
+	require.NoError(t, err)
+	_, err = txn.Append(ctx, &api.Record{Value: []byte("order placed")})
+	require.NoError(t, err)
+	_, err = txn.Append(ctx, &api.Record{Value: []byte("stock reserved")})
+	require.NoError(t, err)
+
+	// committed reads wait for the transaction
+	_, err = committed.Read(ctx, 0)
+	require.True(t, client.IsOffsetOutOfRange(err))
+	records, err := c.ReadRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+
+	require.NoError(t, txn.Commit(ctx))
+	records, err = committed.ReadRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "stock reserved", string(records[1].Value))
+
+	// aborted transactions are skipped
+	txn, err = c.BeginTransaction(ctx)
+	require.NoError(t, err)
+	_, err = txn.Append(ctx, &api.Record{Value: []byte("order placed")})
+	require.NoError(t, err)
+	require.NoError(t, txn.Abort(ctx))
+	require.Error(t, txn.Commit(ctx))
+
+	offsets, err := c.AppendTransaction(ctx, []*api.Record{
+		{Value: []byte("order placed")},
+		{Value: []byte("stock reserved")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{8, 9}, offsets)
+
+	var got []uint64
+	tailCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err = committed.Tail(tailCtx, 0, func(record *api.Record) error {
+		got = append(got, record.Offset)
+		if len(got) == 4 {
+			cancel()
+		}
+		return nil
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, []uint64{1, 2, 8, 9}, got)
+}
+
+func TestClientNamedLog(t *testing.T) {
+	commitLog, addr := setupDistributedServer(t)
+	dlog := commitLog.CommitLog.(*log.DistributedLog)
+	require.NoError(t, dlog.CreateLog("orders", nil))
+	c := setupClient(t, addr, client.Config{})
+	orders := setupClient(t, addr, client.Config{Log: "orders"})
+	ctx := context.Background()
+
+	_, err := c.Append(ctx, []byte("default"))
+	require.NoError(t, err)
+	off, err := orders.Append(ctx, []byte("order placed"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	offsets, err := orders.AppendBatch(ctx, []*api.Record{
+		{Value: []byte("order shipped")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, offsets)
+
+	records, err := orders.ReadRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "order shipped", string(records[1].Value))
+	record, err := c.Read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, "default", string(record.Value))
+}
+
+func TestClientTopic(t *testing.T) {
+	commitLog, addr := setupDistributedServer(t)
+	dlog := commitLog.CommitLog.(*log.DistributedLog)
+	require.NoError(t, dlog.CreateTopic("orders", 3))
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	_, err := c.Topic("payments", client.TopicConfig{}).Partitions(ctx)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// records with the same key land in the same partition
+	orders := c.Topic("orders", client.TopicConfig{})
+	var partitions []uint32
+	for i := uint64(0); i < 3; i++ {
+		partition, off, err := orders.Append(ctx, &api.Record{
+			Key:   []byte("customer-1"),
+			Value: []byte(fmt.Sprintf("order %d", i)),
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		partitions = append(partitions, partition)
+	}
+	require.Equal(t, partitions[0], partitions[1])
+	require.Equal(t, partitions[0], partitions[2])
+	record, err := orders.Read(ctx, partitions[0], 2)
+	require.NoError(t, err)
+	require.Equal(t, "order 2", string(record.Value))
+	require.Equal(t, []byte("customer-1"), record.Key)
+
+	// and records without one go round robin
+	roundRobin := c.Topic("orders", client.TopicConfig{
+		Partitioner: &client.RoundRobinPartitioner{},
+	})
+	got := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		partition, _, err := roundRobin.Append(ctx, &api.Record{
+			Value: []byte("order"),
+		})
+		require.NoError(t, err)
+		got[partition] = true
+	}
+	require.Equal(t, 3, len(got))
+}
+
+func TestClientGroups(t *testing.T) {
+	commitLog, addr := setupDistributedServer(t)
+	dlog := commitLog.CommitLog.(*log.DistributedLog)
+	require.NoError(t, dlog.CreateTopic("orders", 2))
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	_, ok, err := c.FetchOffset(ctx, "billing")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Append(ctx, []byte("order placed"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, c.CommitOffset(ctx, "billing", 1))
+	offset, ok, err := c.FetchOffset(ctx, "billing")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), offset)
+
+	orders := c.Topic("orders", client.TopicConfig{})
+	require.NoError(t, orders.CommitOffset(ctx, "billing", 1, 5))
+	offset, ok, err = orders.FetchOffset(ctx, "billing", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(5), offset)
+	_, ok, err = orders.FetchOffset(ctx, "billing", 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+	err = orders.CommitOffset(ctx, "billing", 2, 0)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	groups, err := c.Groups(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(groups))
+	require.Equal(t, "billing", groups[0].Name)
+	require.Equal(t, uint64(2), groups[0].Offsets[0].Lag)
+	require.Equal(t, "orders", groups[0].Offsets[1].Topic)
+}
+
+func TestClientGroupMembers(t *testing.T) {
+	commitLog, addr := setupDistributedServer(t)
+	dlog := commitLog.CommitLog.(*log.DistributedLog)
+	require.NoError(t, dlog.CreateTopic("orders", 2))
+	c := setupClient(t, addr, client.Config{})
+	ctx := context.Background()
+
+	config := client.MemberConfig{
+		Group:             "billing",
+		Topic:             "orders",
+		SessionTimeout:    300 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}
+	first, err := c.JoinGroup(ctx, config)
+	require.NoError(t, err)
+	<-first.Rebalanced()
+	require.Equal(t, []uint32{0, 1}, first.Assignment().Partitions)
+	stale := first.Generation()
+
+	// the partitions are split once another member joins
+	second, err := c.JoinGroup(ctx, config)
+	require.NoError(t, err)
+	select {
+	case <-first.Rebalanced():
+	case <-time.After(time.Second):
+		t.Fatal("first member wasn't rebalanced")
+	}
+	require.Equal(t, second.Generation(), first.Generation())
+	require.Equal(t, 1, len(first.Assignment().Partitions))
+	require.Equal(t, 1, len(second.Assignment().Partitions))
+
+	// offsets are only committed under the current generation
+	partition := first.Assignment().Partitions[0]
+	require.NoError(t, first.CommitOffset(ctx, partition, 3))
+	orders := c.Topic("orders", client.TopicConfig{})
+	require.NoError(t, orders.CommitOffset(ctx, "billing", 0, 1))
+	err = dlog.CommitOffset(&api.CommitOffsetRequest{
+		Group:      "billing",
+		Topic:      "orders",
+		MemberId:   first.ID(),
+		Generation: stale,
+	})
+	require.True(t, client.IsFenced(err))
+
+	// the others take over once a member leaves
+	require.NoError(t, second.Close(ctx))
+	select {
+	case <-first.Rebalanced():
+	case <-time.After(time.Second):
+		t.Fatal("first member wasn't rebalanced")
+	}
+	require.Equal(t, []uint32{0, 1}, first.Assignment().Partitions)
+	require.NoError(t, first.Close(ctx))
+}
+
+// Hands the server the distributed log's named logs and topics'
+// partitions
+type logManager struct {
+	*log.DistributedLog
+}
+
+func (m logManager) Log(name string) (server.CommitLog, error) {
+	l, err := m.DistributedLog.Log(name)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (m logManager) Partition(
+	topic string,
+	id uint32,
+) (server.CommitLog, error) {
+	p, err := m.DistributedLog.Partition(topic, id)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Fails the given number of appends the way servers that aren't the
+// leader do, refusing them or losing the leadership after appending
+// them
+type flakyLog struct {
+	server.CommitLog
+	mu     sync.Mutex
+	fails  int
+	losses int
+}
+
+func (l *flakyLog) failAppends(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fails = n
+}
+
+func (l *flakyLog) loseResponses(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.losses = n
+}
+
+func (l *flakyLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fails > 0 {
+		l.fails--
+		return 0, api.ErrNotLeader{
+			Reason:  "node is not the leader",
+			Refused: true,
+		}
+	}
+	off, err := l.CommitLog.Append(record)
+	if err == nil && l.losses > 0 {
+		l.losses--
+		return 0, api.ErrNotLeader{Reason: "leadership lost"}
+	}
+	return off, err
+}
+
+func (l *flakyLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fails > 0 {
+		l.fails--
+		return nil, api.ErrNotLeader{
+			Reason:  "node is not the leader",
+			Refused: true,
+		}
+	}
+	return l.CommitLog.AppendBatch(records)
+}
+
+func (l *flakyLog) AppendFrom(
+	producerID string,
+	sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offsets, err := l.CommitLog.(server.ProducerLog).AppendFrom(
+		producerID,
+		sequence,
+		records,
+	)
+	if err == nil && l.losses > 0 {
+		l.losses--
+		return nil, api.ErrNotLeader{Reason: "leadership lost"}
+	}
+	return offsets, err
+}
+
+type getServers struct {
+	addr string
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{Id: "0", RpcAddr: s.addr, IsLeader: true}}, nil
+}
+
+func setupServer(t *testing.T) (*flakyLog, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	return setupServerWith(t, clog)
+}
+
+// Starts a server in front of a single server cluster, which deduplicates
+// the producers' appends
+func setupDistributedServer(t *testing.T) (*flakyLog, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// the topics' partitions share the listener, as in the agent
+	mux := cmux.New(ln)
+	raftLn := mux.Match(firstByte(log.RaftRPC))
+	groupLn := mux.Match(firstByte(log.RaftGroupRPC))
+	go mux.Serve()
+
+	c := log.Config{}
+	c.Raft.StreamLayer = log.NewStreamLayer(raftLn, nil, nil)
+	c.Topics.Mux = log.NewStreamMux(groupLn, nil, nil)
+	c.Raft.LocalID = "0"
+	c.Raft.Bootstrap = true
+	c.Raft.HeartbeatTimeout = 200 * time.Millisecond
+	c.Raft.ElectionTimeout = 200 * time.Millisecond
+	c.Raft.LeaderLeaseTimeout = 200 * time.Millisecond
+	dlog, err := log.NewDistributedLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { dlog.Close() })
+	require.NoError(t, dlog.WaitForLeader(3*time.Second))
+	return setupServerWith(t, dlog)
+}
+
+func firstByte(b byte) cmux.Matcher {
+	return func(r io.Reader) bool {
+		got := make([]byte, 1)
+		if _, err := r.Read(got); err != nil {
+			return false
+		}
+		return got[0] == b
+	}
+}
+
+func setupServerWith(
+	t *testing.T,
+	clog server.CommitLog,
+) (*flakyLog, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	commitLog := &flakyLog{CommitLog: clog}
+
+	serverConfig := &server.Config{
+		CommitLog:   commitLog,
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		GetServerer: &getServers{addr: l.Addr().String()},
+	}
+	if _, ok := clog.(server.ProducerLog); ok {
+		serverConfig.ProducerLog = commitLog
+	}
+	if conditional, ok := clog.(server.ConditionalLog); ok {
+		serverConfig.ConditionalLog = conditional
+	}
+	if transactions, ok := clog.(server.TransactionLog); ok {
+		serverConfig.TransactionLog = transactions
+	}
+	if dlog, ok := clog.(*log.DistributedLog); ok {
+		serverConfig.LogManager = logManager{dlog}
+		serverConfig.TopicManager = logManager{dlog}
+		serverConfig.GroupLog = dlog
+		serverConfig.GroupCoordinator = dlog
+	}
+	srv, err := server.NewGRPCServer(
+		serverConfig,
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	return commitLog, l.Addr().String()
+}
+
+func setupClient(t *testing.T, addr string, c client.Config) *client.Client {
+	t.Helper()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	c.Seeds = []string{addr}
+	c.TLSConfig = tlsConfig
+	cl, err := client.New(c)
+	require.NoError(t, err)
+	t.Cleanup(func() { cl.Close() })
+	return cl
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+)
+
+// CommitOffset stores the offset of the next record the group consumes
+// in the client's log, so the group's consumers go on from there after
+// they restart. Committing the same offset again is harmless, so it's
+// retried.
+func (c *Client) CommitOffset(
+	ctx context.Context,
+	group string,
+	offset uint64,
+) error {
+	return c.commitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  group,
+		Log:    c.config.Log,
+		Offset: offset,
+	})
+}
+
+// FetchOffset returns the offset the group committed in the client's
+// log, ok is false if it hasn't committed one
+func (c *Client) FetchOffset(
+	ctx context.Context,
+	group string,
+) (offset uint64, ok bool, err error) {
+	return c.fetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: group,
+		Log:   c.config.Log,
+	})
+}
+
+// Groups lists the consumer groups the client may consume for, with the
+// offsets they committed and how far they trail
+func (c *Client) Groups(ctx context.Context) ([]*api.ConsumerGroup, error) {
+	var res *api.ListGroupsResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.ListGroups(ctx, &api.ListGroupsRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Groups, nil
+}
+
+// CommitOffset stores the offset of the next record the group consumes
+// in the partition, like Client.CommitOffset
+func (t *Topic) CommitOffset(
+	ctx context.Context,
+	group string,
+	partition uint32,
+	offset uint64,
+) error {
+	return t.client.commitOffset(ctx, &api.CommitOffsetRequest{
+		Group:     group,
+		Topic:     t.name,
+		Partition: partition,
+		Offset:    offset,
+	})
+}
+
+// FetchOffset returns the offset the group committed in the partition,
+// ok is false if it hasn't committed one
+func (t *Topic) FetchOffset(
+	ctx context.Context,
+	group string,
+	partition uint32,
+) (offset uint64, ok bool, err error) {
+	return t.client.fetchOffset(ctx, &api.FetchOffsetRequest{
+		Group:     group,
+		Topic:     t.name,
+		Partition: partition,
+	})
+}
+
+// The cluster's leader keeps the offsets, not the partitions' leaders
+func (c *Client) commitOffset(
+	ctx context.Context,
+	req *api.CommitOffsetRequest,
+) error {
+	return c.retry(ctx, func(ctx context.Context) error {
+		_, err := c.log.CommitOffset(ctx, req)
+		return err
+	})
+}
+
+func (c *Client) fetchOffset(
+	ctx context.Context,
+	req *api.FetchOffsetRequest,
+) (uint64, bool, error) {
+	var res *api.FetchOffsetResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.FetchOffset(ctx, req)
+		return err
+	})
+	if err != nil || res.Offset == nil {
+		return 0, false, err
+	}
+	return res.Offset.Offset, true, nil
+}
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type MemberConfig struct {
+	Group string
+	// Topic whose partitions the group's members split, the group splits
+	// the client's log if empty
+	Topic string
+	// How long the coordinator waits for a heartbeat before it drops the
+	// member and hands its share to the others, defaults to 10s
+	SessionTimeout time.Duration
+	// Defaults to a third of the session timeout
+	HeartbeatInterval time.Duration
+	// Records in each of the log's ranges the members take turns at,
+	// defaults to the server's 1000. Only the group's first member sets
+	// it.
+	RangeSize uint64
+}
+
+// Member is a consumer in a group. The group's coordinator splits the
+// log's ranges or the topic's partitions among the live members, and
+// splits them again whenever one joins, leaves or stops heartbeating.
+// Every split is a new generation, the offsets committed under an older
+// one are refused.
+type Member struct {
+	client *Client
+	config MemberConfig
+
+	mu         sync.Mutex
+	id         string
+	generation uint64
+	assignment *api.Assignment
+
+	rebalanced chan struct{}
+	shutdown   chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+}
+
+// JoinGroup joins the group and heartbeats in the background until the
+// member is closed. Members dropped by the coordinator join again.
+func (c *Client) JoinGroup(
+	ctx context.Context,
+	config MemberConfig,
+) (*Member, error) {
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = 10 * time.Second
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = config.SessionTimeout / 3
+	}
+	m := &Member{
+		client:     c,
+		config:     config,
+		rebalanced: make(chan struct{}, 1),
+		shutdown:   make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if err := m.join(ctx); err != nil {
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *Member) ID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.id
+}
+
+func (m *Member) Generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generation
+}
+
+// Assignment returns the member's share of the group's log or topic in
+// the current generation
+func (m *Member) Assignment() *api.Assignment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.assignment
+}
+
+// Rebalanced receives whenever the member's assignment changes. The
+// member stops consuming what isn't in the new one, and commits what it
+// consumed of it before.
+func (m *Member) Rebalanced() <-chan struct{} {
+	return m.rebalanced
+}
+
+// CommitOffset commits the group's offset in the log, or in the
+// partition of the topic, under the member's current generation. It
+// fails with an error IsFenced reports on if the group was rebalanced
+// since.
+func (m *Member) CommitOffset(
+	ctx context.Context,
+	partition uint32,
+	offset uint64,
+) error {
+	m.mu.Lock()
+	req := &api.CommitOffsetRequest{
+		Group:      m.config.Group,
+		Offset:     offset,
+		MemberId:   m.id,
+		Generation: m.generation,
+	}
+	m.mu.Unlock()
+	if m.config.Topic != "" {
+		req.Topic = m.config.Topic
+		req.Partition = partition
+	} else {
+		req.Log = m.client.config.Log
+	}
+	return m.client.commitOffset(ctx, req)
+}
+
+// Close stops heartbeating and leaves the group, so the others take over
+// the member's share without waiting out its session. Closing the member
+// again does nothing.
+func (m *Member) Close(ctx context.Context) error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.shutdown)
+		<-m.stopped
+		err = m.client.retry(ctx, func(ctx context.Context) error {
+			_, err := m.client.log.LeaveGroup(ctx, &api.LeaveGroupRequest{
+				Group:    m.config.Group,
+				MemberId: m.ID(),
+			})
+			return err
+		})
+	})
+	return err
+}
+
+// Joins again under the member's ID, if it has one already
+func (m *Member) join(ctx context.Context) error {
+	req := &api.JoinGroupRequest{
+		Group:          m.config.Group,
+		MemberId:       m.ID(),
+		Topic:          m.config.Topic,
+		SessionTimeout: durationpb.New(m.config.SessionTimeout),
+		RangeSize:      m.config.RangeSize,
+	}
+	if req.Topic == "" {
+		req.Log = m.client.config.Log
+	}
+	var res *api.JoinGroupResponse
+	err := m.client.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = m.client.log.JoinGroup(ctx, req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.id = res.MemberId
+	m.mu.Unlock()
+	m.update(res.Generation, res.Assignment)
+	return nil
+}
+
+func (m *Member) update(generation uint64, assignment *api.Assignment) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// a deposed coordinator may still answer with its older generation
+	if generation <= m.generation {
+		return
+	}
+	m.generation = generation
+	m.assignment = assignment
+	select {
+	case m.rebalanced <- struct{}{}:
+	default:
+	}
+}
+
+// Heartbeats until the member is closed. Failed heartbeats are tried
+// again with the next one, the session outlasts a few of them.
+func (m *Member) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(m.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			m.config.HeartbeatInterval,
+		)
+		m.heartbeat(ctx)
+		cancel()
+	}
+}
+
+func (m *Member) heartbeat(ctx context.Context) {
+	res, err := m.client.log.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:      m.config.Group,
+		MemberId:   m.ID(),
+		Generation: m.Generation(),
+	})
+	if err == nil {
+		m.update(res.Generation, res.Assignment)
+		return
+	}
+	if errorReason(err) == "UNKNOWN_MEMBER" {
+		// the session timed out or another server coordinates the group
+		_ = m.join(ctx)
+	}
+}
+
+// IsFenced reports whether the error says the member was dropped from
+// its group, or committed under a generation the group was rebalanced
+// since
+func IsFenced(err error) bool {
+	switch errorReason(err) {
+	case "UNKNOWN_MEMBER", "STALE_GENERATION":
+		return true
+	}
+	return false
+}
+
+// The reason of the error's ErrorInfo, if it has one
+func errorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
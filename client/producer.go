@@ -0,0 +1,312 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrProducerClosed = fmt.Errorf("producer closed")
+
+type ProducerConfig struct {
+	// Records buffered, waiting to be sent or for their batch's response,
+	// before Produce blocks. Defaults to 10000.
+	BufferSize int
+	// A batch is sent once it holds this many records or bytes, defaults
+	// to 500 records and 1MiB
+	BatchSize  int
+	BatchBytes int
+	// How long a batch waits for more records before it's sent anyway,
+	// defaults to 5ms
+	Linger time.Duration
+	// Batches sent at once, defaults to 5. Batches that are retried may
+	// land after the ones sent after them, 1 keeps the records in the
+	// order they were produced.
+	MaxInFlight int
+	// Batches retried after their response got lost are only appended
+	// once. Idempotent producers send one batch at a time, the servers
+	// refuse batches that skip ahead of the one that failed. Batches
+	// that fail for good may or may not have been appended, the producer
+	// goes on under a new ID.
+	Idempotent bool
+}
+
+// Producer appends records in batches in the background. Produce returns
+// as soon as the record is buffered, and the record's future resolves
+// once its batch was appended or failed.
+type Producer struct {
+	client *Client
+	config ProducerConfig
+
+	// Hold a token per buffered record and per batch in flight
+	buffered chan struct{}
+	inFlight chan struct{}
+	records  chan *Future
+	flushes  chan struct{}
+
+	mu          sync.Mutex
+	closed      bool
+	outstanding int
+	idle        []chan struct{}
+	// Identify the idempotent producer's batches to the servers
+	id       string
+	sequence uint64
+
+	shutdown chan struct{}
+	stopped  chan struct{}
+}
+
+// Future is the result of appending a record
+type Future struct {
+	record *api.Record
+	size   int
+	done   chan struct{}
+	offset uint64
+	err    error
+}
+
+// Done is closed once the record was appended or failed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait returns the record's offset once it was appended
+func (f *Future) Wait(ctx context.Context) (uint64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-f.done:
+		return f.offset, f.err
+	}
+}
+
+func (c *Client) NewProducer(config ProducerConfig) (*Producer, error) {
+	if config.BufferSize == 0 {
+		config.BufferSize = 10000
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 500
+	}
+	if config.BatchBytes == 0 {
+		config.BatchBytes = 1 << 20
+	}
+	if config.Linger == 0 {
+		config.Linger = 5 * time.Millisecond
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 5
+	}
+	if config.Idempotent {
+		config.MaxInFlight = 1
+	}
+	p := &Producer{
+		client:   c,
+		config:   config,
+		buffered: make(chan struct{}, config.BufferSize),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+		records:  make(chan *Future, config.BufferSize),
+		flushes:  make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if config.Idempotent {
+		if err := p.newID(); err != nil {
+			return nil, err
+		}
+	}
+	go p.run()
+	return p, nil
+}
+
+// The caller holds the lock or owns the producer
+func (p *Producer) newID() error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	p.id, p.sequence = id, 0
+	return nil
+}
+
+// Produce buffers the record to be appended with the next batch. It
+// blocks while the buffer is full, until the context is done.
+func (p *Producer) Produce(
+	ctx context.Context,
+	record *api.Record,
+) (*Future, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case p.buffered <- struct{}{}:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		<-p.buffered
+		return nil, ErrProducerClosed
+	}
+	f := &Future{
+		record: record,
+		size:   proto.Size(record),
+		done:   make(chan struct{}),
+	}
+	p.outstanding++
+	// there's room for every buffered record
+	p.records <- f
+	return f, nil
+}
+
+// Flush sends the records buffered so far without waiting out the linger
+// time, and waits for every record produced to be appended or fail
+func (p *Producer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	if p.outstanding == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	p.idle = append(p.idle, idle)
+	p.mu.Unlock()
+
+	select {
+	case p.flushes <- struct{}{}:
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-idle:
+		return nil
+	}
+}
+
+// Close flushes the producer and stops it, records can't be produced
+// afterwards
+func (p *Producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	err := p.Flush(ctx)
+	close(p.shutdown)
+	<-p.stopped
+	return err
+}
+
+// Collects the records into batches, sending a batch once it's full, its
+// linger time is up or the producer is flushed. Sending blocks while the
+// most batches are in flight, so the buffer fills up and producing
+// blocks in turn.
+func (p *Producer) run() {
+	defer close(p.stopped)
+
+	var batch []*Future
+	var size int
+	var linger *time.Timer
+	var lingerC <-chan time.Time
+	send := func() {
+		if linger != nil {
+			linger.Stop()
+			linger, lingerC = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		p.inFlight <- struct{}{}
+		req := &api.AppendBatchRequest{
+			Records: make([]*api.Record, 0, len(batch)),
+		}
+		for _, f := range batch {
+			req.Records = append(req.Records, f.record)
+		}
+		if p.config.Idempotent {
+			// the batch before has been settled, so the sequence
+			// follows on from it
+			p.mu.Lock()
+			req.ProducerId, req.Sequence = p.id, p.sequence
+			p.sequence += uint64(len(batch))
+			p.mu.Unlock()
+		}
+		go p.send(batch, req)
+		batch, size = nil, 0
+	}
+	add := func(f *Future) {
+		batch = append(batch, f)
+		size += f.size
+		if linger == nil {
+			linger = time.NewTimer(p.config.Linger)
+			lingerC = linger.C
+		}
+		if len(batch) >= p.config.BatchSize ||
+			size >= p.config.BatchBytes {
+			send()
+		}
+	}
+	// takes in what was produced so far
+	drain := func() {
+		for len(p.records) > 0 {
+			add(<-p.records)
+		}
+		send()
+	}
+
+	for {
+		select {
+		case f := <-p.records:
+			add(f)
+		case <-lingerC:
+			linger, lingerC = nil, nil
+			send()
+		case <-p.flushes:
+			drain()
+		case <-p.shutdown:
+			drain()
+			// wait for the batches in flight
+			for i := 0; i < cap(p.inFlight); i++ {
+				p.inFlight <- struct{}{}
+			}
+			return
+		}
+	}
+}
+
+func (p *Producer) send(batch []*Future, req *api.AppendBatchRequest) {
+	offsets, err := p.client.appendBatch(context.Background(), req)
+	if err != nil && p.config.Idempotent {
+		p.mu.Lock()
+		if idErr := p.newID(); idErr != nil {
+			err = fmt.Errorf("%v, and failed to get a new ID: %v", err, idErr)
+		}
+		p.mu.Unlock()
+	}
+	for i, f := range batch {
+		if err != nil {
+			f.err = err
+		} else {
+			f.offset = offsets[i]
+		}
+		close(f.done)
+		<-p.buffered
+	}
+	<-p.inFlight
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outstanding -= len(batch)
+	if p.outstanding == 0 {
+		for _, idle := range p.idle {
+			close(idle)
+		}
+		p.idle = nil
+	}
+}
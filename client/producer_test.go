@@ -0,0 +1,112 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/nickstrad/dcl_store/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducer(t *testing.T) {
+	commitLog, addr := setupServer(t)
+	c := setupClient(t, addr, client.Config{})
+	p, err := c.NewProducer(client.ProducerConfig{
+		BatchSize:   10,
+		MaxInFlight: 1,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// failed batches are sent again
+	commitLog.failAppends(1)
+	var futures []*client.Future
+	for i := 0; i < 25; i++ {
+		f, err := p.Produce(ctx, &api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+		futures = append(futures, f)
+	}
+	require.NoError(t, p.Flush(ctx))
+
+	for i, f := range futures {
+		off, err := f.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	record, err := c.Read(ctx, 24)
+	require.NoError(t, err)
+	require.Equal(t, "record 24", string(record.Value))
+
+	require.NoError(t, p.Close(ctx))
+	_, err = p.Produce(ctx, &api.Record{})
+	require.Equal(t, client.ErrProducerClosed, err)
+}
+
+func TestProducerBackpressure(t *testing.T) {
+	_, addr := setupServer(t)
+	c := setupClient(t, addr, client.Config{})
+	p, err := c.NewProducer(client.ProducerConfig{
+		BufferSize: 1,
+		Linger:     time.Hour,
+	})
+	require.NoError(t, err)
+	defer p.Close(context.Background())
+
+	first, err := p.Produce(context.Background(), &api.Record{})
+	require.NoError(t, err)
+
+	// the buffer is full until the first record's batch is sent
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		50*time.Millisecond,
+	)
+	defer cancel()
+	_, err = p.Produce(ctx, &api.Record{})
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, p.Flush(context.Background()))
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("flush returned before the record was appended")
+	}
+	_, err = p.Produce(context.Background(), &api.Record{})
+	require.NoError(t, err)
+}
+
+func TestIdempotentProducer(t *testing.T) {
+	commitLog, addr := setupDistributedServer(t)
+	c := setupClient(t, addr, client.Config{})
+	p, err := c.NewProducer(client.ProducerConfig{
+		BatchSize:  2,
+		Idempotent: true,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// the retries of batches whose response got lost aren't appended
+	// again
+	commitLog.loseResponses(2)
+	var futures []*client.Future
+	for i := 0; i < 4; i++ {
+		f, err := p.Produce(ctx, &api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+		futures = append(futures, f)
+	}
+	require.NoError(t, p.Close(ctx))
+
+	for i, f := range futures {
+		off, err := f.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	_, err = c.Read(ctx, 4)
+	require.True(t, client.IsOffsetOutOfRange(err))
+}
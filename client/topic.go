@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/nickstrad/dcl_store/internal/loadbalance"
+)
+
+// Partitioner picks which of the topic's partitions a record is appended
+// to
+type Partitioner interface {
+	Partition(record *api.Record, partitions uint32) uint32
+}
+
+// HashPartitioner appends records with the same key to the same
+// partition, so they keep their order. Records without a key go round
+// robin.
+type HashPartitioner struct {
+	RoundRobinPartitioner
+}
+
+func (p *HashPartitioner) Partition(
+	record *api.Record,
+	partitions uint32,
+) uint32 {
+	if len(record.Key) == 0 {
+		return p.RoundRobinPartitioner.Partition(record, partitions)
+	}
+	h := fnv.New32a()
+	h.Write(record.Key)
+	return h.Sum32() % partitions
+}
+
+// RoundRobinPartitioner spreads records evenly across the partitions
+type RoundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(
+	record *api.Record,
+	partitions uint32,
+) uint32 {
+	return (atomic.AddUint32(&p.next, 1) - 1) % partitions
+}
+
+type TopicConfig struct {
+	// Defaults to a HashPartitioner
+	Partitioner Partitioner
+}
+
+// Topic appends to and reads from the partitions of a topic. Every
+// partition is a log of its own, with its own offsets and leader.
+type Topic struct {
+	client *Client
+	name   string
+	config TopicConfig
+
+	mu sync.Mutex
+	// Looked up once, topics keep their partitions
+	partitions uint32
+}
+
+func (c *Client) Topic(name string, config TopicConfig) *Topic {
+	if config.Partitioner == nil {
+		config.Partitioner = &HashPartitioner{}
+	}
+	return &Topic{client: c, name: name, config: config}
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Partitions returns how many partitions the topic has
+func (t *Topic) Partitions(ctx context.Context) (uint32, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.partitions != 0 {
+		return t.partitions, nil
+	}
+	var res *api.GetServersResponse
+	err := t.client.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = t.client.log.GetServers(ctx, &api.GetServersRequest{})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, partition := range res.Partitions {
+		if partition.Topic == t.name {
+			t.partitions++
+		}
+	}
+	if t.partitions == 0 {
+		return 0, api.ErrTopicNotFound{Name: t.name}
+	}
+	return t.partitions, nil
+}
+
+// Append appends the record to the partition the partitioner picks and
+// returns the partition and the record's offset in it
+func (t *Topic) Append(
+	ctx context.Context,
+	record *api.Record,
+) (partition uint32, offset uint64, err error) {
+	partitions, err := t.Partitions(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	partition = t.config.Partitioner.Partition(record, partitions)
+	offset, err = t.AppendTo(ctx, partition, record)
+	return partition, offset, err
+}
+
+// AppendTo appends the record to the partition
+func (t *Topic) AppendTo(
+	ctx context.Context,
+	partition uint32,
+	record *api.Record,
+) (uint64, error) {
+	ctx = loadbalance.WithPartition(ctx, t.name, partition)
+	var res *api.AppendResponse
+	err := t.client.retryRefused(ctx, func(ctx context.Context) (err error) {
+		res, err = t.client.log.Append(ctx, &api.AppendRequest{
+			Topic:     t.name,
+			Partition: partition,
+			Record:    record,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// Read reads the record at the offset of the partition, like
+// Client.Read
+func (t *Topic) Read(
+	ctx context.Context,
+	partition uint32,
+	offset uint64,
+) (*api.Record, error) {
+	req := &api.ReadRequest{
+		Topic:     t.name,
+		Partition: partition,
+		Offset:    offset,
+	}
+	if t.client.config.ReadCommitted {
+		req.Isolation = api.ReadRequest_READ_COMMITTED
+	}
+	var res *api.ReadResponse
+	err := t.client.retry(ctx, func(ctx context.Context) (err error) {
+		res, err = t.client.log.Read(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
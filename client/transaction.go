@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+
+	"github.com/hashicorp/go-uuid"
+	api "github.com/nickstrad/dcl_store/api/v1"
+)
+
+// Transaction appends records that committed reads see all at once when
+// it commits, or never if it aborts. Its records are appended as they're
+// sent, so a transaction left open holds up committed reads until the
+// servers abort it for timing out.
+type Transaction struct {
+	client *Client
+	id     string
+}
+
+// BeginTransaction appends the begin marker of a transaction with a new
+// ID
+func (c *Client) BeginTransaction(ctx context.Context) (*Transaction, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	// beginning a transaction again is harmless, so it's retried
+	err = c.retry(ctx, func(ctx context.Context) error {
+		_, err := c.log.BeginTransaction(
+			ctx,
+			&api.BeginTransactionRequest{
+				Log:           c.config.Log,
+				TransactionId: id,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{client: c, id: id}, nil
+}
+
+func (t *Transaction) ID() string {
+	return t.id
+}
+
+// Append appends the records to the transaction
+func (t *Transaction) Append(
+	ctx context.Context,
+	records ...*api.Record,
+) ([]uint64, error) {
+	return t.client.appendBatch(ctx, &api.AppendBatchRequest{
+		Records:       records,
+		TransactionId: t.id,
+	})
+}
+
+// Commit shows the transaction's records to committed reads. Commits
+// retried after their response got lost succeed again, but a transaction
+// that timed out can't be committed anymore.
+func (t *Transaction) Commit(ctx context.Context) error {
+	return t.end(ctx, false)
+}
+
+// Abort hides the transaction's records from committed reads for good
+func (t *Transaction) Abort(ctx context.Context) error {
+	return t.end(ctx, true)
+}
+
+func (t *Transaction) end(ctx context.Context, abort bool) error {
+	return t.client.retry(ctx, func(ctx context.Context) error {
+		_, err := t.client.log.EndTransaction(
+			ctx,
+			&api.EndTransactionRequest{
+				Log:           t.client.config.Log,
+				TransactionId: t.id,
+				Abort:         abort,
+			},
+		)
+		return err
+	})
+}
+
+// AppendTransaction appends the records as a committed transaction in
+// one request, committed reads see none of them until they're all in
+func (c *Client) AppendTransaction(
+	ctx context.Context,
+	records []*api.Record,
+) ([]uint64, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	var res *api.AppendTransactionResponse
+	err = c.retryRefused(ctx, func(ctx context.Context) (err error) {
+		res, err = c.log.AppendTransaction(
+			ctx,
+			&api.AppendTransactionRequest{
+				Log:           c.config.Log,
+				TransactionId: id,
+				Records:       records,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Offsets, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+
+	"github.com/nickstrad/dcl_store/internal/config"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Flags for commands talking to a running server's RPC API
+func setupClientFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("rpc-addr", "127.0.0.1:8400", "RPC address of the server to send the request to.")
+	cmd.PersistentFlags().String("tls-cert-file", "", "Path to client tls cert.")
+	cmd.PersistentFlags().String("tls-key-file", "", "Path to client tls key.")
+	cmd.PersistentFlags().String("tls-ca-file", "", "Path to certificate authority.")
+}
+
+func dial(cmd *cobra.Command) (*grpc.ClientConn, error) {
+	flags := cmd.Flags()
+	rpcAddr, err := flags.GetString("rpc-addr")
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(rpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := config.TLSConfig{ServerAddress: host}
+	if tlsConfig.CertFile, err = flags.GetString("tls-cert-file"); err != nil {
+		return nil, err
+	}
+	if tlsConfig.KeyFile, err = flags.GetString("tls-key-file"); err != nil {
+		return nil, err
+	}
+	if tlsConfig.CAFile, err = flags.GetString("tls-ca-file"); err != nil {
+		return nil, err
+	}
+
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if tlsConfig.CAFile != "" {
+		tls, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(tls)),
+		}
+	}
+	return grpc.Dial(rpcAddr, opts...)
+}
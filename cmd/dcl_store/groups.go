@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func newGroupsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "groups",
+		Short: "Manage the consumer groups' offsets.",
+		Long: `Manages the offsets consumer groups committed, replicated along with
+the logs so consumers go on from them after restarting.`,
+	}
+	setupClientFlags(cmd)
+
+	commit := &cobra.Command{
+		Use:   "commit <group> <offset>",
+		Short: "Commit an offset for a group, e.g. to skip or replay records.",
+		Args:  cobra.ExactArgs(2),
+		RunE:  runCommitOffset,
+	}
+	commit.Flags().String("log", "", "Name of the log, the default log if empty.")
+	commit.Flags().String("topic", "", "Topic, instead of a log.")
+	commit.Flags().Uint32("partition", 0, "Partition of the topic.")
+
+	cmd.AddCommand(
+		commit,
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the groups with their offsets and lag.",
+			Args:  cobra.NoArgs,
+			RunE:  runListGroups,
+		},
+	)
+	return cmd
+}
+
+func runCommitOffset(cmd *cobra.Command, args []string) error {
+	offset, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset %q: %w", args[1], err)
+	}
+	req := &api.CommitOffsetRequest{Group: args[0], Offset: offset}
+	flags := cmd.Flags()
+	if req.Log, err = flags.GetString("log"); err != nil {
+		return err
+	}
+	if req.Topic, err = flags.GetString("topic"); err != nil {
+		return err
+	}
+	if req.Partition, err = flags.GetUint32("partition"); err != nil {
+		return err
+	}
+
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = api.NewLogClient(conn).CommitOffset(context.Background(), req)
+	return err
+}
+
+func runListGroups(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := api.NewLogClient(conn).ListGroups(
+		context.Background(),
+		&api.ListGroupsRequest{},
+	)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tLOG\tOFFSET\tLAG")
+	for _, group := range res.Groups {
+		for _, offset := range group.Offsets {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%d\t%d\n",
+				group.Name,
+				formatSource(offset),
+				offset.Offset,
+				offset.Lag,
+			)
+		}
+	}
+	return w.Flush()
+}
+
+// Partitions are shown as topic/partition, the default log as -
+func formatSource(offset *api.GroupOffset) string {
+	if offset.Topic != "" {
+		return fmt.Sprintf("%s/%d", offset.Topic, offset.Partition)
+	}
+	if offset.Log == "" {
+		return "-"
+	}
+	return offset.Log
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func newKeyringCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keyring",
+		Short: "Manage the keys encrypting gossip across the cluster.",
+		Long: `Manages the keys encrypting gossip across the cluster. To rotate the
+key, install the new one, use it once every member has it and then
+remove the old one.`,
+	}
+	setupClientFlags(cmd)
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "generate",
+			Short: "Print a new random key.",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				key := make([]byte, 32)
+				if _, err := rand.Read(key); err != nil {
+					return err
+				}
+				fmt.Fprintln(
+					cmd.OutOrStdout(),
+					base64.StdEncoding.EncodeToString(key),
+				)
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the keys installed on the members.",
+			Args:  cobra.NoArgs,
+			RunE: keyringRunE(func(
+				ctx context.Context,
+				client api.AdminClient,
+				args []string,
+			) (*api.Keyring, error) {
+				res, err := client.ListKeys(ctx, &api.ListKeysRequest{})
+				return res.GetKeyring(), err
+			}),
+		},
+		&cobra.Command{
+			Use:   "install <key>",
+			Short: "Install a key on every member.",
+			Args:  cobra.ExactArgs(1),
+			RunE: keyringRunE(func(
+				ctx context.Context,
+				client api.AdminClient,
+				args []string,
+			) (*api.Keyring, error) {
+				res, err := client.InstallKey(
+					ctx,
+					&api.InstallKeyRequest{Key: args[0]},
+				)
+				return res.GetKeyring(), err
+			}),
+		},
+		&cobra.Command{
+			Use:   "use <key>",
+			Short: "Encrypt gossip with an installed key.",
+			Args:  cobra.ExactArgs(1),
+			RunE: keyringRunE(func(
+				ctx context.Context,
+				client api.AdminClient,
+				args []string,
+			) (*api.Keyring, error) {
+				res, err := client.UseKey(
+					ctx,
+					&api.UseKeyRequest{Key: args[0]},
+				)
+				return res.GetKeyring(), err
+			}),
+		},
+		&cobra.Command{
+			Use:   "remove <key>",
+			Short: "Remove a key that's no longer used from every member.",
+			Args:  cobra.ExactArgs(1),
+			RunE: keyringRunE(func(
+				ctx context.Context,
+				client api.AdminClient,
+				args []string,
+			) (*api.Keyring, error) {
+				res, err := client.RemoveKey(
+					ctx,
+					&api.RemoveKeyRequest{Key: args[0]},
+				)
+				return res.GetKeyring(), err
+			}),
+		},
+	)
+	return cmd
+}
+
+type keyringFunc func(
+	ctx context.Context,
+	client api.AdminClient,
+	args []string,
+) (*api.Keyring, error)
+
+func keyringRunE(fn keyringFunc) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		conn, err := dial(cmd)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		keyring, err := fn(
+			context.Background(),
+			api.NewAdminClient(conn),
+			args,
+		)
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		keys := make([]string, 0, len(keyring.Keys))
+		for key := range keyring.Keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(
+				out,
+				"%s [%d/%d]\n",
+				key,
+				keyring.Keys[key],
+				keyring.NumNodes,
+			)
+		}
+		for name, msg := range keyring.Messages {
+			fmt.Fprintf(out, "%s: %s\n", name, msg)
+		}
+		if keyring.NumErrors != 0 {
+			return fmt.Errorf(
+				"%d/%d members failed",
+				keyring.NumErrors,
+				keyring.NumNodes,
+			)
+		}
+		return nil
+	}
+}
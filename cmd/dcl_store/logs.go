@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func newLogsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Manage the cluster's named logs.",
+		Long: `Manages the cluster's named logs. Every server keeps every log, and
+requests that don't name a log go to the default one.`,
+	}
+	setupClientFlags(cmd)
+
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a named log.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runCreateLog,
+	}
+	create.Flags().Uint64(
+		"max-store-bytes",
+		0,
+		"Size of the log's segments' stores, the servers' own if 0.",
+	)
+	create.Flags().Uint64(
+		"max-index-bytes",
+		0,
+		"Size of the log's segments' indexes, the servers' own if 0.",
+	)
+
+	cmd.AddCommand(
+		create,
+		&cobra.Command{
+			Use:   "delete <name>",
+			Short: "Delete a named log and its records.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  runDeleteLog,
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the named logs.",
+			Args:  cobra.NoArgs,
+			RunE:  runListLogs,
+		},
+	)
+	return cmd
+}
+
+func runCreateLog(cmd *cobra.Command, args []string) error {
+	config := &api.LogConfig{}
+	var err error
+	config.MaxStoreBytes, err = cmd.Flags().GetUint64("max-store-bytes")
+	if err != nil {
+		return err
+	}
+	config.MaxIndexBytes, err = cmd.Flags().GetUint64("max-index-bytes")
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = api.NewAdminClient(conn).CreateLog(
+		context.Background(),
+		&api.CreateLogRequest{Name: args[0], Config: config},
+	)
+	return err
+}
+
+func runDeleteLog(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = api.NewAdminClient(conn).DeleteLog(
+		context.Background(),
+		&api.DeleteLogRequest{Name: args[0]},
+	)
+	return err
+}
+
+func runListLogs(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := api.NewAdminClient(conn).ListLogs(
+		context.Background(),
+		&api.ListLogsRequest{},
+	)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMAX STORE BYTES\tMAX INDEX BYTES")
+	for _, log := range res.Logs {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\n",
+			log.Name,
+			formatBytes(log.Config.GetMaxStoreBytes()),
+			formatBytes(log.Config.GetMaxIndexBytes()),
+		)
+	}
+	return w.Flush()
+}
+
+// Unset sizes fall back on the servers' own
+func formatBytes(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
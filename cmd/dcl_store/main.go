@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/nickstrad/dcl_store/internal/agent"
 	"github.com/nickstrad/dcl_store/internal/config"
@@ -26,6 +27,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	cmd.AddCommand(newRecoverCmd())
+	cmd.AddCommand(newKeyringCmd())
+	cmd.AddCommand(newMembersCmd())
+	cmd.AddCommand(newLogsCmd())
+	cmd.AddCommand(newTopicsCmd())
+	cmd.AddCommand(newGroupsCmd())
+
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -51,10 +59,27 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 
 	c.cfg.DataDir = viper.GetString("data-dir")
 	c.cfg.NodeName = viper.GetString("node-name")
+	c.cfg.NodeID = viper.GetString("node-id")
+	c.cfg.Zone = viper.GetString("zone")
+	c.cfg.Role = viper.GetString("role")
 	c.cfg.BindAddr = viper.GetString("bind-addr")
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
+	c.cfg.StartJoinDNS = viper.GetStringSlice("start-join-dns")
+	c.cfg.StartJoinFile = viper.GetString("start-join-file")
+	c.cfg.RetryJoinInterval = viper.GetDuration("retry-join-interval")
+	c.cfg.RetryJoinMaxInterval = viper.GetDuration("retry-join-max-interval")
+	c.cfg.RetryJoinMaxAttempts = viper.GetInt("retry-join-max-attempts")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.BootstrapExpect = viper.GetInt("bootstrap-expect")
+	c.cfg.LeaveOnShutdown = viper.GetBool("leave-on-shutdown")
+	c.cfg.DrainTimeout = viper.GetDuration("drain-timeout")
+	c.cfg.ReconcileInterval = viper.GetDuration("reconcile-interval")
+	c.cfg.ReapFailedTimeout = viper.GetDuration("reap-failed-timeout")
+	c.cfg.Autopilot = viper.GetBool("autopilot")
+	c.cfg.ServerStabilizationTime = viper.GetDuration("server-stabilization-time")
+	c.cfg.ClusterID = viper.GetString("cluster-id")
+	c.cfg.EncryptKey = viper.GetString("encrypt")
 	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
@@ -113,7 +138,11 @@ func setupFlags(cmd *cobra.Command) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cmd.Flags().String("node-name", hostname, "Unique server ID.")
+	cmd.Flags().String("node-name", hostname, "Human readable server name.")
+	cmd.Flags().String("node-id", "", "Unique server ID, generated on first start and kept in the data dir if empty.")
+
+	cmd.Flags().String("zone", "", "Zone the server runs in, advertised to clients.")
+	cmd.Flags().String("role", "", "Role of the server, advertised to clients.")
 
 	dataDir := path.Join(os.TempDir(), "dcl-store")
 	cmd.Flags().String("data-dir", dataDir, "Directory to store log and Raft data.")
@@ -121,7 +150,21 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().String("bind-addr", "127.0.0.1:8401", "Address to bind serf on.")
 	cmd.Flags().Int("rpc-port", 8400, "Port for RPC clients (and Raft) connections.")
 	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf addresses to join.")
+	cmd.Flags().StringSlice("start-join-dns", nil, "DNS names to look up serf addresses to join in, SRV records if they start with an underscore.")
+	cmd.Flags().String("start-join-file", "", "File listing serf addresses to join, re-read when it changes.")
+	cmd.Flags().Duration("retry-join-interval", time.Second, "Wait between join attempts, doubling after each failure.")
+	cmd.Flags().Duration("retry-join-max-interval", 30*time.Second, "Longest wait between join attempts.")
+	cmd.Flags().Int("retry-join-max-attempts", 0, "Give up joining after this many attempts, 0 retries forever.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Int("bootstrap-expect", 0, "Number of servers to wait for before bootstrapping the cluster together.")
+	cmd.Flags().Bool("leave-on-shutdown", false, "Remove this node from the Raft configuration on shutdown.")
+	cmd.Flags().Duration("drain-timeout", 10*time.Second, "How long in-flight RPCs get to finish on shutdown.")
+	cmd.Flags().Duration("reconcile-interval", 30*time.Second, "How often the leader reconciles serf members with Raft.")
+	cmd.Flags().Duration("reap-failed-timeout", 72*time.Hour, "How long a member may be failed before it's removed.")
+	cmd.Flags().Bool("autopilot", false, "Add new servers as non-voters and promote them once stable.")
+	cmd.Flags().Duration("server-stabilization-time", 10*time.Second, "How long a server has to be healthy before it's promoted.")
+	cmd.Flags().String("cluster-id", "", "Only join the cluster with this ID, learned from the start-join servers if empty.")
+	cmd.Flags().String("encrypt", "", "Base64 key encrypting gossip, ignored once the keyring in the data dir exists.")
 	cmd.Flags().String("acl-model-file", "", "Path to ACL Model")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy")
 	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert.")
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func newMembersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "members",
+		Short: "List the serf members with their place in the Raft configuration.",
+		Args:  cobra.NoArgs,
+		RunE:  runMembers,
+	}
+	setupClientFlags(cmd)
+	return cmd
+}
+
+func runMembers(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := api.NewAdminClient(conn).ListMembers(
+		context.Background(),
+		&api.ListMembersRequest{},
+	)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tSINCE\tRAFT\tPROTOCOL\tTAGS")
+	for _, member := range res.Members {
+		since := "-"
+		if member.StatusSince != nil {
+			since = member.StatusSince.AsTime().Format(time.RFC3339)
+		}
+		suffrage := member.Suffrage
+		if suffrage == "" {
+			suffrage = "-"
+		}
+		if member.IsLeader {
+			suffrage += " (leader)"
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			member.Name,
+			member.Address,
+			member.Status,
+			since,
+			suffrage,
+			member.ProtocolCur,
+			formatTags(member.Tags),
+		)
+	}
+	return w.Flush()
+}
+
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/hashicorp/raft"
+	"github.com/nickstrad/dcl_store/internal/agent"
+	"github.com/nickstrad/dcl_store/internal/log"
+	"github.com/spf13/cobra"
+)
+
+func newRecoverCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Rewrite the Raft configuration of a stopped server after losing quorum.",
+		Long: `Rewrites the Raft configuration of a stopped server to the servers
+listed in the peers file. Run it with the same peers file on every
+surviving server before starting any of them again.
+
+The peers file is a JSON list of the servers to keep:
+
+  [
+    {"id": "node-1", "address": "10.0.0.1:8400", "non_voter": false}
+  ]`,
+		RunE: runRecover,
+	}
+
+	cmd.Flags().String("node-id", "", "Unique server ID, read from the data dir if empty.")
+	cmd.Flags().String("data-dir", path.Join(os.TempDir(), "dcl-store"), "Directory to store log and Raft data.")
+	cmd.Flags().String("peers-file", "", "Path to the JSON list of servers to recover the cluster with.")
+	cmd.Flags().Bool("dry-run", false, "Only show the configuration and last index on disk.")
+	return cmd
+}
+
+func runRecover(cmd *cobra.Command, args []string) error {
+	dataDir, err := cmd.Flags().GetString("data-dir")
+	if err != nil {
+		return err
+	}
+	nodeID, err := cmd.Flags().GetString("node-id")
+	if err != nil {
+		return err
+	}
+	peersFile, err := cmd.Flags().GetString("peers-file")
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	state, err := log.ReadRecoveryState(dataDir, log.Config{})
+	if err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "last index: %d (term %d)\n", state.LastIndex, state.LastTerm)
+	fmt.Fprintln(out, "current configuration:")
+	printServers(out, state.Configuration)
+
+	if peersFile == "" {
+		if dryRun {
+			return nil
+		}
+		return fmt.Errorf("peers-file is required")
+	}
+	configuration, err := raft.ReadConfigJSON(peersFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "recovered configuration:")
+	printServers(out, configuration)
+	if dryRun {
+		return nil
+	}
+
+	if nodeID == "" {
+		if nodeID, err = agent.ReadNodeID(dataDir); err != nil {
+			return err
+		}
+	}
+	if nodeID == "" {
+		return fmt.Errorf("node-id is required")
+	}
+	config := log.Config{}
+	config.Raft.LocalID = raft.ServerID(nodeID)
+	if err := log.Recover(dataDir, config, configuration); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "recovered, start the server to elect a leader")
+	return nil
+}
+
+func printServers(w io.Writer, configuration raft.Configuration) {
+	for _, server := range configuration.Servers {
+		fmt.Fprintf(
+			w,
+			"  %s\t%s\t%s\n",
+			server.ID,
+			server.Address,
+			server.Suffrage,
+		)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func newTopicsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "topics",
+		Short: "Manage the cluster's topics.",
+		Long: `Manages the cluster's topics. Every partition of a topic is a log
+replicated by a Raft group of its own, and the partitions' leaders are
+spread across the servers.`,
+	}
+	setupClientFlags(cmd)
+
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a topic.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runCreateTopic,
+	}
+	create.Flags().Uint32("partitions", 1, "Number of partitions.")
+
+	cmd.AddCommand(
+		create,
+		&cobra.Command{
+			Use:   "delete <name>",
+			Short: "Delete a topic and its partitions' records.",
+			Args:  cobra.ExactArgs(1),
+			RunE:  runDeleteTopic,
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the topics.",
+			Args:  cobra.NoArgs,
+			RunE:  runListTopics,
+		},
+	)
+	return cmd
+}
+
+func runCreateTopic(cmd *cobra.Command, args []string) error {
+	partitions, err := cmd.Flags().GetUint32("partitions")
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = api.NewAdminClient(conn).CreateTopic(
+		context.Background(),
+		&api.CreateTopicRequest{Name: args[0], Partitions: partitions},
+	)
+	return err
+}
+
+func runDeleteTopic(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = api.NewAdminClient(conn).DeleteTopic(
+		context.Background(),
+		&api.DeleteTopicRequest{Name: args[0]},
+	)
+	return err
+}
+
+func runListTopics(cmd *cobra.Command, args []string) error {
+	conn, err := dial(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := api.NewAdminClient(conn).ListTopics(
+		context.Background(),
+		&api.ListTopicsRequest{},
+	)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPARTITIONS\tSERVERS")
+	for _, topic := range res.Topics {
+		var servers []string
+		for _, server := range topic.Servers {
+			servers = append(servers, server.Id)
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%s\n",
+			topic.Name,
+			topic.Partitions,
+			strings.Join(servers, ","),
+		)
+	}
+	return w.Flush()
+}
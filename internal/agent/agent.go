@@ -2,14 +2,21 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	api "github.com/nickstrad/dcl_store/api/v1"
 	"github.com/nickstrad/dcl_store/internal/auth"
 	"github.com/nickstrad/dcl_store/internal/discovery"
 	"github.com/nickstrad/dcl_store/internal/log"
@@ -26,9 +33,14 @@ type Agent struct {
 	log        *log.DistributedLog
 	server     *grpc.Server
 	membership *discovery.Membership
+	logger     *zap.Logger
+	clusterID  *log.ClusterID
+	// Connects to the other servers for their Raft stats
+	statsFetcher *statsFetcher
 
 	shutdown     bool
 	shutdowns    chan struct{}
+	drains       chan struct{}
 	shutdownLock sync.Mutex
 }
 
@@ -38,24 +50,72 @@ type Config struct {
 	DataDir         string
 	BindAddr        string
 	RPCPort         int
-	NodeName        string
-	StartJoinAddrs  []string
-	ACLModelFile    string
-	ACLPolicyFile   string
-	Bootstrap       bool
+	// Human readable name, advertised as a tag
+	NodeName string
+	// Advertised as tags, so clients can prefer servers in their zone
+	// or of a given role
+	Zone string
+	Role string
+	// Identifies the server to Raft and serf. Generated on first start
+	// and persisted in the data dir if empty.
+	NodeID         string
+	StartJoinAddrs []string
+	// Seeds looked up in DNS and read from a file, see discovery.Config
+	StartJoinDNS  []string
+	StartJoinFile string
+	// Joining is retried in the background with a backoff, so servers
+	// can start in any order
+	RetryJoinInterval    time.Duration
+	RetryJoinMaxInterval time.Duration
+	RetryJoinMaxAttempts int
+	ACLModelFile         string
+	ACLPolicyFile        string
+	Bootstrap            bool
+	// Wait for this many servers to show up in serf and bootstrap them
+	// all together, instead of bootstrapping a single node
+	BootstrapExpect int
+	// Remove this node from the Raft configuration on shutdown instead
+	// of keeping its place for when it comes back
+	LeaveOnShutdown bool
+	// How long in-flight RPCs get to finish on shutdown before their
+	// connections are closed
+	DrainTimeout time.Duration
+	// How often the leader reconciles serf members with Raft
+	ReconcileInterval time.Duration
+	// How long a member may be failed before it leaves the cluster
+	ReapFailedTimeout time.Duration
+	// Add new servers as non-voters and promote them once they've been
+	// healthy for the stabilization time
+	Autopilot               bool
+	ServerStabilizationTime time.Duration
+	// Base64 encoded key encrypting gossip. Only used until the keyring
+	// persisted in the data dir exists.
+	EncryptKey string
+	// Only join this cluster. Servers without one generate it when they
+	// bootstrap, or take it from the cluster they join.
+	ClusterID string
 }
 
 func New(config Config) (*Agent, error) {
 	a := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
+		drains:    make(chan struct{}),
+	}
+	if a.Config.DrainTimeout == 0 {
+		a.Config.DrainTimeout = 10 * time.Second
+	}
+	if a.Config.Bootstrap && a.Config.BootstrapExpect != 0 {
+		return nil, fmt.Errorf("bootstrap and bootstrap-expect are exclusive")
 	}
 	setup := []func() error{
 		a.setupLogger,
+		a.setupNodeID,
+		a.setupClusterID,
 		a.setupMux,
 		a.setupLog,
-		a.setupServer,
 		a.setupMembership,
+		a.setupServer,
 	}
 
 	for _, fn := range setup {
@@ -64,6 +124,13 @@ func New(config Config) (*Agent, error) {
 		}
 	}
 
+	if a.Config.BootstrapExpect != 0 {
+		go a.bootstrapExpect()
+	}
+	if a.clusterID.Get() == "" {
+		go a.learnClusterID()
+	}
+
 	go a.serve()
 	return a, nil
 }
@@ -84,9 +151,41 @@ func (a *Agent) setupLogger() error {
 		return err
 	}
 	zap.ReplaceGlobals(logger)
+	a.logger = logger.Named("agent")
+	return nil
+}
+
+func (a *Agent) setupNodeID() error {
+	id, err := loadNodeID(
+		a.Config.DataDir,
+		a.Config.NodeID,
+		a.Config.NodeName,
+	)
+	if err != nil {
+		return err
+	}
+	a.Config.NodeID = id
 	return nil
 }
 
+func (a *Agent) setupClusterID() error {
+	var err error
+	a.clusterID, err = log.LoadClusterID(a.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	id := a.Config.ClusterID
+	if id == "" && a.clusterID.Get() == "" && a.Config.Bootstrap {
+		if id, err = log.NewClusterID(); err != nil {
+			return err
+		}
+	}
+	if id == "" {
+		return nil
+	}
+	return a.clusterID.Set(id)
+}
+
 func (a *Agent) setupLog() error {
 	raftLn := a.mux.Match(func(reader io.Reader) bool {
 		b := make([]byte, 1)
@@ -95,6 +194,25 @@ func (a *Agent) setupLog() error {
 		}
 		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
 	})
+	// the partitions' Raft groups share the listener too
+	groupLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftGroupRPC)})
+	})
+
+	// the mux listens on every interface, Raft knows this server by the
+	// address the rest of the cluster dials
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
 
 	logConfig := log.Config{}
 	logConfig.Raft.StreamLayer = log.NewStreamLayer(
@@ -102,9 +220,20 @@ func (a *Agent) setupLog() error {
 		a.Config.ServerTLSConfig,
 		a.Config.PeerTLSConfig,
 	)
-	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
+	logConfig.Raft.StreamLayer.Advertise(advertise)
+	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeID)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
-	var err error
+	logConfig.Raft.ClusterID = a.clusterID
+	logConfig.Autopilot.Enabled = a.Config.Autopilot
+	logConfig.Autopilot.ServerStabilizationTime = a.Config.ServerStabilizationTime
+	a.statsFetcher = &statsFetcher{tlsConfig: a.Config.PeerTLSConfig}
+	logConfig.Raft.StatsFetcher = a.statsFetcher
+	logConfig.Topics.Mux = log.NewStreamMux(
+		groupLn,
+		a.Config.ServerTLSConfig,
+		a.Config.PeerTLSConfig,
+	)
+	logConfig.Topics.Mux.Advertise(advertise)
 	a.log, err = log.NewDistributedLog(
 		a.Config.DataDir,
 		logConfig,
@@ -127,9 +256,21 @@ func (a *Agent) setupServer() error {
 	)
 
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:        a.log,
+		ProducerLog:      a.log,
+		ConditionalLog:   a.log,
+		TransactionLog:   a.log,
+		LogManager:       logManager{a.log},
+		TopicManager:     logManager{a.log},
+		GroupLog:         a.log,
+		GroupCoordinator: a.log,
+		Authorizer:       authorizer,
+		GetServerer:      a.log,
+		ServerWatcher:    a.log,
+		ClusterAdmin:     a.log,
+		Keyring:          a.membership,
+		MemberLister:     a.membership,
+		Drain:            a.drains,
 	}
 
 	var opts []grpc.ServerOption
@@ -160,15 +301,45 @@ func (a *Agent) setupMembership() error {
 		return err
 	}
 
+	tags := map[string]string{
+		"rpc_addr":  rpcAddr,
+		"node_name": a.Config.NodeName,
+	}
+	if a.Config.Zone != "" {
+		tags["zone"] = a.Config.Zone
+	}
+	if a.Config.Role != "" {
+		tags["role"] = a.Config.Role
+	}
+	if a.Config.BootstrapExpect != 0 {
+		tags[bootstrapExpectTag] = strconv.Itoa(a.Config.BootstrapExpect)
+	}
+
+	var encryptKey []byte
+	if a.Config.EncryptKey != "" {
+		encryptKey, err = base64.StdEncoding.DecodeString(a.Config.EncryptKey)
+		if err != nil {
+			return fmt.Errorf("invalid encrypt key: %w", err)
+		}
+	}
+
 	a.membership, err = discovery.New(
 		a.log,
 		discovery.Config{
-			NodeName: a.Config.NodeName,
-			BindAddr: a.Config.BindAddr,
-			Tags: map[string]string{
-				"rpc_addr": rpcAddr,
-			},
-			StartJoinAddrs: a.Config.StartJoinAddrs,
+			NodeName:             a.Config.NodeID,
+			BindAddr:             a.Config.BindAddr,
+			Tags:                 tags,
+			StartJoinAddrs:       a.Config.StartJoinAddrs,
+			StartJoinDNS:         a.Config.StartJoinDNS,
+			StartJoinFile:        a.Config.StartJoinFile,
+			RetryJoinInterval:    a.Config.RetryJoinInterval,
+			RetryJoinMaxInterval: a.Config.RetryJoinMaxInterval,
+			RetryJoinMaxAttempts: a.Config.RetryJoinMaxAttempts,
+			ClusterID:            a.clusterID.Get(),
+			EncryptKey:           encryptKey,
+			KeyringFile:          filepath.Join(a.Config.DataDir, "serf", "keyring"),
+			ReconcileInterval:    a.Config.ReconcileInterval,
+			ReapFailedTimeout:    a.Config.ReapFailedTimeout,
 		},
 	)
 
@@ -176,6 +347,152 @@ func (a *Agent) setupMembership() error {
 
 }
 
+const bootstrapExpectTag = "bootstrap_expect"
+
+// Polls serf until the expected number of servers advertising the same
+// bootstrap_expect tag are alive, then bootstraps Raft with all of them.
+// It gives up if more show up than expected.
+// Every server sorts the same members into the same configuration, so
+// they all bootstrap one cluster rather than several.
+func (a *Agent) bootstrapExpect() {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdowns:
+			return
+		case <-ticker.C:
+		}
+
+		servers, ok, err := a.expectedServers()
+		if err != nil {
+			// bootstrapping some of them would leave the others out of
+			// the cluster, or in another one
+			a.logger.Error("won't bootstrap", zap.Error(err))
+			return
+		}
+		if !ok {
+			continue
+		}
+		if a.clusterID.Get() == "" {
+			if err := a.setClusterID(log.ClusterIDFor(servers)); err != nil {
+				a.logger.Error("failed to set cluster ID", zap.Error(err))
+				return
+			}
+		}
+		if err := a.log.Bootstrap(servers); err != nil {
+			a.logger.Error("failed to bootstrap", zap.Error(err))
+			continue
+		}
+		a.logger.Info(
+			"bootstrapped cluster",
+			zap.Int("servers", len(servers)),
+		)
+		return
+	}
+}
+
+// Takes the cluster ID advertised by the seeds this server joined, so
+// the leader lets it in and it refuses other clusters from then on.
+// Other members are ignored, the serf pool may well be shared with
+// another cluster.
+func (a *Agent) learnClusterID() {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdowns:
+			return
+		case <-ticker.C:
+		}
+		if a.clusterID.Get() != "" {
+			return
+		}
+
+		var seeds []*net.TCPAddr
+		for _, addr := range a.membership.Seeds() {
+			seed, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				continue
+			}
+			seeds = append(seeds, seed)
+		}
+
+		ids := make(map[string]bool)
+		for _, member := range a.membership.Members() {
+			id, ok := member.Tags[discovery.ClusterIDTag]
+			if !ok || member.Status != serf.StatusAlive {
+				continue
+			}
+			for _, seed := range seeds {
+				if seed.IP.Equal(member.Addr) && seed.Port == int(member.Port) {
+					ids[id] = true
+				}
+			}
+		}
+		if len(ids) > 1 {
+			a.logger.Error("seeds advertise different cluster IDs")
+			continue
+		}
+		for id := range ids {
+			if err := a.setClusterID(id); err != nil {
+				a.logger.Error("failed to set cluster ID", zap.Error(err))
+				continue
+			}
+			a.logger.Info("joined cluster", zap.String("cluster_id", id))
+			return
+		}
+	}
+}
+
+func (a *Agent) setClusterID(id string) error {
+	if err := a.clusterID.Set(id); err != nil {
+		return err
+	}
+	return a.membership.SetClusterID(id)
+}
+
+// The servers to bootstrap once exactly the expected number are alive
+func (a *Agent) expectedServers() ([]raft.Server, bool, error) {
+	expect := strconv.Itoa(a.Config.BootstrapExpect)
+	var servers []raft.Server
+	for _, member := range a.membership.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		tag, ok := member.Tags[bootstrapExpectTag]
+		if !ok {
+			continue
+		}
+		if tag != expect {
+			a.logger.Error(
+				"member expects a different cluster size",
+				zap.String("name", member.Name),
+				zap.String(bootstrapExpectTag, tag),
+			)
+			return nil, false, nil
+		}
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(member.Name),
+			Address: raft.ServerAddress(member.Tags["rpc_addr"]),
+		})
+	}
+	if len(servers) > a.Config.BootstrapExpect {
+		return nil, false, fmt.Errorf(
+			"%d servers expect a cluster of %d",
+			len(servers),
+			a.Config.BootstrapExpect,
+		)
+	}
+	if len(servers) < a.Config.BootstrapExpect {
+		return nil, false, nil
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	return servers, true, nil
+}
+
 func (c Config) RPCAddr() (string, error) {
 	host, _, err := net.SplitHostPort(c.BindAddr)
 	if err != nil {
@@ -195,12 +512,11 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
-		func() error {
-			a.server.GracefulStop()
-			return nil
-		},
+		a.transferLeadership,
+		a.leave,
+		a.drain,
 		a.log.Close,
+		a.statsFetcher.close,
 	}
 
 	for _, fn := range shutdown {
@@ -212,6 +528,48 @@ func (a *Agent) Shutdown() error {
 	return nil
 }
 
+// Moves leadership to another voter so the cluster doesn't sit
+// leaderless until an election timeout once this node goes away
+func (a *Agent) transferLeadership() error {
+	if !a.log.IsLeader() {
+		return nil
+	}
+	if err := a.log.TransferLeadership(""); err != nil {
+		// e.g. single node clusters have nobody to transfer to
+		a.logger.Warn("failed to transfer leadership", zap.Error(err))
+	}
+	return nil
+}
+
+// Leaving serf makes the leader remove this node from the Raft
+// configuration, otherwise it stays a member that is only failed
+func (a *Agent) leave() error {
+	if a.Config.LeaveOnShutdown {
+		if err := a.membership.Leave(); err != nil {
+			return err
+		}
+	}
+	return a.membership.Shutdown()
+}
+
+// Stops accepting new RPCs and gives in-flight ones until the drain
+// timeout to finish before their connections are closed
+func (a *Agent) drain() error {
+	close(a.drains)
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(a.Config.DrainTimeout):
+		a.logger.Warn("drain timed out, closing connections")
+		a.server.Stop()
+	}
+	return nil
+}
+
 func (a *Agent) serve() error {
 	if err := a.mux.Serve(); err != nil {
 		_ = a.Shutdown()
@@ -219,3 +577,99 @@ func (a *Agent) serve() error {
 	}
 	return nil
 }
+
+var _ log.StatsFetcher = (*statsFetcher)(nil)
+
+// Fetches other servers' Raft stats over their admin API, so the peer
+// certificate needs the read-cluster permission
+type statsFetcher struct {
+	tlsConfig *tls.Config
+
+	mu sync.Mutex
+	// Kept open for the next fetches, by address
+	conns map[string]*grpc.ClientConn
+}
+
+func (f *statsFetcher) FetchStats(
+	ctx context.Context,
+	addr string,
+) (map[string]string, error) {
+	conn, err := f.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := api.NewAdminClient(conn).GetStats(
+		ctx,
+		&api.GetStatsRequest{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.Stats, nil
+}
+
+// Dials the server the first time its stats are fetched, the connection
+// reconnects by itself if the server goes away
+func (f *statsFetcher) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+	var opts []grpc.DialOption
+	if f.tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(
+			credentials.NewTLS(f.tlsConfig),
+		))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if f.conns == nil {
+		f.conns = make(map[string]*grpc.ClientConn)
+	}
+	f.conns[addr] = conn
+	return conn, nil
+}
+
+func (f *statsFetcher) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		delete(f.conns, addr)
+		if err := conn.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	_ server.LogManager   = logManager{}
+	_ server.TopicManager = logManager{}
+)
+
+// Hands the server the distributed log's named logs and topics'
+// partitions as commit logs
+type logManager struct {
+	*log.DistributedLog
+}
+
+func (m logManager) Log(name string) (server.CommitLog, error) {
+	l, err := m.DistributedLog.Log(name)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (m logManager) Partition(topic string, id uint32) (server.CommitLog, error) {
+	p, err := m.DistributedLog.Partition(topic, id)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
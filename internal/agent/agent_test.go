@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +23,316 @@ import (
 )
 
 func TestAgent(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, nil)
+
+	// delay to let agents setup
+	time.Sleep(3 * time.Second)
+
+	// get first agent as "leader" agent
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	appendResponse, err := leaderClient.Append(
+		context.Background(),
+		&api.AppendRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	// delay for replication
+	time.Sleep(3 * time.Second)
+
+	readResponse, err := leaderClient.Read(context.Background(),
+		&api.ReadRequest{
+			Offset: appendResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, readResponse.Record.Value, []byte("foo"))
+
+	// get another agent that should have data replicated to it by now
+	followerClient := client(t, agents[1], peerTLSConfig)
+	readResponse, err = followerClient.Read(
+		context.Background(),
+		&api.ReadRequest{
+			Offset: appendResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, readResponse.Record.Value, []byte("foo"))
+
+	readResponse, err = leaderClient.Read(
+		context.Background(),
+		&api.ReadRequest{
+			Offset: appendResponse.Offset + 1,
+		},
+	)
+	require.Nil(t, readResponse)
+	require.Error(t, err)
+	got := status.Code(err)
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, got, want)
+}
+
+func client(
+	t *testing.T,
+	agent *agent.Agent,
+	tlsConfig *tls.Config,
+) api.LogClient {
+	tlsCreds := credentials.NewTLS(tlsConfig)
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(tlsCreds),
+	}
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Scheme, rpcAddr),
+		opts...,
+	)
+	require.NoError(t, err)
+	client := api.NewLogClient(conn)
+	return client
+}
+
+func TestAgentShutdown(t *testing.T) {
+	for scenario, leaveOnShutdown := range map[string]bool{
+		"shutdown keeps the node in the cluster": false,
+		"shutdown removes the node when leaving": true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+				c.LeaveOnShutdown = leaveOnShutdown
+			})
+
+			require.Eventually(t, func() bool {
+				peers := listPeers(t, agents[0], peerTLSConfig)
+				return len(peers.Peers) == 3
+			}, 3*time.Second, 100*time.Millisecond)
+
+			require.NoError(t, agents[0].Shutdown())
+
+			// leadership was handed over, so a new leader shows up
+			// well before the one second election timeout
+			var peers *api.ListPeersResponse
+			require.Eventually(t, func() bool {
+				peers = listPeers(t, agents[1], peerTLSConfig)
+				for _, peer := range peers.Peers {
+					if peer.IsLeader && peer.Id != "0" {
+						return true
+					}
+				}
+				return false
+			}, 500*time.Millisecond, 50*time.Millisecond)
+
+			if !leaveOnShutdown {
+				require.Equal(t, 3, len(peers.Peers))
+				return
+			}
+			require.Eventually(t, func() bool {
+				peers := listPeers(t, agents[1], peerTLSConfig)
+				return len(peers.Peers) == 2
+			}, 3*time.Second, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestAgentBootstrapExpect(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		c.Bootstrap = false
+		c.BootstrapExpect = 3
+	})
+
+	// every agent bootstrapped the same configuration, so they all
+	// agree on one leader and three voters
+	require.Eventually(t, func() bool {
+		var leaders []string
+		for _, agent := range agents {
+			peers := listPeers(t, agent, peerTLSConfig)
+			if len(peers.Peers) != 3 {
+				return false
+			}
+			for _, peer := range peers.Peers {
+				if peer.IsLeader {
+					leaders = append(leaders, peer.Id)
+				}
+			}
+		}
+		return len(leaders) == 3 &&
+			leaders[0] == leaders[1] &&
+			leaders[1] == leaders[2]
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestAgentAutopilot(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		c.Autopilot = true
+		c.ServerStabilizationTime = time.Second
+	})
+
+	// servers join as non-voters and get promoted once they're stable
+	require.Eventually(t, func() bool {
+		peers := listPeers(t, agents[0], peerTLSConfig)
+		if len(peers.Peers) != 3 {
+			return false
+		}
+		for _, peer := range peers.Peers {
+			if peer.Suffrage != "Voter" {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 250*time.Millisecond)
+
+	conn := dial(t, agents[0], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := api.NewAdminClient(conn).GetHealth(
+			context.Background(),
+			&api.GetHealthRequest{},
+		)
+		require.NoError(t, err)
+		return res.Health.Healthy && res.Health.FailureTolerance == 1
+	}, 5*time.Second, 250*time.Millisecond)
+}
+
+func TestAgentClusterID(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, func(c *agent.Config) {
+		if c.NodeName == "2" {
+			c.ClusterID = "staging"
+		}
+	})
+
+	// the agent pointed at the wrong cluster is never added to Raft
+	require.Eventually(t, func() bool {
+		return len(listPeers(t, agents[0], peerTLSConfig).Peers) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+	time.Sleep(time.Second)
+	peers := listPeers(t, agents[0], peerTLSConfig).Peers
+	require.Equal(t, 2, len(peers))
+	for _, peer := range peers {
+		require.NotEqual(t, "2", peer.Id)
+	}
+
+	// the agent that joined learned the bootstrapped cluster's ID
+	clusterID := func(a *agent.Agent) string {
+		b, err := ioutil.ReadFile(
+			filepath.Join(a.Config.DataDir, "cluster_id"),
+		)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(b))
+	}
+	require.NotEmpty(t, clusterID(agents[0]))
+	require.Equal(t, clusterID(agents[0]), clusterID(agents[1]))
+	require.Equal(t, "staging", clusterID(agents[2]))
+}
+
+func TestAgentMembers(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, nil)
+	require.Eventually(t, func() bool {
+		return len(listPeers(t, agents[0], peerTLSConfig).Peers) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// gossip notices the dead agent while Raft keeps it as a voter
+	require.NoError(t, agents[2].Shutdown())
+	conn := dial(t, agents[0], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := api.NewAdminClient(conn).ListMembers(
+			context.Background(),
+			&api.ListMembersRequest{},
+		)
+		require.NoError(t, err)
+		for _, member := range res.Members {
+			if member.Name == "2" {
+				return member.Status == "failed" &&
+					member.Suffrage == "Voter" &&
+					member.Tags["node_name"] == "2"
+			}
+		}
+		return false
+	}, 10*time.Second, 250*time.Millisecond)
+}
+
+func TestAgentNodeID(t *testing.T) {
+	agents, _ := setupAgents(t, 1, func(c *agent.Config) {
+		c.NodeID = ""
+	})
+	cfg := agents[0].Config
+
+	// the generated ID is persisted with the data
+	require.NotEmpty(t, cfg.NodeID)
+	require.NotEqual(t, cfg.NodeName, cfg.NodeID)
+	id, err := agent.ReadNodeID(cfg.DataDir)
+	require.NoError(t, err)
+	require.Equal(t, cfg.NodeID, id)
+
+	// and the data dir refuses to start as another node
+	require.NoError(t, agents[0].Shutdown())
+	cfg.NodeID = "other"
+	_, err = agent.New(cfg)
+	require.Error(t, err)
+}
+
+func TestAgentTopics(t *testing.T) {
+	agents, peerTLSConfig := setupAgents(t, 3, nil)
+	require.Eventually(t, func() bool {
+		return len(listPeers(t, agents[0], peerTLSConfig).Peers) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+	ctx := context.Background()
+
+	_, err := api.NewAdminClient(dial(t, agents[0], peerTLSConfig)).CreateTopic(
+		ctx,
+		&api.CreateTopicRequest{Name: "orders", Partitions: 3},
+	)
+	require.NoError(t, err)
+
+	// the partitions' Raft groups go over the agents' RPC ports with TLS
+	var partitions []*api.Partition
+	conns := make(map[string]*grpc.ClientConn)
+	for _, agent := range agents {
+		conns[agent.Config.NodeID] = dial(t, agent, peerTLSConfig)
+	}
+	require.Eventually(t, func() bool {
+		res, err := api.NewLogClient(conns["0"]).GetServers(
+			ctx,
+			&api.GetServersRequest{},
+		)
+		require.NoError(t, err)
+		partitions = res.Partitions
+		for _, p := range partitions {
+			if p.LeaderId == "" {
+				return false
+			}
+		}
+		return len(partitions) == 3
+	}, 10*time.Second, 100*time.Millisecond)
+
+	leader := api.NewLogClient(conns[partitions[2].LeaderId])
+	res, err := leader.Append(ctx, &api.AppendRequest{
+		Topic:     "orders",
+		Partition: 2,
+		Record:    &api.Record{Value: []byte("order placed")},
+	})
+	require.NoError(t, err)
+	for _, conn := range conns {
+		require.Eventually(t, func() bool {
+			read, err := api.NewLogClient(conn).Read(ctx, &api.ReadRequest{
+				Topic:     "orders",
+				Partition: 2,
+				Offset:    res.Offset,
+			})
+			return err == nil &&
+				string(read.Record.Value) == "order placed"
+		}, 3*time.Second, 100*time.Millisecond)
+	}
+}
+
+func setupAgents(
+	t *testing.T,
+	n int,
+	fn func(*agent.Config),
+) ([]*agent.Agent, *tls.Config) {
+	t.Helper()
+
 	serverTLSConfig, err := config.SetupTLSConfig(
 		config.TLSConfig{
 			CertFile:      config.ServerCertFile,
@@ -44,7 +356,7 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 
 	var agents []*agent.Agent
-	for i := 0; i < 3; i++ {
+	for i := 0; i < n; i++ {
 
 		ports := discovery.GetPorts(2)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
@@ -61,8 +373,9 @@ func TestAgent(t *testing.T) {
 			)
 		}
 
-		agent, err := agent.New(agent.Config{
+		cfg := agent.Config{
 			NodeName:        fmt.Sprintf("%d", i),
+			NodeID:          fmt.Sprintf("%d", i),
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
@@ -72,85 +385,54 @@ func TestAgent(t *testing.T) {
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
 			Bootstrap:       i == 0,
-		})
+		}
+		if fn != nil {
+			fn(&cfg)
+		}
+
+		agent, err := agent.New(cfg)
 		require.NoError(t, err)
 
 		agents = append(agents, agent)
 	}
-	defer func() {
+	t.Cleanup(func() {
 		for _, agent := range agents {
 			err := agent.Shutdown()
 			require.NoError(t, err)
 			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
 		}
-	}()
-
-	// delay to let agents setup
-	time.Sleep(3 * time.Second)
-
-	// get first agent as "leader" agent
-	leaderClient := client(t, agents[0], peerTLSConfig)
-	appendResponse, err := leaderClient.Append(
-		context.Background(),
-		&api.AppendRequest{
-			Record: &api.Record{
-				Value: []byte("foo"),
-			},
-		},
-	)
-	require.NoError(t, err)
-
-	// delay for replication
-	time.Sleep(3 * time.Second)
+	})
+	return agents, peerTLSConfig
+}
 
-	readResponse, err := leaderClient.Read(context.Background(),
-		&api.ReadRequest{
-			Offset: appendResponse.Offset,
-		},
-	)
+// dial connects straight to the agent, without the resolver
+func dial(
+	t *testing.T,
+	agent *agent.Agent,
+	tlsConfig *tls.Config,
+) *grpc.ClientConn {
+	rpcAddr, err := agent.Config.RPCAddr()
 	require.NoError(t, err)
-	require.Equal(t, readResponse.Record.Value, []byte("foo"))
-
-	// get another agent that should have data replicated to it by now
-	followerClient := client(t, agents[1], peerTLSConfig)
-	readResponse, err = followerClient.Read(
-		context.Background(),
-		&api.ReadRequest{
-			Offset: appendResponse.Offset,
-		},
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
 	)
 	require.NoError(t, err)
-	require.Equal(t, readResponse.Record.Value, []byte("foo"))
-
-	readResponse, err = leaderClient.Read(
-		context.Background(),
-		&api.ReadRequest{
-			Offset: appendResponse.Offset + 1,
-		},
-	)
-	require.Nil(t, readResponse)
-	require.Error(t, err)
-	got := status.Code(err)
-	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
-	require.Equal(t, got, want)
+	t.Cleanup(func() { conn.Close() })
+	return conn
 }
 
-func client(
+func listPeers(
 	t *testing.T,
 	agent *agent.Agent,
 	tlsConfig *tls.Config,
-) api.LogClient {
-	tlsCreds := credentials.NewTLS(tlsConfig)
-	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(tlsCreds),
-	}
-	rpcAddr, err := agent.Config.RPCAddr()
-	require.NoError(t, err)
-	conn, err := grpc.Dial(
-		fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
-		opts...,
+) *api.ListPeersResponse {
+	conn := dial(t, agent, tlsConfig)
+	defer conn.Close()
+	peers, err := api.NewAdminClient(conn).ListPeers(
+		context.Background(),
+		&api.ListPeersRequest{},
 	)
 	require.NoError(t, err)
-	client := api.NewLogClient(conn)
-	return client
+	return peers
 }
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-uuid"
+)
+
+const nodeIDFile = "node_id"
+
+// Reads the node ID persisted in the data dir, empty if the agent has
+// never started with it
+func ReadNodeID(dataDir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, nodeIDFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Loads the node ID from the data dir, or picks one and persists it on
+// first start. The ID stays with the data, so a reimaged host or a data
+// dir moved to another machine keeps its place in the cluster.
+func loadNodeID(dataDir, configured, nodeName string) (string, error) {
+	id, err := ReadNodeID(dataDir)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		if configured != "" && configured != id {
+			return "", fmt.Errorf(
+				"data dir belongs to node %s, not %s",
+				id,
+				configured,
+			)
+		}
+		return id, nil
+	}
+
+	switch {
+	case configured != "":
+		id = configured
+	case hasRaftState(dataDir):
+		// data dirs from before node IDs were persisted are known to
+		// the cluster by their node name
+		id = nodeName
+	default:
+		if id, err = uuid.GenerateUUID(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(dataDir, nodeIDFile),
+		[]byte(id+"\n"),
+		0644,
+	)
+	return id, err
+}
+
+func hasRaftState(dataDir string) bool {
+	_, err := os.Stat(filepath.Join(dataDir, "raft"))
+	return err == nil
+}
@@ -0,0 +1,214 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func (m *Membership) hasSeeds() bool {
+	return len(m.StartJoinAddrs) != 0 ||
+		len(m.StartJoinDNS) != 0 ||
+		m.StartJoinFile != ""
+}
+
+// Joins the seeds in the background, backing off between attempts, so
+// servers can start in any order. The seed file is watched from the
+// start, so fixing it gets a server whose seeds are all down to join
+// even after it gave up, and the addresses added to it later are joined
+// too.
+func (m *Membership) retryJoin() {
+	if m.StartJoinFile != "" {
+		go m.watchJoinFile()
+	}
+	wait := m.RetryJoinInterval
+	for attempt := 1; ; attempt++ {
+		n, err := m.join()
+		if err == nil {
+			m.logger.Info("joined cluster", zap.Int("members", n))
+			break
+		}
+		if m.RetryJoinMaxAttempts != 0 && attempt >= m.RetryJoinMaxAttempts {
+			m.logger.Error(
+				"giving up joining cluster",
+				zap.Error(err),
+				zap.Int("attempts", attempt),
+			)
+			return
+		}
+		m.logger.Warn(
+			"failed to join cluster",
+			zap.Error(err),
+			zap.Duration("retry_in", wait),
+		)
+		select {
+		case <-m.shutdown:
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > m.RetryJoinMaxInterval {
+			wait = m.RetryJoinMaxInterval
+		}
+	}
+}
+
+func (m *Membership) join() (int, error) {
+	seeds := m.resolveSeeds()
+	if len(seeds) == 0 {
+		return 0, fmt.Errorf("no seeds to join")
+	}
+	return m.serf.Join(seeds, true)
+}
+
+func (m *Membership) watchJoinFile() {
+	modified := m.joinFileModTime()
+	ticker := time.NewTicker(m.RetryJoinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-ticker.C:
+		}
+		t := m.joinFileModTime()
+		if t.Equal(modified) {
+			continue
+		}
+		modified = t
+		if _, err := m.join(); err != nil {
+			m.logger.Error(
+				"failed to join seeds from file",
+				zap.Error(err),
+				zap.String("file", m.StartJoinFile),
+			)
+		}
+	}
+}
+
+func (m *Membership) joinFileModTime() time.Time {
+	info, err := os.Stat(m.StartJoinFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Seeds returns the addresses found the last time the seeds were
+// resolved.
+func (m *Membership) Seeds() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.seeds
+}
+
+// Collects the static, DNS and file seeds. Sources that fail are logged
+// and skipped, the others may still be enough to join.
+func (m *Membership) resolveSeeds() []string {
+	seeds := append([]string(nil), m.StartJoinAddrs...)
+	for _, name := range m.StartJoinDNS {
+		addrs, err := m.lookupSeeds(name)
+		if err != nil {
+			m.logger.Warn(
+				"failed to look up seeds",
+				zap.Error(err),
+				zap.String("name", name),
+			)
+			continue
+		}
+		seeds = append(seeds, addrs...)
+	}
+	if m.StartJoinFile != "" {
+		addrs, err := readJoinFile(m.StartJoinFile)
+		if err != nil {
+			m.logger.Warn(
+				"failed to read seeds",
+				zap.Error(err),
+				zap.String("file", m.StartJoinFile),
+			)
+		}
+		seeds = append(seeds, addrs...)
+	}
+
+	m.mu.Lock()
+	m.seeds = seeds
+	m.mu.Unlock()
+	return seeds
+}
+
+// Names starting with an underscore are looked up as SRV records, e.g.
+// _serf._tcp.example.com, anything else as A records of host[:port]
+// with the port defaulting to ours.
+func (m *Membership) lookupSeeds(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if strings.HasPrefix(name, "_") {
+		_, srvs, err := m.Resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		var addrs []string
+		for _, srv := range srvs {
+			hosts, err := m.Resolver.LookupHost(
+				ctx,
+				strings.TrimSuffix(srv.Target, "."),
+			)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range hosts {
+				addrs = append(addrs, net.JoinHostPort(
+					host,
+					strconv.Itoa(int(srv.Port)),
+				))
+			}
+		}
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		host = name
+		if _, port, err = net.SplitHostPort(m.BindAddr); err != nil {
+			return nil, err
+		}
+	}
+	hosts, err := m.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+// Seed files list an address per line, blank lines and lines starting
+// with # are skipped
+func readJoinFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,150 @@
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/nickstrad/dcl_store/internal/discovery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryJoin(t *testing.T) {
+	ports := GetPorts(2)
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+
+	// the joining member comes up before its seed
+	m, err := New(&handler{}, Config{
+		NodeName:          "1",
+		BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		StartJoinAddrs:    []string{seedAddr},
+		RetryJoinInterval: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	time.Sleep(300 * time.Millisecond)
+	seed, err := New(&handler{}, Config{NodeName: "0", BindAddr: seedAddr})
+	require.NoError(t, err)
+	defer seed.Shutdown()
+
+	require.Eventually(t, func() bool {
+		return len(seed.Members()) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestJoinSeeds(t *testing.T) {
+	ports := GetPorts(1)
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	seed, err := New(&handler{}, Config{NodeName: "seed", BindAddr: seedAddr})
+	require.NoError(t, err)
+	defer seed.Shutdown()
+
+	resolver := setupDNS(t, ports[0])
+	dir, err := ioutil.TempDir("", "join-seeds-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	seedFile := filepath.Join(dir, "seeds")
+
+	for name, fn := range map[string]func(*Config){
+		"srv record": func(c *Config) {
+			c.StartJoinDNS = []string{"_serf._tcp.dcl.test"}
+		},
+		"a record": func(c *Config) {
+			c.StartJoinDNS = []string{
+				fmt.Sprintf("seed.dcl.test:%d", ports[0]),
+			}
+		},
+		// the file doesn't exist until after the member started and
+		// gave up joining
+		"seed file": func(c *Config) {
+			c.StartJoinFile = seedFile
+			c.RetryJoinMaxAttempts = 1
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ports := GetPorts(1)
+			c := Config{
+				NodeName:          name,
+				BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[0]),
+				Resolver:          resolver,
+				RetryJoinInterval: 100 * time.Millisecond,
+			}
+			fn(&c)
+			m, err := New(&handler{}, c)
+			require.NoError(t, err)
+			defer m.Shutdown()
+
+			if c.StartJoinFile != "" {
+				time.Sleep(300 * time.Millisecond)
+				err = ioutil.WriteFile(
+					seedFile,
+					[]byte("# seeds\n"+seedAddr+"\n"),
+					0644,
+				)
+				require.NoError(t, err)
+			}
+
+			require.Eventually(t, func() bool {
+				for _, member := range seed.Members() {
+					if member.Name == name {
+						return true
+					}
+				}
+				return false
+			}, 3*time.Second, 100*time.Millisecond)
+			require.Contains(t, m.Seeds(), seedAddr)
+		})
+	}
+}
+
+// Serves the seed's A record and an SRV record pointing at it, and
+// returns a resolver that asks this server only
+func setupDNS(t *testing.T, seedPort int) *net.Resolver {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := dns.NewServeMux()
+	mux.HandleFunc("dcl.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		var rr string
+		switch {
+		case q.Qtype == dns.TypeA && q.Name == "seed.dcl.test.":
+			rr = "seed.dcl.test. 60 IN A 127.0.0.1"
+		case q.Qtype == dns.TypeSRV && q.Name == "_serf._tcp.dcl.test.":
+			rr = "_serf._tcp.dcl.test. 60 IN SRV 0 0 " +
+				strconv.Itoa(seedPort) + " seed.dcl.test."
+		}
+		if rr != "" {
+			answer, err := dns.NewRR(rr)
+			require.NoError(t, err)
+			m.Answer = append(m.Answer, answer)
+		}
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"go.uber.org/zap"
+)
+
+// Sets up gossip encryption. Serf rewrites the keyring file whenever keys
+// are installed, used or removed, so once it exists it takes precedence
+// over the configured encrypt key.
+func (m *Membership) setupKeyring(config *serf.Config) error {
+	if m.KeyringFile == "" {
+		config.MemberlistConfig.SecretKey = m.EncryptKey
+		return nil
+	}
+	config.KeyringFile = m.KeyringFile
+
+	_, err := os.Stat(m.KeyringFile)
+	switch {
+	case os.IsNotExist(err):
+		if m.EncryptKey == nil {
+			return nil
+		}
+		if err := writeKeyringFile(
+			m.KeyringFile,
+			[][]byte{m.EncryptKey},
+		); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case m.EncryptKey != nil:
+		m.logger.Warn(
+			"keyring file exists, ignoring encrypt key",
+			zap.String("keyring_file", m.KeyringFile),
+		)
+	}
+
+	keys, err := readKeyringFile(m.KeyringFile)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	config.MemberlistConfig.Keyring, err = memberlist.NewKeyring(
+		keys,
+		keys[0],
+	)
+	return err
+}
+
+// Keyring files hold base64 encoded keys in a JSON list, primary key
+// first, the same format serf writes them in
+func readKeyringFile(path string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(encoded))
+	for _, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func writeKeyringFile(path string, keys [][]byte) error {
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(key))
+	}
+	b, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func (m *Membership) ListKeys() (*api.Keyring, error) {
+	return keyring(m.serf.KeyManager().ListKeys())
+}
+
+func (m *Membership) InstallKey(key string) (*api.Keyring, error) {
+	return keyring(m.serf.KeyManager().InstallKey(key))
+}
+
+func (m *Membership) UseKey(key string) (*api.Keyring, error) {
+	return keyring(m.serf.KeyManager().UseKey(key))
+}
+
+func (m *Membership) RemoveKey(key string) (*api.Keyring, error) {
+	return keyring(m.serf.KeyManager().RemoveKey(key))
+}
+
+// The key operations are gossiped to every member. Members that fail are
+// reported in the keyring's errors alongside the error, so callers see
+// which of them need another try.
+func keyring(res *serf.KeyResponse, err error) (*api.Keyring, error) {
+	if res == nil {
+		return nil, err
+	}
+	k := &api.Keyring{
+		Keys:         make(map[string]uint32, len(res.Keys)),
+		NumNodes:     uint32(res.NumNodes),
+		NumResponses: uint32(res.NumResp),
+		NumErrors:    uint32(res.NumErr),
+		Messages:     res.Messages,
+	}
+	for key, n := range res.Keys {
+		k.Keys[key] = uint32(n)
+	}
+	return k, err
+}
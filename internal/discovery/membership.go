@@ -3,11 +3,16 @@ package discovery
 import (
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	api "github.com/nickstrad/dcl_store/api/v1"
 	"github.com/phayes/freeport"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Config struct {
@@ -15,6 +20,30 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// Seeds looked up in DNS, SRV records for names starting with an
+	// underscore and A records of host[:port] otherwise
+	StartJoinDNS []string
+	// File listing seed addresses, re-read when it changes
+	StartJoinFile string
+	// Resolves StartJoinDNS, defaults to net.DefaultResolver
+	Resolver *net.Resolver
+	// Wait between join attempts, doubling up to the max interval
+	RetryJoinInterval    time.Duration
+	RetryJoinMaxInterval time.Duration
+	// Give up joining after this many attempts, 0 retries forever
+	RetryJoinMaxAttempts int
+	// Members advertising a different cluster ID are never joined. Empty
+	// until the server knows which cluster it belongs to.
+	ClusterID string
+	// How often the leader compares serf's members against the servers
+	// it knows about and fixes what the event handler missed
+	ReconcileInterval time.Duration
+	// How long a member may be failed before it's removed for good
+	ReapFailedTimeout time.Duration
+	// Encrypts gossip, members without the key can't join the pool
+	EncryptKey []byte
+	// Where the keyring is persisted as keys change
+	KeyringFile string
 }
 
 type Handler interface {
@@ -22,23 +51,63 @@ type Handler interface {
 	Leave(name string) error
 }
 
+// Handlers that can report the servers they know about get periodically
+// reconciled against serf while they are the leader
+type Reconciler interface {
+	Handler
+	IsLeader() bool
+	GetServers() ([]*api.Server, error)
+}
+
+const ClusterIDTag = "cluster_id"
+
 type Membership struct {
 	Config
-	handler Handler
-	serf    *serf.Serf
-	events  chan serf.Event
-	logger  *zap.Logger
+	mu          sync.RWMutex
+	handler     Handler
+	serf        *serf.Serf
+	events      chan serf.Event
+	logger      *zap.Logger
+	failedSince map[string]time.Time
+	// When the leader first saw servers serf has no member for
+	missingSince map[string]time.Time
+	statuses     map[string]memberStatus
+	seeds        []string
+	shutdown     chan struct{}
+	closeOnce    sync.Once
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
+	if config.ReconcileInterval == 0 {
+		config.ReconcileInterval = 30 * time.Second
+	}
+	if config.ReapFailedTimeout == 0 {
+		config.ReapFailedTimeout = 72 * time.Hour
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	if config.RetryJoinInterval == 0 {
+		config.RetryJoinInterval = time.Second
+	}
+	if config.RetryJoinMaxInterval == 0 {
+		config.RetryJoinMaxInterval = 30 * time.Second
+	}
 	c := &Membership{
-		Config:  config,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
+		Config:       config,
+		handler:      handler,
+		logger:       zap.L().Named("membership"),
+		failedSince:  make(map[string]time.Time),
+		missingSince: make(map[string]time.Time),
+		statuses:     make(map[string]memberStatus),
+		shutdown:     make(chan struct{}),
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
+	if r, ok := handler.(Reconciler); ok {
+		go c.reconcileLoop(r)
+	}
 	return c, nil
 }
 
@@ -55,8 +124,11 @@ func (m *Membership) setupSerf() (err error) {
 
 	m.events = make(chan serf.Event)
 	config.EventCh = m.events
-	config.Tags = m.Tags
+	config.Tags = m.tags()
 	config.NodeName = m.Config.NodeName
+	if err := m.setupKeyring(config); err != nil {
+		return err
+	}
 
 	m.serf, err = serf.Create(config)
 	if err != nil {
@@ -65,11 +137,8 @@ func (m *Membership) setupSerf() (err error) {
 
 	go m.eventHandler()
 
-	if m.StartJoinAddrs != nil {
-		_, err = m.serf.Join(m.StartJoinAddrs, true)
-		if err != nil {
-			return err
-		}
+	if m.hasSeeds() {
+		go m.retryJoin()
 	}
 
 	return nil
@@ -77,15 +146,21 @@ func (m *Membership) setupSerf() (err error) {
 
 func (m *Membership) eventHandler() {
 	for e := range m.events {
+		if e, ok := e.(serf.MemberEvent); ok {
+			m.recordStatuses(e)
+		}
 		switch e.EventType() {
-		case serf.EventMemberJoin:
+		// Members update their tags once they learn their cluster ID
+		case serf.EventMemberJoin, serf.EventMemberUpdate:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
 					continue
 				}
 				m.handleJoin(member)
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		// Failed members keep their place in the cluster so they can
+		// come back, only members that leave on purpose are removed
+		case serf.EventMemberLeave:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
 					return
@@ -96,7 +171,71 @@ func (m *Membership) eventHandler() {
 	}
 }
 
+type memberStatus struct {
+	status serf.MemberStatus
+	since  time.Time
+}
+
+// Serf doesn't keep when members changed status, so we note when we
+// saw it happen
+func (m *Membership) recordStatuses(e serf.MemberEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, member := range e.Members {
+		if e.Type == serf.EventMemberReap {
+			delete(m.statuses, member.Name)
+			continue
+		}
+		if s, ok := m.statuses[member.Name]; ok && s.status == member.Status {
+			continue
+		}
+		m.statuses[member.Name] = memberStatus{
+			status: member.Status,
+			since:  now,
+		}
+	}
+}
+
+// ListMembers returns every member serf knows about, including those
+// that left or failed.
+func (m *Membership) ListMembers() []*api.Member {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var members []*api.Member
+	for _, member := range m.serf.Members() {
+		res := &api.Member{
+			Name: member.Name,
+			Address: net.JoinHostPort(
+				member.Addr.String(),
+				strconv.Itoa(int(member.Port)),
+			),
+			Status:      member.Status.String(),
+			Tags:        member.Tags,
+			ProtocolMin: uint32(member.ProtocolMin),
+			ProtocolMax: uint32(member.ProtocolMax),
+			ProtocolCur: uint32(member.ProtocolCur),
+			DelegateMin: uint32(member.DelegateMin),
+			DelegateMax: uint32(member.DelegateMax),
+			DelegateCur: uint32(member.DelegateCur),
+		}
+		if s, ok := m.statuses[member.Name]; ok {
+			res.StatusSince = timestamppb.New(s.since)
+		}
+		members = append(members, res)
+	}
+	return members
+}
+
 func (m *Membership) handleJoin(member serf.Member) {
+	if id := m.clusterID(); id != "" && member.Tags[ClusterIDTag] != id {
+		m.logger.Warn(
+			"refusing member of another cluster",
+			zap.String("name", member.Name),
+			zap.String(ClusterIDTag, member.Tags[ClusterIDTag]),
+		)
+		return
+	}
 	if err := m.handler.Join(
 		member.Name,
 		member.Tags["rpc_addr"],
@@ -111,6 +250,134 @@ func (m *Membership) handleLeave(member serf.Member) {
 	}
 }
 
+func (m *Membership) reconcileLoop(r Reconciler) {
+	ticker := time.NewTicker(m.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-ticker.C:
+			if !r.IsLeader() {
+				continue
+			}
+			if err := m.reconcile(r); err != nil {
+				m.logger.Error("failed to reconcile", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Joins alive members missing from the servers, removes members that
+// left or stayed failed past the reap timeout, and removes servers serf
+// hasn't had a member for in as long. Serf only knows about the members
+// it has heard of since it started, so missing servers get the same
+// grace as failed ones while it catches up after a restart.
+func (m *Membership) reconcile(r Reconciler) error {
+	servers, err := r.GetServers()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]*api.Server, len(servers))
+	for _, server := range servers {
+		known[server.Id] = server
+	}
+
+	members := make(map[string]bool)
+	now := time.Now()
+	for _, member := range m.serf.Members() {
+		members[member.Name] = true
+		if member.Status != serf.StatusFailed {
+			delete(m.failedSince, member.Name)
+		}
+		if m.isLocal(member) {
+			continue
+		}
+		server, ok := known[member.Name]
+		switch member.Status {
+		case serf.StatusAlive:
+			if !ok || server.RpcAddr != member.Tags["rpc_addr"] {
+				m.handleJoin(member)
+			}
+		case serf.StatusLeft:
+			if ok {
+				m.handleLeave(member)
+			}
+		case serf.StatusFailed:
+			since, seen := m.failedSince[member.Name]
+			if !seen {
+				m.failedSince[member.Name] = now
+				continue
+			}
+			if now.Sub(since) < m.ReapFailedTimeout {
+				continue
+			}
+			if ok {
+				m.handleLeave(member)
+			}
+			if err := m.serf.RemoveFailedNode(member.Name); err != nil {
+				m.logError(err, "failed to reap", member)
+				continue
+			}
+			delete(m.failedSince, member.Name)
+		}
+	}
+
+	for id := range m.missingSince {
+		if _, ok := known[id]; !ok || members[id] {
+			delete(m.missingSince, id)
+		}
+	}
+	for id := range known {
+		if members[id] || id == m.NodeName {
+			continue
+		}
+		since, seen := m.missingSince[id]
+		if !seen {
+			m.missingSince[id] = now
+			continue
+		}
+		if now.Sub(since) < m.ReapFailedTimeout {
+			continue
+		}
+		delete(m.missingSince, id)
+		if err := r.Leave(id); err != nil {
+			m.logger.Error(
+				"failed to remove unknown server",
+				zap.Error(err),
+				zap.String("name", id),
+			)
+		}
+	}
+	return nil
+}
+
+func (m *Membership) tags() map[string]string {
+	tags := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	if id := m.clusterID(); id != "" {
+		tags[ClusterIDTag] = id
+	}
+	return tags
+}
+
+func (m *Membership) clusterID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ClusterID
+}
+
+// Advertises the cluster ID the server has joined, from then on members
+// of other clusters are refused
+func (m *Membership) SetClusterID(id string) error {
+	m.mu.Lock()
+	m.ClusterID = id
+	m.mu.Unlock()
+	return m.serf.SetTags(m.tags())
+}
+
 func (m *Membership) isLocal(member serf.Member) bool {
 	return m.serf.LocalMember().Name == member.Name
 }
@@ -120,9 +387,23 @@ func (m *Membership) Members() []serf.Member {
 }
 
 func (m *Membership) Leave() error {
+	m.stopReconcile()
 	return m.serf.Leave()
 }
 
+// Stops gossiping without announcing a leave, so the rest of the
+// cluster sees this member as failed
+func (m *Membership) Shutdown() error {
+	m.stopReconcile()
+	return m.serf.Shutdown()
+}
+
+func (m *Membership) stopReconcile() {
+	m.closeOnce.Do(func() {
+		close(m.shutdown)
+	})
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
 	if err == raft.ErrNotLeader {
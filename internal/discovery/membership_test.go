@@ -1,11 +1,19 @@
 package discovery_test
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	api "github.com/nickstrad/dcl_store/api/v1"
 	. "github.com/nickstrad/dcl_store/internal/discovery"
 	"github.com/stretchr/testify/require"
 )
@@ -26,13 +34,125 @@ func TestMembership(t *testing.T) {
 	require.Eventually(t, func() bool {
 		return len(handler.joins) == 2 &&
 			len(m[0].Members()) == 3 &&
-			serf.StatusLeft == m[0].Members()[2].Status &&
+			serf.StatusLeft == memberStatus(m[0], "2") &&
 			len(handler.leaves) == 1
 	}, 3*time.Second, 250*time.Millisecond)
 
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
+// serf lists the members in no particular order
+func memberStatus(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+func TestMembershipClusterID(t *testing.T) {
+	h := &handler{joins: make(chan map[string]string, 3)}
+	var members []*Membership
+	for i, id := range []string{"production", "staging", ""} {
+		ports := GetPorts(1)
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		c := Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			BindAddr:  addr,
+			Tags:      map[string]string{"rpc_addr": addr},
+			ClusterID: id,
+		}
+		var mh Handler = h
+		if i != 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+			mh = &handler{}
+		}
+		m, err := New(mh, c)
+		require.NoError(t, err)
+		defer m.Shutdown()
+		members = append(members, m)
+	}
+
+	// neither the staging member nor the one without an ID is joined
+	require.Eventually(t, func() bool {
+		return len(members[0].Members()) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, 0, len(h.joins))
+
+	// until it advertises the same cluster ID
+	require.NoError(t, members[2].SetClusterID("production"))
+	select {
+	case join := <-h.joins:
+		require.Equal(t, "2", join["id"])
+	case <-time.After(3 * time.Second):
+		t.Fatal("member wasn't joined after updating its cluster ID")
+	}
+}
+
+func TestMembershipKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "membership-keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := bytes.Repeat([]byte{1}, 32)
+	second := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	var members []*Membership
+	join := func(key []byte) (*Membership, error) {
+		ports := GetPorts(1)
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		c := Config{
+			NodeName:   fmt.Sprintf("%d", len(members)),
+			BindAddr:   addr,
+			Tags:       map[string]string{"rpc_addr": addr},
+			EncryptKey: key,
+			KeyringFile: filepath.Join(
+				dir,
+				fmt.Sprintf("%d", len(members)),
+				"keyring",
+			),
+		}
+		if len(members) != 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+			c.RetryJoinMaxAttempts = 1
+		}
+		return New(&handler{}, c)
+	}
+	for i := 0; i < 2; i++ {
+		m, err := join(first)
+		require.NoError(t, err)
+		defer m.Shutdown()
+		members = append(members, m)
+	}
+
+	// members without the key can't join the pool
+	outsider, err := join(nil)
+	require.NoError(t, err)
+	defer outsider.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, 2, len(members[0].Members()))
+
+	// rotate the key across the cluster
+	keyring, err := members[0].InstallKey(second)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), keyring.NumResponses)
+	_, err = members[0].UseKey(second)
+	require.NoError(t, err)
+	_, err = members[0].RemoveKey(base64.StdEncoding.EncodeToString(first))
+	require.NoError(t, err)
+
+	keyring, err = members[1].ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint32{second: 2}, keyring.Keys)
+
+	// serf persists the rotated keyring for the next start
+	b, err := ioutil.ReadFile(filepath.Join(dir, "1", "keyring"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), second)
+}
+
 type handler struct {
 	joins  chan map[string]string
 	leaves chan string
@@ -84,3 +204,99 @@ func (h *handler) Leave(id string) error {
 	}
 	return nil
 }
+
+func TestReconcile(t *testing.T) {
+	start := time.Now()
+	r := &reconciler{
+		servers: map[string]string{"ghost": "127.0.0.1:0"},
+		left:    make(map[string]time.Time),
+		// the first join lands while "leadership" is changing
+		failJoins: 1,
+	}
+
+	var members []*Membership
+	for i := 0; i < 2; i++ {
+		ports := GetPorts(1)
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		c := Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			BindAddr:          addr,
+			Tags:              map[string]string{"rpc_addr": addr},
+			ReconcileInterval: 100 * time.Millisecond,
+			ReapFailedTimeout: 200 * time.Millisecond,
+		}
+		var h Handler = r
+		if i != 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+			h = &handler{}
+		}
+		m, err := New(h, c)
+		require.NoError(t, err)
+		members = append(members, m)
+	}
+	defer members[0].Shutdown()
+
+	// the missed join is repaired and the server serf has never heard
+	// of is removed
+	require.Eventually(t, func() bool {
+		return r.has("1") && !r.has("ghost")
+	}, 3*time.Second, 100*time.Millisecond)
+	// but only after it's been missing for the reap timeout, serf may
+	// just not have heard of it yet
+	r.mu.Lock()
+	require.GreaterOrEqual(t, r.left["ghost"].Sub(start), 200*time.Millisecond)
+	r.mu.Unlock()
+
+	// a member that dies without leaving is reaped after the timeout
+	require.NoError(t, members[1].Shutdown())
+	require.Eventually(t, func() bool {
+		return !r.has("1")
+	}, 15*time.Second, 250*time.Millisecond)
+}
+
+type reconciler struct {
+	mu        sync.Mutex
+	servers   map[string]string
+	failJoins int
+	left      map[string]time.Time
+}
+
+func (r *reconciler) Join(id, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failJoins > 0 {
+		r.failJoins--
+		return raft.ErrNotLeader
+	}
+	r.servers[id] = addr
+	return nil
+}
+
+func (r *reconciler) Leave(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.servers, id)
+	r.left[id] = time.Now()
+	return nil
+}
+
+func (r *reconciler) IsLeader() bool {
+	return true
+}
+
+func (r *reconciler) GetServers() ([]*api.Server, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var servers []*api.Server
+	for id, addr := range r.servers {
+		servers = append(servers, &api.Server{Id: id, RpcAddr: addr})
+	}
+	return servers, nil
+}
+
+func (r *reconciler) has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.servers[id]
+	return ok
+}
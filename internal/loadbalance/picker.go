@@ -1,40 +1,151 @@
 package loadbalance
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 
+	api "github.com/nickstrad/dcl_store/api/v1"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 )
 
+// PickerConfig is the balancer's part of the loadBalancingConfig, e.g.
+// {"loadBalancingConfig": [{"dcl_store": {"maxLag": 100, "zone": "a"}}]}
+type PickerConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	// Followers trailing the most up to date server by more log entries
+	// don't get reads, 0 reads from every follower
+	MaxLag uint64 `json:"maxLag,omitempty"`
+	// Reads go to followers in this zone, and only to the others when
+	// none of them are available
+	Zone string `json:"zone,omitempty"`
+}
+
 var _ base.PickerBuilder = (*Picker)(nil)
 
 type Picker struct {
-	mu        sync.RWMutex
+	mu sync.RWMutex
+	// Config decides which followers get reads
+	Config PickerConfig
+	// Latest description of the servers by address. The ready SubConns
+	// keep the addresses they were created with, whose servers' progress
+	// is long out of date.
+	servers   map[string]*api.Server
 	leader    balancer.SubConn
 	followers []balancer.SubConn
 	current   uint64
+	// SubConns by the IDs of their servers, and the IDs of the topics'
+	// partitions' leaders
+	ids        map[string]balancer.SubConn
+	partitions map[string]string
+}
+
+type partitionKey struct{}
+
+// WithPartition routes the requests made with the context, other than
+// reads, to the leader of the topic's partition instead of the cluster's
+func WithPartition(
+	ctx context.Context,
+	topic string,
+	partition uint32,
+) context.Context {
+	return context.WithValue(ctx, partitionKey{}, partitionName(topic, partition))
+}
+
+func partitionName(topic string, partition uint32) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
 }
 
 func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	var followers []balancer.SubConn
+
+	type follower struct {
+		sc     balancer.SubConn
+		addr   string
+		server *api.Server
+	}
+	var followers []follower
+	var maxIndex uint64
+	p.leader = nil
+	p.ids = make(map[string]balancer.SubConn)
 	for sc, scInfo := range buildInfo.ReadySCs {
 		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
-
+		server := p.server(scInfo.Address)
+		if server != nil && server.LastIndex > maxIndex {
+			maxIndex = server.LastIndex
+		}
+		if server != nil && server.Id != "" {
+			p.ids[server.Id] = sc
+		}
 		if isLeader {
 			p.leader = sc
 			continue
 		}
-		followers = append(followers, sc)
+		followers = append(followers, follower{
+			sc:     sc,
+			addr:   scInfo.Address.Addr,
+			server: server,
+		})
+	}
+	sort.Slice(followers, func(i, j int) bool {
+		return followers[i].addr < followers[j].addr
+	})
+
+	var near, far []balancer.SubConn
+	for _, f := range followers {
+		if p.Config.MaxLag != 0 {
+			// servers that couldn't describe their progress are
+			// assumed to be behind
+			if f.server == nil || f.server.Term == 0 ||
+				f.server.AppliedIndex+p.Config.MaxLag < maxIndex {
+				continue
+			}
+		}
+		if p.Config.Zone != "" &&
+			(f.server == nil || f.server.Zone != p.Config.Zone) {
+			far = append(far, f.sc)
+			continue
+		}
+		near = append(near, f.sc)
+	}
+	p.followers = near
+	if len(near) == 0 {
+		p.followers = far
 	}
-	p.followers = followers
 	return p
 }
 
+// UpdatePartitions tells the picker which servers lead the topics'
+// partitions
+func (p *Picker) UpdatePartitions(partitions []*api.Partition) {
+	leaders := make(map[string]string, len(partitions))
+	for _, partition := range partitions {
+		name := partitionName(partition.Topic, partition.Id)
+		leaders[name] = partition.LeaderId
+	}
+	p.mu.Lock()
+	p.partitions = leaders
+	p.mu.Unlock()
+}
+
+// Prefers the latest description of the server the resolver gave to the
+// one the address was created with
+func (p *Picker) server(addr resolver.Address) *api.Server {
+	if server, ok := p.servers[addr.Addr]; ok {
+		return server
+	}
+	server, _ := addr.BalancerAttributes.Value("server").(*api.Server)
+	return server
+}
+
 var _ balancer.Picker = (*Picker)(nil)
 
 func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
@@ -43,12 +154,15 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 
 	var result balancer.PickResult
 
-	if strings.Contains(info.FullMethodName, "Append") ||
-		len(p.followers) == 0 {
-		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Read") {
+	// everything but reads goes to the leader
+	if !strings.Contains(info.FullMethodName, "Read") {
+		result.SubConn = p.partitionLeader(info.Ctx)
+	} else if len(p.followers) != 0 {
 		result.SubConn = p.nextFollower()
 	}
+	if result.SubConn == nil {
+		result.SubConn = p.leader
+	}
 
 	if result.SubConn == nil {
 		return result, balancer.ErrNoSubConnAvailable
@@ -57,6 +171,20 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	return result, nil
 }
 
+// The leader of the partition the context names, nil for requests that
+// don't name one or whose partition's leader isn't known, they go to the
+// cluster's leader, which tells the client if it isn't the partition's
+func (p *Picker) partitionLeader(ctx context.Context) balancer.SubConn {
+	if ctx == nil {
+		return nil
+	}
+	name, ok := ctx.Value(partitionKey{}).(string)
+	if !ok {
+		return nil
+	}
+	return p.ids[p.partitions[name]]
+}
+
 func (p *Picker) nextFollower() balancer.SubConn {
 	cur := atomic.AddUint64(&p.current, uint64(1))
 	len := uint64(len(p.followers))
@@ -64,8 +192,71 @@ func (p *Picker) nextFollower() balancer.SubConn {
 	return p.followers[idx]
 }
 
+var _ balancer.Builder = (*builder)(nil)
+var _ balancer.ConfigParser = (*builder)(nil)
+
+// Builds base balancers that keep their picker up to date with the
+// config and the servers the resolver reports
+type builder struct{}
+
+func (b *builder) Build(
+	cc balancer.ClientConn,
+	opts balancer.BuildOptions,
+) balancer.Balancer {
+	picker := &Picker{}
+	return &pickerBalancer{
+		Balancer: base.NewBalancerBuilder(
+			Name,
+			picker,
+			base.Config{},
+		).Build(cc, opts),
+		picker: picker,
+	}
+}
+
+func (b *builder) Name() string {
+	return Name
+}
+
+func (b *builder) ParseConfig(
+	js json.RawMessage,
+) (serviceconfig.LoadBalancingConfig, error) {
+	config := &PickerConfig{}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+type pickerBalancer struct {
+	balancer.Balancer
+	picker *Picker
+}
+
+func (b *pickerBalancer) UpdateClientConnState(
+	state balancer.ClientConnState,
+) error {
+	servers := make(map[string]*api.Server)
+	for _, addr := range state.ResolverState.Addresses {
+		server, ok := addr.BalancerAttributes.Value("server").(*api.Server)
+		if ok {
+			servers[addr.Addr] = server
+		}
+	}
+	partitions, _ := state.ResolverState.Attributes.Value(
+		"partitions",
+	).([]*api.Partition)
+	b.picker.UpdatePartitions(partitions)
+	b.picker.mu.Lock()
+	b.picker.servers = servers
+	if config, ok := state.BalancerConfig.(*PickerConfig); ok {
+		b.picker.Config = *config
+	}
+	b.picker.mu.Unlock()
+	// the base balancer rebuilds the picker with the new state
+	return b.Balancer.UpdateClientConnState(state)
+}
+
 func init() {
-	balancer.Register(
-		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
-	)
+	balancer.Register(&builder{})
 }
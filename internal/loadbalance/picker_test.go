@@ -1,8 +1,11 @@
 package loadbalance_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
 
+	api "github.com/nickstrad/dcl_store/api/v1"
 	"github.com/nickstrad/dcl_store/internal/loadbalance"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/attributes"
@@ -38,7 +41,7 @@ func TestPickerAppendsToLeader(t *testing.T) {
 	}
 }
 
-func TesetPickerReadsFromFollowers(t *testing.T) {
+func TestPickerReadsFromFollowers(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
 		FullMethodName: "/log.vX.Log/Read",
@@ -46,25 +49,155 @@ func TesetPickerReadsFromFollowers(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		pick, err := picker.Pick(info)
 		require.NoError(t, err)
-		require.Equal(t, subConns[i%2+1], pick.SubConn)
+		require.Equal(t, subConns[(i+1)%2+1], pick.SubConn)
 	}
 }
 
+func TestPickerRoutesReads(t *testing.T) {
+	servers := func() []*api.Server {
+		return []*api.Server{
+			{Term: 1, LastIndex: 100, AppliedIndex: 100, Zone: "a"},
+			{Term: 1, LastIndex: 100, AppliedIndex: 100, Zone: "a"},
+			{Term: 1, LastIndex: 40, AppliedIndex: 40, Zone: "b"},
+			{Term: 1, LastIndex: 100, AppliedIndex: 95, Zone: "b"},
+		}
+	}
+	for scenario, test := range map[string]struct {
+		config  loadbalance.PickerConfig
+		servers func([]*api.Server)
+		want    []int
+	}{
+		"every follower without a config": {
+			want: []int{1, 2, 3},
+		},
+		"skips lagging followers": {
+			config: loadbalance.PickerConfig{MaxLag: 10},
+			want:   []int{1, 3},
+		},
+		"prefers followers in the zone": {
+			config: loadbalance.PickerConfig{Zone: "b"},
+			want:   []int{2, 3},
+		},
+		"reads from other zones when the zone is lagging": {
+			config: loadbalance.PickerConfig{MaxLag: 1, Zone: "b"},
+			want:   []int{1},
+		},
+		"falls back to the leader": {
+			config: loadbalance.PickerConfig{MaxLag: 1},
+			servers: func(servers []*api.Server) {
+				servers[1].AppliedIndex = 90
+				// couldn't be reached for its stats
+				servers[3] = &api.Server{}
+			},
+			want: []int{0},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			s := servers()
+			if test.servers != nil {
+				test.servers(s)
+			}
+			picker, subConns := setupPicker(test.config, s)
+			got := make(map[balancer.SubConn]bool)
+			for i := 0; i < 10; i++ {
+				pick, err := picker.Pick(balancer.PickInfo{
+					FullMethodName: "/log.vX.Log/Read",
+				})
+				require.NoError(t, err)
+				got[pick.SubConn] = true
+			}
+			want := make(map[balancer.SubConn]bool)
+			for _, i := range test.want {
+				want[subConns[i]] = true
+			}
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestPickerRoutesToPartitionLeaders(t *testing.T) {
+	servers := []*api.Server{{Id: "0"}, {Id: "1"}, {Id: "2"}}
+	picker, subConns := setupPicker(loadbalance.PickerConfig{}, servers)
+	picker.UpdatePartitions([]*api.Partition{
+		{Topic: "orders", Id: 0, LeaderId: "2"},
+		{Topic: "orders", Id: 1, LeaderId: "1"},
+		{Topic: "orders", Id: 2, LeaderId: ""},
+	})
+
+	pick := func(ctx context.Context, method string) balancer.SubConn {
+		result, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: method,
+			Ctx:            ctx,
+		})
+		require.NoError(t, err)
+		return result.SubConn
+	}
+	append := "/log.vX.Log/Append"
+	ctx := context.Background()
+	require.Equal(t, subConns[2], pick(
+		loadbalance.WithPartition(ctx, "orders", 0),
+		append,
+	))
+	require.Equal(t, subConns[1], pick(
+		loadbalance.WithPartition(ctx, "orders", 1),
+		"/log.vX.Log/BeginTransaction",
+	))
+	// partitions without a known leader fall back on the cluster's
+	require.Equal(t, subConns[0], pick(
+		loadbalance.WithPartition(ctx, "orders", 2),
+		append,
+	))
+	require.Equal(t, subConns[0], pick(ctx, append))
+	// reads still go to the followers
+	read := pick(
+		loadbalance.WithPartition(ctx, "orders", 1),
+		"/log.vX.Log/Read",
+	)
+	require.NotEqual(t, subConns[0], read)
+}
+
+func TestPickerConfig(t *testing.T) {
+	parser := balancer.Get(loadbalance.Name).(balancer.ConfigParser)
+	config, err := parser.ParseConfig(
+		[]byte(`{"maxLag": 100, "zone": "us-east-1a"}`),
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), config.(*loadbalance.PickerConfig).MaxLag)
+	require.Equal(t, "us-east-1a", config.(*loadbalance.PickerConfig).Zone)
+}
+
 func setupTest() (*loadbalance.Picker, []*subConn) {
+	return setupPicker(loadbalance.PickerConfig{}, nil)
+}
+
+// Builds a picker over a leader and followers, described by the given
+// servers if any
+func setupPicker(
+	config loadbalance.PickerConfig,
+	servers []*api.Server,
+) (*loadbalance.Picker, []*subConn) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
 		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
 	}
-	for i := 0; i < 3; i++ {
+	n := 3
+	if servers != nil {
+		n = len(servers)
+	}
+	for i := 0; i < n; i++ {
 		sc := &subConn{}
 		addr := resolver.Address{
+			Addr:       fmt.Sprintf("127.0.0.1:900%d", i),
 			Attributes: attributes.New("is_leader", i == 0),
 		}
+		if servers != nil {
+			addr.BalancerAttributes = attributes.New("server", servers[i])
+		}
 		sc.UpdateAddresses([]resolver.Address{addr})
 		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
 		subConns = append(subConns, sc)
 	}
-	picker := &loadbalance.Picker{}
+	picker := &loadbalance.Picker{Config: config}
 	picker.Build(buildInfo)
 	return picker, subConns
 }
@@ -78,3 +211,9 @@ func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
 }
 
 func (s *subConn) Connect() {}
+
+func (s *subConn) GetOrBuildProducer(
+	balancer.ProducerBuilder,
+) (balancer.Producer, func()) {
+	return nil, func() {}
+}
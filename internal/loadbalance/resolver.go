@@ -2,57 +2,137 @@ package loadbalance
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
+	"time"
 
 	api "github.com/nickstrad/dcl_store/api/v1"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 )
 
+// Resolver discovers the servers through the seeds a target lists,
+// comma separated addresses or DNS names, e.g.
+// dcl-store:///10.0.0.1:8400,10.0.0.2:8400 or
+// dcl-store:///dcl-store.example.com:8400. Once it knows the servers it
+// asks them rather than the seeds, so clients keep working when the seed
+// they were configured with goes away.
 type Resolver struct {
-	mu            sync.Mutex
-	clientConn    resolver.ClientConn
+	// Sent to the balancer in the service config, decides which
+	// followers get reads
+	PickerConfig PickerConfig
+
+	mu         sync.Mutex
+	clientConn resolver.ClientConn
+	dialOpts   []grpc.DialOption
+	seeds      []string
+	// Servers found last, kept when none of them can be reached, and
+	// the leaders of the topics' partitions
+	servers    []*api.Server
+	partitions []*api.Partition
+	// Server the resolver asks, and the one that failed last
+	resolverAddr  string
 	resolverConn  *grpc.ClientConn
+	failedAddr    string
 	serviceConfig *serviceconfig.ParseResult
 	logger        *zap.Logger
+	cancel        context.CancelFunc
+	closed        bool
+
+	// Resolvers built for the client conns, and the builder of this one
+	builder  *Resolver
+	resolved map[*Resolver]struct{}
 }
 
 var _ resolver.Builder = (*Resolver)(nil)
 
+// Build returns a new resolver for every client conn, the registered
+// one only holds their config
 func (r *Resolver) Build(
 	target resolver.Target,
 	cc resolver.ClientConn,
 	opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.logger = zap.L().Named("resolver")
-	r.clientConn = cc
-	var dialOpts []grpc.DialOption
+	seeds := parseSeeds(target.Endpoint)
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no seeds in target %q", target.Endpoint)
+	}
+	res := &Resolver{
+		PickerConfig: r.PickerConfig,
+		clientConn:   cc,
+		seeds:        seeds,
+		logger:       zap.L().Named("resolver"),
+		builder:      r,
+	}
 	if opts.DialCreds != nil {
-		dialOpts = append(
-			dialOpts,
+		res.dialOpts = append(
+			res.dialOpts,
 			grpc.WithTransportCredentials(opts.DialCreds),
 		)
 	}
-	r.serviceConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{"loadBalancingConfig": [{"%s": {}}]}`, Name),
-	)
-	var err error
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	pickerConfig, err := json.Marshal(res.PickerConfig)
 	if err != nil {
 		return nil, err
 	}
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	return r, nil
+	res.serviceConfig = res.clientConn.ParseServiceConfig(fmt.Sprintf(
+		`{"loadBalancingConfig": [{"%s": %s}]}`,
+		Name,
+		pickerConfig,
+	))
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	var ctx context.Context
+	ctx, res.cancel = context.WithCancel(context.Background())
+	go res.watch(ctx)
+
+	r.mu.Lock()
+	if r.resolved == nil {
+		r.resolved = make(map[*Resolver]struct{})
+	}
+	r.resolved[res] = struct{}{}
+	r.mu.Unlock()
+	return res, nil
+}
+
+// Refresh resolves the servers again in the background for every client
+// conn built with r, e.g. when a server says it isn't the leader the
+// balancer still thinks it is
+func (r *Resolver) Refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for res := range r.resolved {
+		go res.ResolveNow(resolver.ResolveNowOptions{})
+	}
 }
 
+func parseSeeds(endpoint string) []string {
+	var seeds []string
+	for _, seed := range strings.Split(endpoint, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// Name of the balancer
 const Name = "dcl_store"
 
+// Scheme of the targets the resolver resolves, e.g.
+// dcl-store:///127.0.0.1:8400. grpc-go parses targets as URLs since
+// 1.52, and URL schemes can't contain underscores, so dcl_store:///
+// targets never reached the resolver.
+const Scheme = "dcl-store"
+
 func (r *Resolver) Scheme() string {
-	return Name
+	return Scheme
 }
 
 func init() {
@@ -61,44 +141,358 @@ func init() {
 
 var _ resolver.Resolver = (*Resolver)(nil)
 
+// Resolves the servers, reporting the error to the client conn when no
+// server can be reached. The balancer keeps the servers it was sent
+// last until the resolver gets through again. The servers are asked
+// without holding the lock, so other resolves and Close don't wait on
+// them.
 func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	seeds := r.resolveSeeds()
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	conn, connAddr := r.resolverConn, r.resolverAddr
+	addrs := r.candidates(seeds)
+	r.mu.Unlock()
+
+	res, err := r.getServers(addrs, conn, connAddr)
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if err != nil {
+		r.logger.Error(
+			"failed to resolve servers",
+			zap.Error(err),
+		)
+		r.clientConn.ReportError(err)
+		return
+	}
+	r.servers = res.Servers
+	r.partitions = res.Partitions
+	r.updateState(res.Servers)
+}
+
+// How long a server gets to describe the servers before the next one is
+// asked
+const resolveTimeout = 3 * time.Second
 
-	client := api.NewLogClient(r.resolverConn)
-	ctx := context.Background()
+// Asks the servers in turn until one of them describes the servers,
+// through the conn to the server asked last if it's still among them.
+// The server that answered is asked first from then on.
+func (r *Resolver) getServers(
+	addrs []string,
+	conn *grpc.ClientConn,
+	connAddr string,
+) (*api.GetServersResponse, error) {
+	var err error
+	for _, addr := range addrs {
+		c := conn
+		if addr != connAddr || c == nil {
+			if c, err = grpc.Dial(addr, r.dialOpts...); err != nil {
+				r.logger.Warn(
+					"failed to dial server",
+					zap.Error(err),
+					zap.String("addr", addr),
+				)
+				continue
+			}
+		}
+		var res *api.GetServersResponse
+		res, err = r.getServersFrom(c, addr)
+		if err == nil {
+			r.connected(c, addr)
+			return res, nil
+		}
+		r.logger.Warn(
+			"failed to get servers",
+			zap.Error(err),
+			zap.String("addr", addr),
+		)
+		r.failed(c, addr)
+	}
+	return nil, fmt.Errorf("failed to resolve servers: %w", err)
+}
 
-	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+func (r *Resolver) getServersFrom(
+	conn *grpc.ClientConn,
+	addr string,
+) (*api.GetServersResponse, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		resolveTimeout,
+	)
+	defer cancel()
+	res, err := api.NewLogClient(conn).GetServers(
+		ctx,
+		&api.GetServersRequest{},
+	)
 	if err != nil {
+		return nil, err
+	}
+	if len(res.Servers) == 0 {
+		return nil, fmt.Errorf("%s doesn't know any servers", addr)
+	}
+	return res, nil
+}
+
+// The server asked last goes first, then the servers found last, the
+// seeds may be long gone. The server that failed last goes last so the
+// resolver moves on to the others. The caller holds the lock.
+func (r *Resolver) candidates(seeds []string) []string {
+	var addrs []string
+	if r.resolverAddr != "" {
+		addrs = append(addrs, r.resolverAddr)
+	}
+	for _, server := range r.servers {
+		addrs = append(addrs, server.RpcAddr)
+	}
+	addrs = append(addrs, seeds...)
+
+	seen := make(map[string]bool, len(addrs))
+	candidates := make([]string, 0, len(addrs))
+	failed := false
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if addr == r.failedAddr {
+			failed = true
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+	if failed {
+		candidates = append(candidates, r.failedAddr)
+	}
+	return candidates
+}
+
+// Seeds that are DNS names are looked up every time so they can follow
+// the servers, names that can't be looked up are dialed as they are
+func (r *Resolver) resolveSeeds() []string {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		resolveTimeout,
+	)
+	defer cancel()
+
+	var addrs []string
+	for _, seed := range r.seeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil || net.ParseIP(host) != nil {
+			addrs = append(addrs, seed)
+			continue
+		}
+		hosts, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			r.logger.Warn(
+				"failed to look up seed",
+				zap.Error(err),
+				zap.String("seed", seed),
+			)
+			addrs = append(addrs, seed)
+			continue
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, port))
+		}
+	}
+	return addrs
+}
+
+// Keeps the conn to the server that answered for the next resolves and
+// the watch, unless the resolver was closed meanwhile
+func (r *Resolver) connected(conn *grpc.ClientConn, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn == r.resolverConn {
+		return
+	}
+	if r.closed {
+		r.closeConn(conn)
+		return
+	}
+	if r.resolverConn != nil {
+		r.closeConn(r.resolverConn)
+	}
+	r.resolverAddr = addr
+	r.resolverConn = conn
+}
+
+// Drops the conn to a server that failed, so it's asked last next time
+func (r *Resolver) failed(conn *grpc.ClientConn, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn == r.resolverConn {
+		r.disconnect()
+		return
+	}
+	r.closeConn(conn)
+	r.failedAddr = addr
+}
+
+func (r *Resolver) closeConn(conn *grpc.ClientConn) {
+	if err := conn.Close(); err != nil {
 		r.logger.Error(
-			"failed to resolve server",
+			"failed to close conn",
 			zap.Error(err),
 		)
+	}
+}
+
+// Drops the conn to the server asked last, it failed. The caller holds
+// the lock.
+func (r *Resolver) disconnect() {
+	if r.resolverConn == nil {
 		return
 	}
+	r.closeConn(r.resolverConn)
+	r.failedAddr = r.resolverAddr
+	r.resolverAddr = ""
+	r.resolverConn = nil
+}
+
+const (
+	// Bounds of the backoff between attempts to watch the servers again
+	// after the stream broke
+	watchRetryInterval    = 100 * time.Millisecond
+	watchRetryMaxInterval = 5 * time.Second
+	// How often servers that can't be watched are polled instead
+	pollInterval = 10 * time.Second
+)
+
+// Watches the servers so the balancer learns about a new leader as soon
+// as it's elected. While the stream is broken the servers are resolved
+// once per attempt to watch them again, possibly through another server,
+// and servers too old to be watched are polled.
+func (r *Resolver) watch(ctx context.Context) {
+	wait := watchRetryInterval
+	for {
+		err := r.watchServers(ctx, func() {
+			wait = watchRetryInterval
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			r.poll(ctx)
+			return
+		}
+		r.logger.Warn(
+			"failed to watch servers",
+			zap.Error(err),
+			zap.Duration("retry_in", wait),
+		)
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > watchRetryMaxInterval {
+			wait = watchRetryMaxInterval
+		}
+	}
+}
+
+// Updates the state with every message on the stream until it breaks,
+// received is called for every message
+func (r *Resolver) watchServers(ctx context.Context, received func()) error {
+	r.mu.Lock()
+	conn := r.resolverConn
+	r.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected to any server")
+	}
 
+	stream, err := api.NewLogClient(conn).WatchServers(
+		ctx,
+		&api.WatchServersRequest{},
+	)
+	if err == nil {
+		for {
+			var res *api.WatchServersResponse
+			if res, err = stream.Recv(); err != nil {
+				break
+			}
+			received()
+			r.mu.Lock()
+			if len(res.Servers) != 0 {
+				r.servers = res.Servers
+				r.partitions = res.Partitions
+				r.updateState(res.Servers)
+			}
+			r.mu.Unlock()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the conn may have been replaced while the stream was open
+	if ctx.Err() == nil && r.resolverConn == conn &&
+		status.Code(err) != codes.Unimplemented {
+		r.disconnect()
+	}
+	return err
+}
+
+func (r *Resolver) poll(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+// Sends the servers to the balancer, the caller holds the lock
+func (r *Resolver) updateState(servers []*api.Server) {
+	// Changing an address' attributes replaces its connection, so the
+	// server's progress, which changes all the time, goes in the
+	// balancer attributes. The partitions' leaders go in the state's.
 	var addrs []resolver.Address
-	for _, server := range res.Servers {
+	for _, server := range servers {
 		addrs = append(addrs, resolver.Address{
 			Addr: server.RpcAddr,
 			Attributes: attributes.New(
 				"is_leader",
 				server.IsLeader,
 			),
+			BalancerAttributes: attributes.New("server", server),
 		})
 	}
 
-	r.clientConn.UpdateState(resolver.State{
+	if err := r.clientConn.UpdateState(resolver.State{
 		Addresses:     addrs,
 		ServiceConfig: r.serviceConfig,
-	})
-}
-
-func (r *Resolver) Close() {
-	if err := r.resolverConn.Close(); err != nil {
+		Attributes:    attributes.New("partitions", r.partitions),
+	}); err != nil {
 		r.logger.Error(
-			"failed to close conn",
+			"failed to update state",
 			zap.Error(err),
 		)
 	}
 }
+
+func (r *Resolver) Close() {
+	r.cancel()
+	r.mu.Lock()
+	r.closed = true
+	r.disconnect()
+	r.mu.Unlock()
+
+	r.builder.mu.Lock()
+	delete(r.builder.resolved, r)
+	r.builder.mu.Unlock()
+}
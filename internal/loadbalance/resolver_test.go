@@ -1,8 +1,12 @@
 package loadbalance_test
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/nickstrad/dcl_store/api/v1"
 
@@ -15,9 +19,136 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestResolver(t *testing.T) {
+	conn, r := setupResolver(t, &server.Config{
+		GetServerer: &getServers{},
+	})
+
+	servers, err := (&getServers{}).GetServers()
+	require.NoError(t, err)
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:               "localhost:9001",
+			Attributes:         attributes.New("is_leader", true),
+			BalancerAttributes: attributes.New("server", servers[0]),
+		}, {
+			Addr:               "localhost:9002",
+			Attributes:         attributes.New("is_leader", false),
+			BalancerAttributes: attributes.New("server", servers[1]),
+		}},
+	}
+	requireState(t, wantState, conn.State())
+
+	conn.UpdateState(resolver.State{})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	requireState(t, wantState, conn.State())
+}
+
+func TestResolverWatchesServers(t *testing.T) {
+	watcher := &watchServers{updates: make(chan []*api.Server)}
+	conn, _ := setupResolver(t, &server.Config{
+		GetServerer:   &getServers{},
+		ServerWatcher: watcher,
+	})
+
+	servers := []*api.Server{{
+		Id:      "leader",
+		RpcAddr: "localhost:9001",
+	}, {
+		Id:       "follower",
+		RpcAddr:  "localhost:9002",
+		IsLeader: true,
+	}}
+	watcher.updates <- servers
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:               "localhost:9001",
+			Attributes:         attributes.New("is_leader", false),
+			BalancerAttributes: attributes.New("server", servers[0]),
+		}, {
+			Addr:               "localhost:9002",
+			Attributes:         attributes.New("is_leader", true),
+			BalancerAttributes: attributes.New("server", servers[1]),
+		}},
+	}
+	require.Eventually(t, func() bool {
+		state := conn.State()
+		return len(state.Addresses) == 2 &&
+			state.Addresses[1].Attributes.Equal(wantState.Addresses[1].Attributes)
+	}, time.Second, 10*time.Millisecond)
+	requireState(t, wantState, conn.State())
+}
+
+func TestResolverFailsOver(t *testing.T) {
+	addr, srv := setupServer(t, &server.Config{
+		GetServerer: &getServers{},
+	})
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, dead.Close())
+
+	// seeds that are down are skipped, and names are looked up
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	conn, r := buildResolver(t, fmt.Sprintf(
+		"%s, localhost:%s",
+		dead.Addr(),
+		port,
+	))
+	require.Equal(t, 2, len(conn.State().Addresses))
+	require.NoError(t, conn.Err())
+
+	// the servers found last are kept when none can be reached
+	conn, r = buildResolver(t, fmt.Sprintf("%s,%s", dead.Addr(), addr))
+	require.Equal(t, 2, len(conn.State().Addresses))
+	srv.Stop()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Error(t, conn.Err())
+	require.Equal(t, 2, len(conn.State().Addresses))
+}
+
+func TestResolverClosesWhileResolving(t *testing.T) {
+	slow := &slowServers{called: make(chan struct{}, 1)}
+	conn, r := setupResolver(t, &server.Config{GetServerer: slow})
+	require.Equal(t, 2, len(conn.State().Addresses))
+
+	// a server that takes its time doesn't hold up closing
+	slow.block()
+	go r.ResolveNow(resolver.ResolveNowOptions{})
+	<-slow.called
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close waited on the resolve")
+	}
+	slow.unblock()
+}
+
+func setupResolver(
+	t *testing.T,
+	serverConfig *server.Config,
+) (*clientConn, resolver.Resolver) {
+	t.Helper()
+	addr, _ := setupServer(t, serverConfig)
+	return buildResolver(t, addr)
+}
+
+// Starts a server listening on the returned address
+func setupServer(
+	t *testing.T,
+	serverConfig *server.Config,
+) (string, *grpc.Server) {
+	t.Helper()
+
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
@@ -31,16 +162,23 @@ func TestResolver(t *testing.T) {
 	require.NoError(t, err)
 	serverCreds := credentials.NewTLS(tlsConfig)
 
-	srv, err := server.NewGRPCServer(&server.Config{
-		GetServerer: &getServers{},
-	}, grpc.Creds(serverCreds))
+	srv, err := server.NewGRPCServer(serverConfig, grpc.Creds(serverCreds))
 	require.NoError(t, err)
 
 	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String(), srv
+}
+
+func buildResolver(
+	t *testing.T,
+	endpoint string,
+) (*clientConn, resolver.Resolver) {
+	t.Helper()
 
 	conn := &clientConn{}
 
-	tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -54,30 +192,30 @@ func TestResolver(t *testing.T) {
 		DialCreds: clientCreds,
 	}
 
-	r := &loadbalance.Resolver{}
-	_, err = r.Build(
+	r, err := (&loadbalance.Resolver{}).Build(
 		resolver.Target{
-			Endpoint: l.Addr().String(),
+			Endpoint: endpoint,
 		},
 		conn,
 		opts,
 	)
 	require.NoError(t, err)
 
-	wantState := resolver.State{
-		Addresses: []resolver.Address{{
-			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
-		}, {
-			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
-		}},
-	}
-	require.Equal(t, wantState, conn.state)
+	t.Cleanup(r.Close)
+	return conn, r
+}
 
-	conn.state.Addresses = nil
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	require.Equal(t, wantState, conn.state)
+func requireState(t *testing.T, want, got resolver.State) {
+	t.Helper()
+	require.Equal(t, len(want.Addresses), len(got.Addresses))
+	for i, addr := range want.Addresses {
+		require.Equal(t, addr.Addr, got.Addresses[i].Addr)
+		require.True(t, addr.Attributes.Equal(got.Addresses[i].Attributes))
+		require.True(t, proto.Equal(
+			addr.BalancerAttributes.Value("server").(*api.Server),
+			got.Addresses[i].BalancerAttributes.Value("server").(*api.Server),
+		))
+	}
 }
 
 type getServers struct{}
@@ -96,15 +234,78 @@ func (s *getServers) GetServers() ([]*api.Server, error) {
 	}, nil
 }
 
+// Answers like getServers until it's blocked
+type slowServers struct {
+	getServers
+	mu      sync.Mutex
+	blocked chan struct{}
+	called  chan struct{}
+}
+
+func (s *slowServers) block() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked = make(chan struct{})
+}
+
+func (s *slowServers) unblock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.blocked)
+}
+
+func (s *slowServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	blocked := s.blocked
+	s.mu.Unlock()
+	if blocked != nil {
+		s.called <- struct{}{}
+		<-blocked
+	}
+	return s.getServers.GetServers()
+}
+
+type watchServers struct {
+	updates chan []*api.Server
+}
+
+func (w *watchServers) WatchServers(
+	ctx context.Context,
+) <-chan []*api.Server {
+	return w.updates
+}
+
 type clientConn struct {
 	resolver.ClientConn
+	mu    sync.Mutex
 	state resolver.State
+	err   error
 }
 
-func (c *clientConn) UpdateState(state resolver.State) {
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
+	return nil
+}
+
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
 }
-func (c *clientConn) ReportError(err error)               {}
+func (c *clientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *clientConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 func (c *clientConn) NewAddress(addrs []resolver.Address) {}
 func (c *clientConn) NewServiceConfig(config string)      {}
 func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
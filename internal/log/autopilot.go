@@ -0,0 +1,279 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// StatsFetcher gets the Raft stats (see raft.Raft.Stats) of the server
+// listening on the given address.
+type StatsFetcher interface {
+	FetchStats(ctx context.Context, addr string) (map[string]string, error)
+}
+
+// autopilot runs on the leader. It keeps track of every server's health
+// and promotes non-voters once they have been healthy for the
+// stabilization time, and demotes voters that have been unhealthy for as
+// long when the cluster can afford it.
+type autopilot struct {
+	log    *DistributedLog
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	health  *api.ClusterHealth
+	streaks map[raft.ServerID]streak
+
+	shutdown chan struct{}
+}
+
+// A server's current run of being healthy or unhealthy
+type streak struct {
+	healthy bool
+	since   time.Time
+}
+
+func newAutopilot(l *DistributedLog) *autopilot {
+	c := &l.config.Autopilot
+	if c.ServerStabilizationTime == 0 {
+		c.ServerStabilizationTime = 10 * time.Second
+	}
+	if c.Interval == 0 {
+		c.Interval = 2 * time.Second
+	}
+	return &autopilot{
+		log:      l,
+		logger:   zap.L().Named("autopilot"),
+		streaks:  make(map[raft.ServerID]streak),
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (a *autopilot) run() {
+	ticker := time.NewTicker(a.log.config.Autopilot.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdown:
+			return
+		case <-ticker.C:
+			if !a.log.IsLeader() {
+				a.mu.Lock()
+				a.health = nil
+				a.streaks = make(map[raft.ServerID]streak)
+				a.mu.Unlock()
+				continue
+			}
+			if err := a.check(); err != nil {
+				a.logger.Error("failed to check servers", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (a *autopilot) stop() {
+	close(a.shutdown)
+}
+
+func (a *autopilot) check() error {
+	future := a.log.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	servers := future.Configuration().Servers
+
+	leaderStats := a.log.raft.Stats()
+	health := &api.ClusterHealth{}
+	for _, server := range servers {
+		health.Servers = append(
+			health.Servers,
+			a.serverHealth(server, leaderStats),
+		)
+	}
+
+	a.mu.Lock()
+	now := time.Now()
+	streaks := make(map[raft.ServerID]streak, len(servers))
+	var voters, healthyVoters int
+	for i, server := range servers {
+		h := health.Servers[i]
+		s, ok := a.streaks[server.ID]
+		if !ok || s.healthy != h.Healthy {
+			s = streak{healthy: h.Healthy, since: now}
+		}
+		streaks[server.ID] = s
+		h.StableSince = timestamppb.New(s.since)
+		if server.Suffrage == raft.Voter {
+			voters++
+			if h.Healthy {
+				healthyVoters++
+			}
+		}
+	}
+	a.streaks = streaks
+	quorum := voters/2 + 1
+	if healthyVoters > quorum {
+		health.FailureTolerance = uint32(healthyVoters - quorum)
+	}
+	health.Healthy = true
+	for _, h := range health.Servers {
+		health.Healthy = health.Healthy && h.Healthy
+	}
+	a.health = health
+	a.mu.Unlock()
+
+	a.promoteOrDemote(servers, health, voters, healthyVoters)
+	return nil
+}
+
+func (a *autopilot) promoteOrDemote(
+	servers []raft.Server,
+	health *api.ClusterHealth,
+	voters, healthyVoters int,
+) {
+	stabilization := a.log.config.Autopilot.ServerStabilizationTime
+	for i, server := range servers {
+		h := health.Servers[i]
+		if h.IsLeader || time.Since(h.StableSince.AsTime()) < stabilization {
+			continue
+		}
+		switch {
+		case server.Suffrage == raft.Nonvoter && h.Healthy:
+			err := a.log.raft.AddVoter(server.ID, server.Address, 0, 0).Error()
+			if err != nil {
+				a.logger.Error("failed to promote", zap.Error(err))
+				continue
+			}
+			a.logger.Info("promoted", zap.String("id", h.Id))
+			return
+		case server.Suffrage == raft.Voter && !h.Healthy:
+			// the healthy voters left have to be a quorum on their own
+			if healthyVoters < (voters-1)/2+1 {
+				continue
+			}
+			err := a.log.raft.DemoteVoter(server.ID, 0, 0).Error()
+			if err != nil {
+				a.logger.Error("failed to demote", zap.Error(err))
+				continue
+			}
+			a.logger.Info(
+				"demoted",
+				zap.String("id", h.Id),
+				zap.String("reason", h.Reason),
+			)
+			return
+		}
+	}
+}
+
+func (a *autopilot) serverHealth(
+	server raft.Server,
+	leaderStats map[string]string,
+) *api.ServerHealth {
+	h := &api.ServerHealth{
+		Id:       string(server.ID),
+		Address:  string(server.Address),
+		Suffrage: server.Suffrage.String(),
+		IsLeader: a.log.isLeader(server),
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		a.log.config.Autopilot.Interval,
+	)
+	defer cancel()
+	stats, err := a.log.serverStats(ctx, server)
+	if err != nil {
+		h.Reason = fmt.Sprintf("failed to fetch stats: %v", err)
+		return h
+	}
+	a.log.judgeHealth(h, stats, leaderStats)
+	return h
+}
+
+// Gets a server's Raft stats, asking the other servers for theirs
+// through the stats fetcher
+func (l *DistributedLog) serverStats(
+	ctx context.Context,
+	server raft.Server,
+) (map[string]string, error) {
+	if server.ID == l.config.Raft.LocalID {
+		return l.raft.Stats(), nil
+	}
+	if l.config.Raft.StatsFetcher == nil {
+		return nil, fmt.Errorf("no stats fetcher configured")
+	}
+	return l.config.Raft.StatsFetcher.FetchStats(ctx, string(server.Address))
+}
+
+// Fills in the server's progress from its stats and judges whether it
+// keeps up with the leader
+func (l *DistributedLog) judgeHealth(
+	h *api.ServerHealth,
+	stats map[string]string,
+	leaderStats map[string]string,
+) {
+	h.Term = parseStat(stats, "term")
+	h.LastIndex = parseStat(stats, "last_log_index")
+	h.AppliedIndex = parseStat(stats, "applied_index")
+	lastContact, err := parseLastContact(stats["last_contact"])
+	if err != nil {
+		h.Reason = err.Error()
+		return
+	}
+	h.LastContact = durationpb.New(lastContact)
+	if leaderStats == nil {
+		h.Reason = "no leader to compare with"
+		return
+	}
+
+	c := l.config.Autopilot
+	leaderTerm := parseStat(leaderStats, "term")
+	leaderIndex := parseStat(leaderStats, "last_log_index")
+	switch {
+	case h.Term != leaderTerm:
+		h.Reason = fmt.Sprintf("term %d, leader is at %d", h.Term, leaderTerm)
+	case lastContact > c.LastContactThreshold:
+		h.Reason = fmt.Sprintf("last contact %s ago", lastContact)
+	case h.LastIndex+c.MaxTrailingLogs < leaderIndex:
+		h.Reason = fmt.Sprintf(
+			"trailing the leader by %d logs",
+			leaderIndex-h.LastIndex,
+		)
+	default:
+		h.Healthy = true
+	}
+}
+
+func parseStat(stats map[string]string, key string) uint64 {
+	v, _ := strconv.ParseUint(stats[key], 10, 64)
+	return v
+}
+
+// Leaders report "0", followers that never heard from one "never"
+func parseLastContact(s string) (time.Duration, error) {
+	switch s {
+	case "0":
+		return 0, nil
+	case "never", "":
+		return 0, fmt.Errorf("never heard from the leader")
+	}
+	return time.ParseDuration(s)
+}
+
+func (a *autopilot) Health() (*api.ClusterHealth, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.health == nil {
+		return nil, raft.ErrNotLeader
+	}
+	return a.health, nil
+}
@@ -0,0 +1,99 @@
+package log
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+const clusterIDFile = "cluster_id"
+
+// ClusterID identifies the cluster a server belongs to. It's persisted
+// in the data dir so a server keeps refusing other clusters across
+// restarts. An empty ID means the server hasn't joined a cluster yet.
+type ClusterID struct {
+	mu   sync.RWMutex
+	path string
+	id   string
+}
+
+func LoadClusterID(dataDir string) (*ClusterID, error) {
+	c := &ClusterID{path: filepath.Join(dataDir, clusterIDFile)}
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.id = strings.TrimSpace(string(b))
+	return c, nil
+}
+
+func (c *ClusterID) Get() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.id
+}
+
+// Persists the ID, a server that already belongs to a different cluster
+// can't be moved to another one.
+func (c *ClusterID) Set(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == id {
+		return nil
+	}
+	// the stream layer's handshake sends the ID's length in a byte
+	if id == "" || len(id) > 255 {
+		return fmt.Errorf("invalid cluster ID %q", id)
+	}
+	if c.id != "" {
+		return fmt.Errorf(
+			"server belongs to cluster %s, not %s",
+			c.id,
+			id,
+		)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.path, []byte(id+"\n"), 0644); err != nil {
+		return err
+	}
+	c.id = id
+	return nil
+}
+
+func NewClusterID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Derives the ID from the servers bootstrapping the cluster, so servers
+// bootstrapped with the same configuration agree on it without talking
+// to each other.
+func ClusterIDFor(servers []raft.Server) string {
+	ids := make([]string, 0, len(servers))
+	for _, server := range servers {
+		ids = append(ids, fmt.Sprintf("%s@%s", server.ID, server.Address))
+	}
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	return hex.EncodeToString(sum[:16])
+}
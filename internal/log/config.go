@@ -1,16 +1,54 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
 		raft.Config
 		StreamLayer *StreamLayer
 		Bootstrap   bool
+		// Raft connections from servers of other clusters are refused
+		ClusterID *ClusterID
+		// Used to ask the other servers for their stats, by autopilot and
+		// to describe the servers in GetServers
+		StatsFetcher StatsFetcher
 	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	Autopilot struct {
+		// New servers join as non-voters and are promoted once stable
+		Enabled bool
+		// Followers that haven't heard from the leader for longer are
+		// unhealthy, here and in GetServers
+		LastContactThreshold time.Duration
+		// Servers trailing the leader by more log entries are unhealthy
+		MaxTrailingLogs uint64
+		// How long a server has to stay healthy before it's promoted, or
+		// unhealthy before it's demoted
+		ServerStabilizationTime time.Duration
+		// How often the leader checks on the servers
+		Interval time.Duration
+	}
+	Transactions struct {
+		// How long a transaction may stay open before the leader aborts
+		// it, so a client that went away doesn't hold up committed reads
+		// for good. Defaults to a minute.
+		Timeout time.Duration
+	}
+	Topics struct {
+		// Multiplexes the Raft groups of the topics' partitions, nil
+		// leaves topics out. Closed along with the log.
+		Mux *StreamMux
+		// How often the server hands the leadership of partitions it
+		// leads to the servers that should lead them, and catches up on
+		// the topics and the cluster's servers. Defaults to 30s.
+		BalanceInterval time.Duration
+	}
 }
@@ -0,0 +1,309 @@
+package log
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
+	api "github.com/nickstrad/dcl_store/api/v1"
+)
+
+const (
+	defaultSessionTimeout = 10 * time.Second
+	defaultRangeSize      = 1000
+)
+
+// coordinator splits the consumer groups' logs and partitions among
+// their live members. It runs on the cluster's leader and keeps the
+// members in memory, they join the new leader's again after an election.
+// Generations start from the leader's term, so they keep going up across
+// leaders and fence the members of the old leader's generations.
+//
+// Members whose session timed out are dropped when the coordinator next
+// hears from their group, the live members heartbeat often enough for
+// their partitions to move on.
+type coordinator struct {
+	log *DistributedLog
+
+	mu     sync.Mutex
+	term   uint64
+	groups map[string]*group
+}
+
+type group struct {
+	log       string
+	topic     string
+	rangeSize uint64
+	// Goes up with every rebalance
+	generation  uint64
+	members     map[string]*member
+	assignments map[string]*api.Assignment
+}
+
+type member struct {
+	sessionTimeout time.Duration
+	lastSeen       time.Time
+}
+
+func newCoordinator(l *DistributedLog) *coordinator {
+	return &coordinator{log: l, groups: make(map[string]*group)}
+}
+
+// Followers refuse the groups' requests, and a new term starts the
+// groups over. The caller holds the lock.
+func (c *coordinator) lead() error {
+	if c.log.raft.State() != raft.Leader {
+		c.term = 0
+		c.groups = make(map[string]*group)
+		return api.ErrNotLeader{
+			Reason:  raft.ErrNotLeader.Error(),
+			Refused: true,
+		}
+	}
+	term := parseStat(c.log.raft.Stats(), "term")
+	if term != c.term {
+		c.term = term
+		c.groups = make(map[string]*group)
+	}
+	return nil
+}
+
+func (c *coordinator) join(
+	req *api.JoinGroupRequest,
+) (*api.JoinGroupResponse, error) {
+	if !groupNameRegexp.MatchString(req.Group) {
+		return nil, api.ErrInvalidGroupName{Name: req.Group}
+	}
+	if err := c.log.fsm.checkSource(req.Log, req.Topic); err != nil {
+		return nil, err
+	}
+	sessionTimeout := req.SessionTimeout.AsDuration()
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultSessionTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.lead(); err != nil {
+		return nil, err
+	}
+	g, ok := c.groups[req.Group]
+	if !ok {
+		g = &group{
+			log:        req.Log,
+			topic:      req.Topic,
+			rangeSize:  req.RangeSize,
+			generation: c.term << 32,
+			members:    make(map[string]*member),
+		}
+		if g.rangeSize == 0 {
+			g.rangeSize = defaultRangeSize
+		}
+		c.groups[req.Group] = g
+	} else if g.log != req.Log || g.topic != req.Topic {
+		return nil, api.ErrGroupMismatch{Group: req.Group}
+	}
+
+	// members joining again after an election keep their IDs
+	id := req.MemberId
+	if id == "" {
+		var err error
+		if id, err = uuid.GenerateUUID(); err != nil {
+			return nil, err
+		}
+	}
+	m, ok := g.members[id]
+	if !ok {
+		m = &member{}
+		g.members[id] = m
+	}
+	m.sessionTimeout = sessionTimeout
+	m.lastSeen = time.Now()
+	if !c.expire(req.Group, g) && !ok {
+		c.rebalance(g)
+	}
+	return &api.JoinGroupResponse{
+		MemberId:   id,
+		Generation: g.generation,
+		Assignment: g.assignments[id],
+	}, nil
+}
+
+func (c *coordinator) heartbeat(
+	req *api.HeartbeatRequest,
+) (*api.HeartbeatResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	// the member heard from the coordinator of a later term, this server
+	// doesn't know it lost the leadership yet
+	if req.Generation > g.generation {
+		return nil, api.ErrNotLeader{
+			Reason:  "the group has a newer coordinator",
+			Refused: true,
+		}
+	}
+	m.lastSeen = time.Now()
+	return &api.HeartbeatResponse{
+		Generation: g.generation,
+		Assignment: g.assignments[req.MemberId],
+	}, nil
+}
+
+// Leaving a group the member isn't in is harmless, it may have been
+// dropped already
+func (c *coordinator) leave(req *api.LeaveGroupRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, _, err := c.member(req.Group, req.MemberId)
+	switch err.(type) {
+	case nil:
+	case api.ErrUnknownMember:
+		return nil
+	default:
+		return err
+	}
+	delete(g.members, req.MemberId)
+	c.rebalance(g)
+	if len(g.members) == 0 {
+		delete(c.groups, req.Group)
+	}
+	return nil
+}
+
+// Commits the member's offset, refusing it if the member was dropped or
+// the group was rebalanced since the generation it's committed in. The
+// lock is held until the offset's applied, so the group can't be
+// rebalanced in between.
+func (c *coordinator) commit(req *api.CommitOffsetRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, _, err := c.member(req.Group, req.MemberId)
+	if err != nil {
+		return err
+	}
+	if req.Generation != g.generation {
+		return api.ErrStaleGeneration{
+			Group:      req.Group,
+			Generation: req.Generation,
+			Current:    g.generation,
+		}
+	}
+	_, err = c.log.apply(CommitOffsetRequestType, req)
+	return err
+}
+
+// The member of the group, after dropping the group's expired members.
+// The caller holds the lock.
+func (c *coordinator) member(group, id string) (*group, *member, error) {
+	if err := c.lead(); err != nil {
+		return nil, nil, err
+	}
+	if g, ok := c.groups[group]; ok {
+		c.expire(group, g)
+		if m, ok := g.members[id]; ok {
+			return g, m, nil
+		}
+	}
+	return nil, nil, api.ErrUnknownMember{Group: group, MemberID: id}
+}
+
+// Drops the members whose session timed out and rebalances the group if
+// there were any, reporting whether there were
+func (c *coordinator) expire(name string, g *group) bool {
+	now := time.Now()
+	expired := false
+	for id, m := range g.members {
+		if now.Sub(m.lastSeen) > m.sessionTimeout {
+			delete(g.members, id)
+			expired = true
+		}
+	}
+	if !expired {
+		return false
+	}
+	c.rebalance(g)
+	if len(g.members) == 0 {
+		delete(c.groups, name)
+	}
+	return true
+}
+
+// Starts a new generation, dealing the topic's partitions or the log's
+// ranges to the members in the order of their IDs
+func (c *coordinator) rebalance(g *group) {
+	g.generation++
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	g.assignments = make(map[string]*api.Assignment, len(ids))
+	for i, id := range ids {
+		a := &api.Assignment{}
+		if g.topic == "" {
+			a.RangeSize = g.rangeSize
+			a.Index = uint32(i)
+			a.Members = uint32(len(ids))
+		}
+		g.assignments[id] = a
+	}
+	if g.topic == "" || len(ids) == 0 {
+		return
+	}
+	for p := uint32(0); p < c.log.fsm.topicPartitions(g.topic); p++ {
+		a := g.assignments[ids[int(p)%len(ids)]]
+		a.Partitions = append(a.Partitions, p)
+	}
+}
+
+// Checks the log or topic exists
+func (f *fsm) checkSource(log, topic string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if topic != "" {
+		if _, ok := f.topics[topic]; !ok {
+			return api.ErrTopicNotFound{Name: topic}
+		}
+		return nil
+	}
+	if _, ok := f.logs[log]; !ok {
+		return api.ErrLogNotFound{Name: log}
+	}
+	return nil
+}
+
+// 0 if the topic was deleted
+func (f *fsm) topicPartitions(topic string) uint32 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if t, ok := f.topics[topic]; ok {
+		return t.Partitions
+	}
+	return 0
+}
+
+// JoinGroup adds the member to the group, or refreshes it, and returns
+// its share of the group's log or topic. Only the leader coordinates
+// the groups.
+func (l *DistributedLog) JoinGroup(
+	req *api.JoinGroupRequest,
+) (*api.JoinGroupResponse, error) {
+	return l.coordinator.join(req)
+}
+
+func (l *DistributedLog) Heartbeat(
+	req *api.HeartbeatRequest,
+) (*api.HeartbeatResponse, error) {
+	return l.coordinator.heartbeat(req)
+}
+
+func (l *DistributedLog) LeaveGroup(req *api.LeaveGroupRequest) error {
+	return l.coordinator.leave(req)
+}
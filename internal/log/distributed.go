@@ -2,15 +2,23 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	raftboltdb "github.com/hashicorp/raft-boltdb"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/hashicorp/raft"
@@ -18,82 +26,81 @@ import (
 )
 
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	// Appends to and reads from the default log
+	NamedLog
+
+	config    Config
+	raft      *raft.Raft
+	stores    *raftStores
+	autopilot *autopilot
+	watch     *serverWatch
+	fsm       *fsm
+	// The other servers' stats as GetServers last fetched them
+	statsMu sync.Mutex
+	stats   map[raft.ServerID]fetchedStats
+	// Splits the consumer groups' logs among their members
+	coordinator *coordinator
+
+	shutdown chan struct{}
+	stopOnce sync.Once
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
-	l := &DistributedLog{config: config}
-	if err := l.setupLog(dataDir); err != nil {
-		return nil, err
+	if config.Autopilot.LastContactThreshold == 0 {
+		config.Autopilot.LastContactThreshold = 200 * time.Millisecond
 	}
-
+	if config.Autopilot.MaxTrailingLogs == 0 {
+		config.Autopilot.MaxTrailingLogs = 250
+	}
+	if config.Transactions.Timeout == 0 {
+		config.Transactions.Timeout = defaultTransactionTimeout
+	}
+	l := &DistributedLog{config: config, shutdown: make(chan struct{})}
+	l.NamedLog = NamedLog{dlog: l}
+	l.coordinator = newCoordinator(l)
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
 
-	return l, nil
-}
+	if l.config.Autopilot.Enabled {
+		l.autopilot = newAutopilot(l)
+		go l.autopilot.run()
+	}
 
-func (l *DistributedLog) setupLog(dataDir string) error {
-	logDir := filepath.Join(dataDir, "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return err
+	l.watch = newServerWatch(l)
+	go l.watch.run()
+	go l.expireTransactions()
+	if l.fsm.partitions != nil {
+		// watchers learn about the partitions' leaders too
+		l.fsm.partitions.setCluster(l)
 	}
-	var err error
-	l.log, err = NewLog(logDir, l.config)
-	return err
+
+	return l, nil
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	// finite state machine
-	fsm := &fsm{log: l.log}
-
-	logDir := filepath.Join(dataDir, "raft", "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return err
-	}
-
-	logConfig := l.config
-
-	// Raft needs initial offset to be 1
-	logConfig.Segment.InitialOffset = 1
-
-	// raft's WAL
-	logStore, err := newLogStore(logDir, logConfig)
-	if err != nil {
-		return err
-	}
-
-	// raft's on disk storage for things like current term,
-	// candidate voted for, etc.
-	stableStore, err := raftboltdb.NewBoltStore(
-		filepath.Join(dataDir, "raft", "stable"),
-	)
+	fsm, err := newFSM(dataDir, l.config)
 	if err != nil {
 		return err
 	}
+	l.fsm = fsm
 
-	// How many snapshots we will keep
-	retain := 1
-
-	// Create snapshots that nodes can recover from instead of
-	// streaming all data from leader when re-initializing
-	snapshotStore, err := raft.NewFileSnapshotStore(
-		filepath.Join(dataDir, "raft"),
-		retain,
-		os.Stderr,
-	)
+	l.stores, err = newRaftStores(dataDir, l.config)
 	if err != nil {
 		return err
 	}
+	logStore := l.stores.log
+	stableStore := l.stores.stable
+	snapshotStore := l.stores.snapshots
 
 	// I believe number of connections open to be used by queries
 	maxPool := 5
 	timeout := 10 * time.Second
+	streamLayer := l.config.Raft.StreamLayer
+	streamLayer.clusterID = l.config.Raft.ClusterID
 	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
+		streamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
@@ -148,10 +155,101 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	return err
 }
 
-func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
-	res, err := l.apply(
+// Bootstraps a cluster made of the given servers. Every server has to
+// be bootstrapped with the same configuration, servers that already
+// have Raft state are left as they are.
+func (l *DistributedLog) Bootstrap(servers []raft.Server) error {
+	err := l.raft.BootstrapCluster(raft.Configuration{
+		Servers: servers,
+	}).Error()
+	if err == raft.ErrCantBootstrap {
+		return nil
+	}
+	return err
+}
+
+type raftStores struct {
+	// raft's WAL
+	log *logStore
+	// raft's on disk storage for things like current term,
+	// candidate voted for, etc.
+	stable *raftboltdb.BoltStore
+	// Create snapshots that nodes can recover from instead of
+	// streaming all data from leader when re-initializing
+	snapshots *raft.FileSnapshotStore
+}
+
+// How long opening the stable store waits for another process to let go
+// of its lock
+const boltTimeout = time.Second
+
+func newRaftStores(dataDir string, config Config) (*raftStores, error) {
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// bolt locks its file, so the stores of a running server fail to
+	// open here before anything else of its is touched
+	stableStore, err := raftboltdb.New(raftboltdb.Options{
+		Path:        filepath.Join(dataDir, "raft", "stable"),
+		BoltOptions: &bolt.Options{Timeout: boltTimeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the Raft stable store: %w", err)
+	}
+
+	logConfig := config
+
+	// Raft needs initial offset to be 1
+	logConfig.Segment.InitialOffset = 1
+
+	logStore, err := newLogStore(logDir, logConfig)
+	if err != nil {
+		_ = stableStore.Close()
+		return nil, err
+	}
+
+	// How many snapshots we will keep
+	retain := 1
+
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		filepath.Join(dataDir, "raft"),
+		retain,
+		os.Stderr,
+	)
+	if err != nil {
+		_ = stableStore.Close()
+		_ = logStore.Close()
+		return nil, err
+	}
+
+	return &raftStores{
+		log:       logStore,
+		stable:    stableStore,
+		snapshots: snapshotStore,
+	}, nil
+}
+
+func (s *raftStores) Close() error {
+	if err := s.stable.Close(); err != nil {
+		return err
+	}
+	return s.log.Close()
+}
+
+// NamedLog appends to and reads from one of the cluster's logs. Its
+// commands go through the cluster's Raft group like every other log's.
+type NamedLog struct {
+	dlog *DistributedLog
+	// Empty for the default log
+	name string
+}
+
+func (n *NamedLog) Append(record *api.Record) (uint64, error) {
+	res, err := n.dlog.apply(
 		AppendRequestType,
-		&api.AppendRequest{Record: record},
+		&api.AppendRequest{Record: record, Log: n.name},
 	)
 	if err != nil {
 		return 0, err
@@ -160,6 +258,145 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.AppendResponse).Offset, nil
 }
 
+// AppendBatch replicates the records in a single Raft entry, so they
+// cost one round trip to the followers and get consecutive offsets
+func (n *NamedLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	res, err := n.dlog.apply(
+		AppendBatchRequestType,
+		&api.AppendBatchRequest{Records: records, Log: n.name},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*api.AppendBatchResponse).Offsets, nil
+}
+
+// AppendFrom appends a producer's records once, however often they're
+// sent. The records get consecutive sequence numbers from sequence on,
+// and records sent again get the offsets they were appended at.
+func (n *NamedLog) AppendFrom(
+	producerID string,
+	sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	if len(records) == 1 {
+		res, err := n.dlog.apply(AppendRequestType, &api.AppendRequest{
+			Record:     records[0],
+			ProducerId: producerID,
+			Sequence:   sequence,
+			Log:        n.name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{res.(*api.AppendResponse).Offset}, nil
+	}
+
+	res, err := n.dlog.apply(AppendBatchRequestType, &api.AppendBatchRequest{
+		Records:    records,
+		ProducerId: producerID,
+		Sequence:   sequence,
+		Log:        n.name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AppendBatchResponse).Offsets, nil
+}
+
+// AppendAt appends the record only if it gets the expected offset,
+// failing with ErrUnexpectedOffset if other records were appended first.
+// The offset is checked as the append is applied, in log order, so of two
+// writers expecting the same offset only one succeeds.
+func (n *NamedLog) AppendAt(
+	record *api.Record,
+	expectedOffset uint64,
+) (uint64, error) {
+	res, err := n.dlog.apply(AppendRequestType, &api.AppendRequest{
+		Record:         record,
+		ExpectedOffset: &expectedOffset,
+		Log:            n.name,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.AppendResponse).Offset, nil
+}
+
+// BeginTransaction appends the transaction's begin marker. Records
+// appended to it are hidden from committed reads until it commits, and
+// so are the records after them.
+func (n *NamedLog) BeginTransaction(id string) (uint64, error) {
+	res, err := n.dlog.apply(
+		BeginTransactionRequestType,
+		&api.BeginTransactionRequest{TransactionId: id, Log: n.name},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.BeginTransactionResponse).Offset, nil
+}
+
+// AppendTo appends the records to the open transaction
+func (n *NamedLog) AppendTo(
+	id string,
+	records []*api.Record,
+) ([]uint64, error) {
+	res, err := n.dlog.apply(AppendBatchRequestType, &api.AppendBatchRequest{
+		Records:       records,
+		TransactionId: id,
+		Log:           n.name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AppendBatchResponse).Offsets, nil
+}
+
+// EndTransaction appends the transaction's commit or abort marker
+func (n *NamedLog) EndTransaction(id string, abort bool) (uint64, error) {
+	res, err := n.dlog.apply(
+		EndTransactionRequestType,
+		&api.EndTransactionRequest{
+			TransactionId: id,
+			Abort:         abort,
+			Log:           n.name,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.EndTransactionResponse).Offset, nil
+}
+
+// AppendTransaction appends the records between begin and commit markers
+// in a single Raft entry
+func (n *NamedLog) AppendTransaction(
+	id string,
+	records []*api.Record,
+) ([]uint64, error) {
+	res, err := n.dlog.apply(
+		AppendTransactionRequestType,
+		&api.AppendTransactionRequest{
+			TransactionId: id,
+			Records:       records,
+			Log:           n.name,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AppendTransactionResponse).Offsets, nil
+}
+
+// ReadCommitted reads the first record at or after the offset that's
+// outside transactions or part of a committed one, stopping at the first
+// open transaction
+func (n *NamedLog) ReadCommitted(offset uint64) (*api.Record, error) {
+	return n.dlog.fsm.read(n.name, offset, true)
+}
+
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
 	error,
@@ -184,8 +421,15 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 
 	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	switch err := future.Error(); err {
+	case nil:
+	case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+		// the entry never made it to the log
+		return nil, api.ErrNotLeader{Reason: err.Error(), Refused: true}
+	case raft.ErrLeadershipLost:
+		return nil, api.ErrNotLeader{Reason: err.Error()}
+	default:
+		return nil, err
 	}
 
 	res := future.Response()
@@ -196,22 +440,47 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	return res, nil
 }
 
-func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	// res, err := l.apply(
-	// 	ReadRequestType,
-	// 	&api.ReadRequest{
-	// 		Offset: offset,
-	// 	},
-	// )
-	// if err != nil {
-	// 	return &api.Record{}, err
-	// }
-
-	// return res.(*api.ReadResponse).Record, nil
-	return l.log.Read(offset)
+func (n *NamedLog) Read(offset uint64) (*api.Record, error) {
+	// reads are served locally rather than through raft, so they may
+	// trail the leader
+	return n.dlog.fsm.read(n.name, offset, false)
 }
 
+// With autopilot servers join as non-voters, and they get promoted once
+// they've caught up and stayed healthy. Servers join the partitions this
+// server leads whether or not it's the cluster's leader.
 func (l *DistributedLog) Join(id, addr string) error {
+	if l.fsm.partitions != nil {
+		l.fsm.partitions.join(id, addr)
+	}
+	if l.autopilot == nil {
+		return l.addServer(id, addr, raft.Voter)
+	}
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) {
+			return nil
+		}
+	}
+	return l.addServer(id, addr, raft.Nonvoter)
+}
+
+func (l *DistributedLog) AddVoter(id, addr string) error {
+	return l.addServer(id, addr, raft.Voter)
+}
+
+// Non-voters receive the log but don't count towards quorum
+func (l *DistributedLog) AddNonvoter(id, addr string) error {
+	return l.addServer(id, addr, raft.Nonvoter)
+}
+
+func (l *DistributedLog) addServer(
+	id, addr string,
+	suffrage raft.ServerSuffrage,
+) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
@@ -221,15 +490,27 @@ func (l *DistributedLog) Join(id, addr string) error {
 	for _, srv := range configFuture.Configuration().Servers {
 		if srv.ID == serverID || srv.Address == serverAddr {
 			if srv.ID == serverID && srv.Address == serverAddr {
-				return nil
+				if srv.Suffrage == suffrage {
+					return nil
+				}
+				if suffrage == raft.Nonvoter {
+					return l.raft.DemoteVoter(serverID, 0, 0).Error()
+				}
+				// AddVoter promotes an existing server in place
+				break
 			}
-			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
+			removeFuture := l.raft.RemoveServer(srv.ID, 0, 0)
 			if err := removeFuture.Error(); err != nil {
 				return err
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	var addFuture raft.IndexFuture
+	if suffrage == raft.Voter {
+		addFuture = l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	} else {
+		addFuture = l.raft.AddNonvoter(serverID, serverAddr, 0, 0)
+	}
 	if err := addFuture.Error(); err != nil {
 		return err
 	}
@@ -237,10 +518,68 @@ func (l *DistributedLog) Join(id, addr string) error {
 }
 
 func (l *DistributedLog) Leave(id string) error {
+	if l.fsm.partitions != nil {
+		l.fsm.partitions.leave(id)
+	}
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
 	return removeFuture.Error()
 }
 
+func (l *DistributedLog) RemoveServer(id string) error {
+	return l.Leave(id)
+}
+
+// Hands leadership to the server with the given id, or to the most
+// up to date follower when id is empty
+func (l *DistributedLog) TransferLeadership(id string) error {
+	if id == "" {
+		return l.raft.LeadershipTransfer().Error()
+	}
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			return l.raft.LeadershipTransferToServer(
+				srv.ID,
+				srv.Address,
+			).Error()
+		}
+	}
+	return fmt.Errorf("unknown server: %s", id)
+}
+
+func (l *DistributedLog) Snapshot() (*api.Snapshot, error) {
+	future := l.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return &api.Snapshot{
+		Id:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+	}, nil
+}
+
+func (l *DistributedLog) Stats() map[string]string {
+	return l.raft.Stats()
+}
+
+func (l *DistributedLog) Health() (*api.ClusterHealth, error) {
+	if l.autopilot == nil {
+		return nil, fmt.Errorf("autopilot is disabled")
+	}
+	return l.autopilot.Health()
+}
+
 func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	timeoutc := time.After(timeout)
 	ticker := time.NewTicker(time.Second)
@@ -260,37 +599,195 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
+// The leader's own transport may listen on a different address than
+// the one its peers know it by, so it recognizes itself by ID
+func (l *DistributedLog) isLeader(server raft.Server) bool {
+	if server.ID == l.config.Raft.LocalID {
+		return l.IsLeader()
+	}
+	return l.raft.Leader() == server.Address
+}
+
+func (l *DistributedLog) IsLeader() bool {
+	return l.raft.State() == raft.Leader
+}
+
 func (l *DistributedLog) Close() error {
+	if l.autopilot != nil {
+		l.autopilot.stop()
+	}
+	l.watch.stop()
+	l.stopOnce.Do(func() { close(l.shutdown) })
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
-	return l.log.Close()
+	if err := l.stores.Close(); err != nil {
+		return err
+	}
+	return l.fsm.close()
+}
+
+// How long GetServers waits for the other servers' stats, and how long
+// it goes on with the stats it got, or failed to get, before it asks
+// the server again
+const fetchStatsTimeout = time.Second
+
+// A server's stats as GetServers last fetched them, nil if it couldn't
+type fetchedStats struct {
+	stats   map[string]string
+	fetched time.Time
 }
 
+// Describes the servers in the configuration with the progress they
+// report, servers that can't be reached in time are only described by
+// their place in the configuration
 func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	return l.getServers(true)
+}
+
+// Without fetching, the other servers are described with the stats last
+// fetched however old they are, and only by their place in the
+// configuration if they haven't been asked yet
+func (l *DistributedLog) getServers(fetch bool) ([]*api.Server, error) {
 	future := l.raft.GetConfiguration()
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	configuration := future.Configuration().Servers
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		fetchStatsTimeout,
+	)
+	defer cancel()
+	// other servers asked for their stats lately aren't asked again, so
+	// frequent calls don't wait on unreachable servers every time
+	l.statsMu.Lock()
+	fetched := make([]fetchedStats, len(configuration))
+	var wg sync.WaitGroup
+	for i, server := range configuration {
+		local := server.ID == l.config.Raft.LocalID
+		cached, ok := l.stats[server.ID]
+		if ok && !local &&
+			(!fetch || time.Since(cached.fetched) < fetchStatsTimeout) {
+			fetched[i] = cached
+			continue
+		}
+		if !fetch && !local {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, server raft.Server) {
+			defer wg.Done()
+			stats, _ := l.serverStats(ctx, server)
+			fetched[i] = fetchedStats{stats: stats, fetched: time.Now()}
+		}(i, server)
+	}
+	l.statsMu.Unlock()
+	wg.Wait()
+	stats := make([]map[string]string, len(configuration))
+	for i := range configuration {
+		stats[i] = fetched[i].stats
+	}
+	if fetch {
+		l.statsMu.Lock()
+		l.stats = make(map[raft.ServerID]fetchedStats, len(configuration))
+		for i, server := range configuration {
+			l.stats[server.ID] = fetched[i]
+		}
+		l.statsMu.Unlock()
+	}
+
+	var leaderStats map[string]string
+	for i, server := range configuration {
+		if l.isLeader(server) {
+			leaderStats = stats[i]
+		}
+	}
 
 	var servers []*api.Server
+	for i, server := range configuration {
+		s := &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: l.isLeader(server),
+			Suffrage: server.Suffrage.String(),
+		}
+		if stats[i] != nil {
+			h := &api.ServerHealth{}
+			l.judgeHealth(h, stats[i], leaderStats)
+			s.LastIndex = h.LastIndex
+			s.CommitIndex = parseStat(stats[i], "commit_index")
+			s.AppliedIndex = h.AppliedIndex
+			s.Term = h.Term
+			s.LastContact = h.LastContact
+			s.Healthy = h.Healthy
+		}
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
+
+// WatchServers sends the servers, then again whenever the configuration
+// or the leader changes, until the context is done or the log is closed
+func (l *DistributedLog) WatchServers(
+	ctx context.Context,
+) <-chan []*api.Server {
+	return l.watch.watch(ctx)
+}
+
+func (l *DistributedLog) GetPeers() ([]*api.Peer, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	var peers []*api.Peer
 
 	for _, server := range future.Configuration().Servers {
-		servers = append(servers, &api.Server{
+		peers = append(peers, &api.Peer{
 			Id:       string(server.ID),
-			RpcAddr:  string(server.Address),
-			IsLeader: l.raft.Leader() == server.Address,
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+			IsLeader: l.isLeader(server),
 		})
 	}
 
-	return servers, nil
+	return peers, nil
 }
 
 var _ raft.FSM = (*fsm)(nil)
 
+// The fsm applies the commands to the logs they name. It applies one
+// command at a time while reads go on, so it only locks the logs to
+// create or delete them.
 type fsm struct {
-	log *Log
+	dataDir string
+	config  Config
+
+	mu     sync.RWMutex
+	logs   map[string]*fsmLog
+	topics map[string]*api.Topic
+	groups groupOffsets
+	// Nil unless the server runs topics' partitions
+	partitions *partitions
+
+	// How many snapshots still read each log. Logs deleted or reset
+	// meanwhile are retired, and closed once the last one is released.
+	snapshotsMu sync.Mutex
+	snapshots   map[*Log]int
+	retired     map[*Log]string
+}
+
+// A log and the state the fsm keeps along with it
+type fsmLog struct {
+	name         string
+	config       logConfig
+	log          *Log
+	producers    *producers
+	transactions *transactions
 }
 
 type RequestType uint8
@@ -298,39 +795,312 @@ type RequestType uint8
 const (
 	AppendRequestType RequestType = 0
 	// ReadRequestType RequestType  = 1 // uncomment if implementing raft coordniate read
+	AppendBatchRequestType       RequestType = 2
+	BeginTransactionRequestType  RequestType = 3
+	EndTransactionRequestType    RequestType = 4
+	AppendTransactionRequestType RequestType = 5
+	CreateLogRequestType         RequestType = 6
+	DeleteLogRequestType         RequestType = 7
+	CreateTopicRequestType       RequestType = 8
+	DeleteTopicRequestType       RequestType = 9
+	CommitOffsetRequestType      RequestType = 10
 )
 
 // This is the logic that updates the local log per raft instance.
 // It takes the 'raft.Log` value and gets the request type and request/response
 // object from payload
-func (l *fsm) Apply(record *raft.Log) interface{} {
+func (f *fsm) Apply(record *raft.Log) interface{} {
 	buf := record.Data
 	reqType := RequestType(buf[0])
 	reqMsg := buf[1:]
 	switch reqType {
 	case AppendRequestType:
-		return l.applyAppend(reqMsg)
+		req := &api.AppendRequest{}
+		return f.applyTo(reqMsg, req, func(l *fsmLog) interface{} {
+			return l.applyAppend(req)
+		})
+	case AppendBatchRequestType:
+		req := &api.AppendBatchRequest{}
+		return f.applyTo(reqMsg, req, func(l *fsmLog) interface{} {
+			return l.applyAppendBatch(req)
+		})
+	case BeginTransactionRequestType:
+		req := &api.BeginTransactionRequest{}
+		return f.applyTo(reqMsg, req, func(l *fsmLog) interface{} {
+			return l.applyBeginTransaction(req)
+		})
+	case EndTransactionRequestType:
+		req := &api.EndTransactionRequest{}
+		return f.applyTo(reqMsg, req, func(l *fsmLog) interface{} {
+			return l.applyEndTransaction(req)
+		})
+	case AppendTransactionRequestType:
+		req := &api.AppendTransactionRequest{}
+		return f.applyTo(reqMsg, req, func(l *fsmLog) interface{} {
+			return l.applyAppendTransaction(req)
+		})
+	case CreateLogRequestType:
+		return f.applyCreateLog(reqMsg)
+	case DeleteLogRequestType:
+		return f.applyDeleteLog(reqMsg)
+	case CreateTopicRequestType:
+		return f.applyCreateTopic(reqMsg)
+	case DeleteTopicRequestType:
+		return f.applyDeleteTopic(reqMsg)
+	case CommitOffsetRequestType:
+		return f.applyCommitOffset(reqMsg)
 		// case ReadRequestType:
 		// 	return l.applyRead(reqMsg)
 	}
 	return nil
 }
 
+type logRequest interface {
+	proto.Message
+	GetLog() string
+}
+
 // The byte array passed in is the actual request object we need to
-// decode
-func (l *fsm) applyAppend(b []byte) interface{} {
-	var req api.AppendRequest
-	err := proto.Unmarshal(b, &req)
-	if err != nil {
+// decode, it's applied to the log it names
+func (f *fsm) applyTo(
+	b []byte,
+	req logRequest,
+	apply func(*fsmLog) interface{},
+) interface{} {
+	if err := proto.Unmarshal(b, req); err != nil {
 		return err
 	}
+	// only the fsm changes the logs, so it doesn't need the lock to look
+	// them up
+	l, ok := f.logs[req.GetLog()]
+	if !ok {
+		return api.ErrLogNotFound{Name: req.GetLog()}
+	}
+	return apply(l)
+}
+
+func (l *fsmLog) applyAppend(req *api.AppendRequest) interface{} {
+	if req.ProducerId != "" {
+		offsets, err := l.producers.check(req.ProducerId, req.Sequence, 1)
+		if err != nil {
+			return err
+		}
+		if offsets != nil {
+			return &api.AppendResponse{Offset: offsets[0]}
+		}
+	}
+	if req.ExpectedOffset != nil {
+		next := l.log.nextOffset()
+		if *req.ExpectedOffset != next {
+			return api.ErrUnexpectedOffset{
+				Expected: *req.ExpectedOffset,
+				Actual:   next,
+			}
+		}
+	}
+	if err := l.checkTransaction(req.TransactionId); err != nil {
+		return err
+	}
+	setTransaction(req.TransactionId, api.Record_NONE, req.Record)
 	offset, err := l.log.Append(req.Record)
 	if err != nil {
 		return err
 	}
+	if req.ProducerId != "" {
+		l.producers.record(req.ProducerId, req.Sequence, []uint64{offset})
+	}
 	return &api.AppendResponse{Offset: offset}
 }
 
+func (l *fsmLog) applyAppendBatch(req *api.AppendBatchRequest) interface{} {
+	dedup := req.ProducerId != "" && len(req.Records) != 0
+	if dedup {
+		offsets, err := l.producers.check(
+			req.ProducerId,
+			req.Sequence,
+			len(req.Records),
+		)
+		if err != nil {
+			return err
+		}
+		if offsets != nil {
+			return &api.AppendBatchResponse{Offsets: offsets}
+		}
+	}
+	if err := l.checkTransaction(req.TransactionId); err != nil {
+		return err
+	}
+	setTransaction(req.TransactionId, api.Record_NONE, req.Records...)
+	offsets, err := l.log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	if dedup {
+		l.producers.record(req.ProducerId, req.Sequence, offsets)
+	}
+	return &api.AppendBatchResponse{Offsets: offsets}
+}
+
+// Appends to transactions need them to be open
+func (l *fsmLog) checkTransaction(id string) error {
+	if id == "" || l.transactions.isOpen(id) {
+		return nil
+	}
+	return api.ErrTransaction{TransactionID: id, Reason: "not open"}
+}
+
+// Records get their transaction and marker from the fsm only, so clients
+// can't end others' transactions by appending markers
+func setTransaction(id string, marker api.Record_Marker, records ...*api.Record) {
+	for _, record := range records {
+		record.TransactionId, record.Marker = id, marker
+	}
+}
+
+func (l *fsmLog) applyBeginTransaction(
+	req *api.BeginTransactionRequest,
+) interface{} {
+	if req.TransactionId == "" {
+		return api.ErrTransaction{Reason: "no ID"}
+	}
+	l.transactions.mu.Lock()
+	defer l.transactions.mu.Unlock()
+	if offset, ok := l.transactions.open[req.TransactionId]; ok {
+		return &api.BeginTransactionResponse{Offset: offset}
+	}
+	offset, err := l.appendMarker(req.TransactionId, api.Record_BEGIN)
+	if err != nil {
+		return err
+	}
+	l.transactions.open[req.TransactionId] = offset
+	l.transactions.began[req.TransactionId] = time.Now()
+	delete(l.transactions.ended, req.TransactionId)
+	return &api.BeginTransactionResponse{Offset: offset}
+}
+
+func (l *fsmLog) applyEndTransaction(
+	req *api.EndTransactionRequest,
+) interface{} {
+	l.transactions.mu.Lock()
+	defer l.transactions.mu.Unlock()
+	begin, ok := l.transactions.open[req.TransactionId]
+	if req.TimedOutBegin != nil && (!ok || begin != *req.TimedOutBegin) {
+		// the transaction ended before the leader's abort got here
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "not open",
+		}
+	}
+	if !ok {
+		return l.transactions.endedAgain(req)
+	}
+	marker := api.Record_COMMIT
+	if req.Abort {
+		marker = api.Record_ABORT
+	}
+	offset, err := l.appendMarker(req.TransactionId, marker)
+	if err != nil {
+		return err
+	}
+	l.transactions.end(req.TransactionId, endedTransaction{
+		Offset:   offset,
+		Abort:    req.Abort,
+		TimedOut: req.TimedOutBegin != nil,
+	})
+	if req.Abort {
+		l.transactions.aborted[req.TransactionId] = append(
+			l.transactions.aborted[req.TransactionId],
+			abortedTransaction{Begin: begin, Abort: offset},
+		)
+	}
+	lowest, err := l.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	l.transactions.prune(lowest)
+	return &api.EndTransactionResponse{Offset: offset}
+}
+
+// Appends the markers and the records holding the lock, so committed
+// reads see all of the transaction or none of it
+func (l *fsmLog) applyAppendTransaction(
+	req *api.AppendTransactionRequest,
+) interface{} {
+	if req.TransactionId == "" {
+		return api.ErrTransaction{Reason: "no ID"}
+	}
+	l.transactions.mu.Lock()
+	defer l.transactions.mu.Unlock()
+	if _, ok := l.transactions.open[req.TransactionId]; ok {
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "already open",
+		}
+	}
+	begin, err := l.appendMarker(req.TransactionId, api.Record_BEGIN)
+	if err != nil {
+		return err
+	}
+	setTransaction(req.TransactionId, api.Record_NONE, req.Records...)
+	offsets, err := l.log.AppendBatch(req.Records)
+	var commit uint64
+	if err == nil {
+		commit, err = l.appendMarker(req.TransactionId, api.Record_COMMIT)
+	}
+	if err != nil {
+		// hide what made it into the log
+		l.transactions.aborted[req.TransactionId] = append(
+			l.transactions.aborted[req.TransactionId],
+			abortedTransaction{Begin: begin, Abort: l.log.nextOffset()},
+		)
+		delete(l.transactions.ended, req.TransactionId)
+		return err
+	}
+	l.transactions.end(req.TransactionId, endedTransaction{Offset: commit})
+	return &api.AppendTransactionResponse{Offsets: offsets}
+}
+
+func (l *fsmLog) appendMarker(id string, marker api.Record_Marker) (uint64, error) {
+	return l.log.Append(&api.Record{TransactionId: id, Marker: marker})
+}
+
+// Reads from the named log, holding the lock so it isn't deleted
+// meanwhile
+func (f *fsm) read(
+	name string,
+	offset uint64,
+	committed bool,
+) (*api.Record, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	l, ok := f.logs[name]
+	if !ok {
+		return nil, api.ErrLogNotFound{Name: name}
+	}
+	if committed {
+		return l.readCommitted(offset)
+	}
+	return l.log.Read(offset)
+}
+
+// Reads the first record at or after the offset that isn't a marker or
+// part of an aborted transaction, and comes before the open transactions
+func (l *fsmLog) readCommitted(offset uint64) (*api.Record, error) {
+	l.transactions.mu.RLock()
+	defer l.transactions.mu.RUnlock()
+	stable := l.transactions.stableOffset(l.log.nextOffset())
+	for off := offset; off < stable; off++ {
+		record, err := l.log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		if l.transactions.committed(record) {
+			return record, nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
 // If implementing a raft based read
 // func (l *fsm) applyRead(b []byte) interface{} {
 // 	var req api.ReadRequest
@@ -345,15 +1115,128 @@ func (l *fsm) applyAppend(b []byte) interface{} {
 // 	return &api.ReadResponse{Record: record}
 // }
 
+// Snapshots start with the magic and their version, then hold sections
+// of a kind byte, the length of what follows and the section's data. The
+// topics and the groups' offsets come first, then every log's header is
+// followed by its records and state. The records are sections of their
+// own, so nothing a client puts in them is taken for the fsm's state.
+const (
+	snapshotMagic   = "dcl_snap"
+	snapshotVersion = 1
+)
+
+const (
+	recordsSection byte = iota + 1
+	producersSection
+	transactionsSection
+	logHeaderSection
+	topicsSection
+	groupsSection
+)
+
+type logHeader struct {
+	Name   string    `json:"name"`
+	Config logConfig `json:"config"`
+	// Of the log's first record, it starts there again when restored
+	Offset uint64 `json:"offset"`
+}
+
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	s := &snapshot{fsm: f}
+	readers := []io.Reader{
+		bytes.NewReader(append([]byte(snapshotMagic), snapshotVersion)),
+	}
+	if topics := f.sortedTopics(); len(topics) != 0 {
+		r, err := stateSection(topicsSection, topics)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	if len(f.groups) != 0 {
+		r, err := stateSection(groupsSection, f.groups)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	// raft doesn't apply entries while the snapshot is taken, so the
+	// state matches the logs. It does while the snapshot is persisted,
+	// the logs deleted meanwhile are kept open until it's released.
+	for _, l := range f.sortedLogs() {
+		f.hold(l.log)
+		s.logs = append(s.logs, l.log)
+		r, err := l.snapshotSections()
+		if err != nil {
+			s.Release()
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	s.reader = io.MultiReader(readers...)
+	return s, nil
+}
+
+// The log's header, records and state
+func (l *fsmLog) snapshotSections() (io.Reader, error) {
+	offset, err := l.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	header, err := stateSection(logHeaderSection, logHeader{
+		Name:   l.name,
+		Config: l.config,
+		Offset: offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+	records, size := l.log.snapshotReader()
+	readers := []io.Reader{
+		header,
+		bytes.NewReader(sectionHeader(recordsSection, size)),
+		records,
+	}
+	if len(l.producers.byID) != 0 {
+		r, err := stateSection(producersSection, l.producers)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	if !l.transactions.empty() {
+		r, err := stateSection(transactionsSection, l.transactions)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	return io.MultiReader(readers...), nil
+}
+
+func sectionHeader(kind byte, size uint64) []byte {
+	b := make([]byte, 1+lenWidth)
+	b[0] = kind
+	enc.PutUint64(b[1:], size)
+	return b
+}
+
+// Encodes the state as JSON in a section of the kind
+func stateSection(kind byte, state interface{}) (io.Reader, error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	header := sectionHeader(kind, uint64(len(value)))
+	return bytes.NewReader(append(header, value...)), nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
 	reader io.Reader
+	fsm    *fsm
+	logs   []*Log
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
@@ -364,20 +1247,100 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 	return sink.Close()
 }
 
-func (s *snapshot) Release() {}
+func (s *snapshot) Release() {
+	if err := s.fsm.release(s.logs); err != nil {
+		zap.L().Named("fsm").Error("failed to close retired log", zap.Error(err))
+	}
+	s.logs = nil
+}
 
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
+	// the snapshot creates the named logs again
+	if err := f.deleteNamedLogs(); err != nil {
+		return err
+	}
 
-	var buf bytes.Buffer
+	magic := make([]byte, len(snapshotMagic)+1)
+	n, err := io.ReadFull(r, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF ||
+		(err == nil && string(magic[:len(snapshotMagic)]) != snapshotMagic) {
+		// snapshots from before the sections only hold the default
+		// log's records
+		legacy := io.MultiReader(bytes.NewReader(magic[:n]), r)
+		return f.restoreRecords(legacy, nil)
+	} else if err != nil {
+		return err
+	}
+	if version := magic[len(snapshotMagic)]; version != snapshotVersion {
+		return fmt.Errorf("unknown snapshot version %d", version)
+	}
 
-	for i := 0; ; i++ {
+	b := make([]byte, 1+lenWidth)
+	var l *fsmLog
+	var topics []*api.Topic
+	groups := make(groupOffsets)
+	for {
 		_, err := io.ReadFull(r, b)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
+		section := io.LimitReader(r, int64(enc.Uint64(b[1:])))
+
+		switch kind := b[0]; kind {
+		case recordsSection:
+			if l == nil {
+				return fmt.Errorf("snapshot has records before a log header")
+			}
+			err = f.restoreRecords(section, l)
+		case topicsSection:
+			err = json.NewDecoder(section).Decode(&topics)
+		case groupsSection:
+			err = json.NewDecoder(section).Decode(&groups)
+		case logHeaderSection:
+			var header logHeader
+			if err = json.NewDecoder(section).Decode(&header); err == nil {
+				l, err = f.restoreLog(header)
+			}
+		case producersSection, transactionsSection:
+			if l == nil {
+				return fmt.Errorf("snapshot has log state before a log header")
+			}
+			var state interface{} = l.producers
+			if kind == transactionsSection {
+				state = l.transactions
+			}
+			err = json.NewDecoder(section).Decode(state)
+		default:
+			return fmt.Errorf("unknown snapshot section %d", kind)
+		}
+		if err != nil {
+			return err
+		}
+		// skip whatever the section's decoder left
+		if _, err = io.Copy(ioutil.Discard, section); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.groups = groups
+	f.mu.Unlock()
+	return f.restoreTopics(topics)
+}
+
+// Appends the length prefixed records to the log. Without a log, they're
+// the default log's, which starts over at the first record's offset.
+func (f *fsm) restoreRecords(r io.Reader, l *fsmLog) error {
+	b := make([]byte, lenWidth)
+	var buf bytes.Buffer
+	for {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
 
 		size := int64(enc.Uint64(b))
 		if _, err = io.CopyN(&buf, r, size); err != nil {
@@ -388,19 +1351,17 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
-
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if l == nil {
+			l, err = f.restoreLog(logHeader{Offset: record.Offset})
+			if err != nil {
 				return err
 			}
 		}
-		if _, err = f.log.Append(record); err != nil {
+		if _, err = l.log.Append(record); err != nil {
 			return err
 		}
 		buf.Reset()
 	}
-	return nil
 }
 
 var _ raft.LogStore = (*logStore)(nil)
@@ -419,14 +1380,28 @@ func newLogStore(dir string, c Config) (*logStore, error) {
 }
 
 func (l *logStore) FirstIndex() (uint64, error) {
+	if l.empty() {
+		return 0, nil
+	}
 	return l.LowestOffset()
 }
 
 func (l *logStore) LastIndex() (uint64, error) {
+	if l.empty() {
+		return 0, nil
+	}
 	off, err := l.HighestOffset()
 	return off, err
 }
 
+// Raft expects an empty store, e.g. after compacting every entry into a
+// snapshot, to report 0 for its first and last index
+func (l *logStore) empty() bool {
+	lowest, _ := l.LowestOffset()
+	highest, _ := l.HighestOffset()
+	return highest < lowest
+}
+
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
 	if err != nil {
@@ -465,6 +1440,20 @@ type StreamLayer struct {
 	ln              net.Listener
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
+	clusterID       *ClusterID
+	logger          *zap.Logger
+	// Set on the layers of groups multiplexed over a StreamMux
+	group string
+	// Reported by Addr instead of the listener's address
+	advertise net.Addr
+
+	// Connections are handshaken apart from each other, so a slow one
+	// doesn't hold up the others, and handed to Accept once they're done
+	acceptOnce sync.Once
+	accepted   chan net.Conn
+	acceptErrs chan error
+	closeOnce  sync.Once
+	closed     chan struct{}
 }
 
 func NewStreamLayer(
@@ -476,14 +1465,59 @@ func NewStreamLayer(
 		ln:              ln,
 		serverTLSConfig: serverTLSConfig,
 		peerTLSConfig:   peerTLSConfig,
+		logger:          zap.L().Named("stream-layer"),
+		accepted:        make(chan net.Conn),
+		acceptErrs:      make(chan error),
+		closed:          make(chan struct{}),
 	}
 }
 
 const RaftRPC = 1
 
+const (
+	handshakeTimeout = 10 * time.Second
+	handshakeOK      = 1
+	handshakeRefused = 0
+	// Starts the handshake, so servers tell it apart from the Raft RPCs
+	// of servers of older versions, which don't handshake. Raft's RPC
+	// types are all lower.
+	handshakeVersion = 0xd1
+)
+
+var ErrClusterIDMismatch = fmt.Errorf("cluster ID mismatch")
+
 func (s *StreamLayer) Dial(
 	addr raft.ServerAddress,
 	timeout time.Duration,
+) (net.Conn, error) {
+	conn, err := s.dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = s.dialHandshake(conn, timeout)
+	if err == nil {
+		return conn, nil
+	}
+	conn.Close()
+	// servers of older versions close the connection on the handshake,
+	// they take Raft's RPCs right away. They're dialed again without it
+	// while the cluster's upgraded.
+	if s.group == "" && closedByPeer(err) {
+		return s.dial(addr, timeout)
+	}
+	return nil, err
+}
+
+func closedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// Dials the server and writes the connection's header
+func (s *StreamLayer) dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
 ) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: timeout}
 	var conn, err = dialer.Dial("tcp", string(addr))
@@ -491,7 +1525,7 @@ func (s *StreamLayer) Dial(
 		return nil, err
 	}
 
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	_, err = conn.Write(groupHeader(s.group))
 	if err != nil {
 		return nil, err
 	}
@@ -499,33 +1533,183 @@ func (s *StreamLayer) Dial(
 	if s.peerTLSConfig != nil {
 		conn = tls.Client(conn, s.peerTLSConfig)
 	}
+	return conn, nil
+}
 
-	return conn, err
+// Sends our cluster ID and waits for the other server to accept it
+func (s *StreamLayer) dialHandshake(conn net.Conn, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = handshakeTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	id := s.clusterID.Get()
+	b := append([]byte{handshakeVersion, byte(len(id))}, id...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	b = make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != handshakeOK {
+		return ErrClusterIDMismatch
+	}
+	return conn.SetDeadline(time.Time{})
 }
 
+// Returns the next connection that passed the handshake. Connections
+// from servers of other clusters are closed rather than returned as
+// errors, since Raft's transport backs off accepting after every error.
 func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
-	if err != nil {
+	s.acceptOnce.Do(func() { go s.acceptLoop() })
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case err := <-s.acceptErrs:
 		return nil, err
+	case <-s.closed:
+		return nil, net.ErrClosed
 	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
+}
+
+func (s *StreamLayer) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case s.acceptErrs <- err:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		go s.handshake(conn)
+	}
+}
+
+func (s *StreamLayer) handshake(conn net.Conn) {
+	conn, err := s.serverConn(conn)
 	if err != nil {
-		return nil, err
+		s.logger.Warn(
+			"refused raft connection",
+			zap.Error(err),
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+		)
+		conn.Close()
+		return
 	}
-	if bytes.Compare([]byte{byte(RaftRPC)}, b) != 0 {
-		return nil, fmt.Errorf("not a raft rpc")
+	select {
+	case s.accepted <- conn:
+	case <-s.closed:
+		conn.Close()
+	}
+}
+
+// Reads the connection's header, the mux read it already for groups'
+// connections, and goes on with TLS and the handshake
+func (s *StreamLayer) serverConn(conn net.Conn) (net.Conn, error) {
+	if s.group == "" {
+		if err := conn.SetDeadline(
+			time.Now().Add(handshakeTimeout),
+		); err != nil {
+			return conn, err
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return conn, err
+		}
+		if b[0] != RaftRPC {
+			return conn, fmt.Errorf("not a raft rpc")
+		}
 	}
 	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
+		conn = tls.Server(conn, s.serverTLSConfig)
 	}
-	return conn, nil
+	return s.acceptHandshake(conn)
+}
+
+// Checks the dialing server's cluster ID against ours. Servers that
+// haven't got one yet are let through, they'd never hear from the
+// leader otherwise. So are servers of older versions, which send Raft's
+// RPCs without handshaking, so a cluster can be upgraded a server at a
+// time.
+func (s *StreamLayer) acceptHandshake(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(
+		time.Now().Add(handshakeTimeout),
+	); err != nil {
+		return conn, err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return conn, err
+	}
+	if version[0] != handshakeVersion {
+		if s.group != "" {
+			return conn, fmt.Errorf("no handshake for group %s", s.group)
+		}
+		s.logger.Warn(
+			"accepted raft connection without a handshake",
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+		)
+		return &peekedConn{Conn: conn, peeked: version},
+			conn.SetDeadline(time.Time{})
+	}
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return conn, err
+	}
+	b := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return conn, err
+	}
+	theirs, ours := string(b), s.clusterID.Get()
+	if theirs != "" && ours != "" && theirs != ours {
+		_, _ = conn.Write([]byte{handshakeRefused})
+		return conn, fmt.Errorf(
+			"%w: got %s, want %s",
+			ErrClusterIDMismatch,
+			theirs,
+			ours,
+		)
+	}
+	if _, err := conn.Write([]byte{handshakeOK}); err != nil {
+		return conn, err
+	}
+	return conn, conn.SetDeadline(time.Time{})
+}
+
+// Reads the bytes read from the connection already before the rest
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.peeked)
+	c.peeked = c.peeked[n:]
+	return n, nil
 }
 
 func (s *StreamLayer) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
 	return s.ln.Close()
 }
 
+// Advertise makes Addr, and so Raft, report the address the other
+// servers dial rather than the one the listener listens on, like when it
+// listens on every interface. Set it before the log starts.
+func (s *StreamLayer) Advertise(addr net.Addr) {
+	s.advertise = addr
+}
+
 func (s *StreamLayer) Addr() net.Addr {
+	if s.advertise != nil {
+		return s.advertise
+	}
 	return s.ln.Addr()
 }
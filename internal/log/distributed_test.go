@@ -1,11 +1,14 @@
 package log_test
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,7 +16,9 @@ import (
 	api "github.com/nickstrad/dcl_store/api/v1"
 	"github.com/nickstrad/dcl_store/internal/discovery"
 	"github.com/nickstrad/dcl_store/internal/log"
+	"github.com/soheilhy/cmux"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 func TestMultipleNodes(t *testing.T) {
@@ -132,3 +137,919 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestAppendBatch(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+
+	offsets, err := logs[0].AppendBatch([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offsets)
+	require.Eventually(t, func() bool {
+		got, err := logs[1].Read(1)
+		return err == nil && string(got.Value) == "second"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// followers send clients to the leader
+	_, err = logs[1].AppendBatch([]*api.Record{{Value: []byte("third")}})
+	require.Equal(t, api.ErrNotLeader{
+		Reason:  raft.ErrNotLeader.Error(),
+		Refused: true,
+	}, err)
+}
+
+func TestAppendAt(t *testing.T) {
+	logs := setupCluster(t, 1, nil)
+
+	off, err := logs[0].AppendAt(&api.Record{Value: []byte("first")}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// of two writers that saw the same log only the first gets through
+	off, err = logs[0].AppendAt(&api.Record{Value: []byte("second")}, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = logs[0].AppendAt(&api.Record{Value: []byte("other")}, 1)
+	require.Equal(t, api.ErrUnexpectedOffset{Expected: 1, Actual: 2}, err)
+
+	// writers can't get ahead of the log either
+	_, err = logs[0].AppendAt(&api.Record{Value: []byte("third")}, 5)
+	require.Equal(t, api.ErrUnexpectedOffset{Expected: 5, Actual: 2}, err)
+
+	_, err = logs[0].Read(2)
+	require.Error(t, err)
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	logs := setupCluster(t, 1, func(c *log.Config) {
+		c.Transactions.Timeout = 200 * time.Millisecond
+	})
+
+	_, err := logs[0].BeginTransaction("abandoned")
+	require.NoError(t, err)
+	_, err = logs[0].AppendTo("abandoned", []*api.Record{{Value: []byte("a")}})
+	require.NoError(t, err)
+	_, err = logs[0].Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+
+	// the leader aborts it, and committed reads go on past it
+	require.Eventually(t, func() bool {
+		record, err := logs[0].ReadCommitted(0)
+		return err == nil && string(record.Value) == "after"
+	}, 3*time.Second, 50*time.Millisecond)
+	_, err = logs[0].EndTransaction("abandoned", false)
+	require.Equal(t, api.ErrTransaction{
+		TransactionID: "abandoned",
+		Reason:        "timed out",
+	}, err)
+}
+
+func TestCreateLog(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+
+	err := logs[0].CreateLog("orders", &api.LogConfig{MaxStoreBytes: 1024})
+	require.NoError(t, err)
+	err = logs[0].CreateLog("orders", nil)
+	require.Equal(t, api.ErrLogExists{Name: "orders"}, err)
+	_, err = logs[0].Log("payments")
+	require.Equal(t, api.ErrLogNotFound{Name: "payments"}, err)
+
+	orders, err := logs[0].Log("orders")
+	require.NoError(t, err)
+	off, err := orders.Append(&api.Record{Value: []byte("order placed")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// the named logs are replicated alongside the default one
+	require.Eventually(t, func() bool {
+		orders, err := logs[1].Log("orders")
+		if err != nil {
+			return false
+		}
+		got, err := orders.Read(0)
+		return err == nil && string(got.Value) == "order placed"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[1].Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	infos, err := logs[1].ListLogs()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, "orders", infos[0].Name)
+	require.Equal(t, uint64(1024), infos[0].Config.MaxStoreBytes)
+
+	require.NoError(t, logs[0].DeleteLog("orders"))
+	_, err = orders.Read(0)
+	require.Equal(t, api.ErrLogNotFound{Name: "orders"}, err)
+	require.Equal(t, api.ErrLogNotFound{Name: "orders"}, logs[0].DeleteLog("orders"))
+}
+
+func TestTopics(t *testing.T) {
+	logs := setupTopicsCluster(t, 3)
+
+	require.NoError(t, logs[0].CreateTopic("orders", 3))
+	err := logs[0].CreateTopic("orders", 3)
+	require.Equal(t, api.ErrTopicExists{Name: "orders"}, err)
+	err = logs[0].CreateTopic("payments", 0)
+	require.IsType(t, api.ErrInvalidTopic{}, err)
+
+	// the partitions' leaders spread across the servers
+	leaders := func(l *log.DistributedLog) map[string]bool {
+		ids := make(map[string]bool)
+		for _, p := range l.Partitions() {
+			ids[p.LeaderId] = true
+		}
+		return ids
+	}
+	require.Eventually(t, func() bool {
+		ids := leaders(logs[0])
+		return len(ids) == 3 && !ids[""]
+	}, 10*time.Second, 100*time.Millisecond)
+
+	partitions := logs[0].Partitions()
+	require.Equal(t, 3, len(partitions))
+	leader := partitions[1].LeaderId
+	var p *log.DistributedLog
+	for i, l := range logs {
+		if fmt.Sprint(i) == leader {
+			p, err = l.Partition("orders", 1)
+			require.NoError(t, err)
+		}
+	}
+	off, err := p.Append(&api.Record{Value: []byte("order placed")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// partitions are replicated like the cluster's log, but apart
+	// from it and each other
+	for _, l := range logs {
+		replica, err := l.Partition("orders", 1)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			got, err := replica.Read(0)
+			return err == nil && string(got.Value) == "order placed"
+		}, 500*time.Millisecond, 50*time.Millisecond)
+		other, err := l.Partition("orders", 0)
+		require.NoError(t, err)
+		_, err = other.Read(0)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	}
+	_, err = logs[0].Partition("orders", 3)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	topics, err := logs[2].ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(topics))
+	require.Equal(t, uint32(3), topics[0].Partitions)
+
+	require.NoError(t, logs[0].DeleteTopic("orders"))
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			_, err := l.Partition("orders", 0)
+			return err == api.ErrTopicNotFound{Name: "orders"}
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+}
+
+func TestPartitionServers(t *testing.T) {
+	logs := setupTopicsCluster(t, 2)
+	require.NoError(t, logs[0].CreateTopic("orders", 1))
+
+	// a server the partitions' leader never heard join is added anyway
+	third, addr := newTopicsNode(t, "2", discovery.GetPorts(1)[0], false)
+	require.NoError(t, logs[0].AddVoter("2", addr))
+	logs = append(logs, third)
+
+	var leader *log.DistributedLog
+	require.Eventually(t, func() bool {
+		for _, p := range logs[0].Partitions() {
+			for i, l := range logs {
+				if p.LeaderId == fmt.Sprint(i) {
+					leader, _ = l.Partition("orders", 0)
+				}
+			}
+		}
+		return leader != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err := leader.Append(&api.Record{Value: []byte("order placed")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		replica, err := third.Partition("orders", 0)
+		if err != nil {
+			return false
+		}
+		got, err := replica.Read(0)
+		return err == nil && string(got.Value) == "order placed"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestGroupMembership(t *testing.T) {
+	logs := setupTopicsCluster(t, 2)
+	leader := logs[0]
+	require.NoError(t, leader.CreateTopic("payments", 3))
+	require.NoError(t, leader.CreateLog("orders", nil))
+
+	join := func(req *api.JoinGroupRequest) *api.JoinGroupResponse {
+		t.Helper()
+		res, err := leader.JoinGroup(req)
+		require.NoError(t, err)
+		return res
+	}
+	heartbeat := func(res *api.JoinGroupResponse) *api.HeartbeatResponse {
+		t.Helper()
+		hb, err := leader.Heartbeat(&api.HeartbeatRequest{
+			Group:    "billing",
+			MemberId: res.MemberId,
+		})
+		require.NoError(t, err)
+		return hb
+	}
+
+	// the first member gets all the partitions
+	first := join(&api.JoinGroupRequest{Group: "billing", Topic: "payments"})
+	require.NotEmpty(t, first.MemberId)
+	require.Equal(t, []uint32{0, 1, 2}, first.Assignment.Partitions)
+
+	// and shares them once another joins, in a new generation
+	second := join(&api.JoinGroupRequest{
+		Group:          "billing",
+		Topic:          "payments",
+		SessionTimeout: durationpb.New(200 * time.Millisecond),
+	})
+	require.Greater(t, second.Generation, first.Generation)
+	hb := heartbeat(first)
+	require.Equal(t, second.Generation, hb.Generation)
+	got := append(hb.Assignment.Partitions, second.Assignment.Partitions...)
+	require.ElementsMatch(t, []uint32{0, 1, 2}, got)
+	require.NotEmpty(t, hb.Assignment.Partitions)
+	require.NotEmpty(t, second.Assignment.Partitions)
+
+	// members of older generations are fenced
+	commit := &api.CommitOffsetRequest{
+		Group:      "billing",
+		Topic:      "payments",
+		Offset:     1,
+		MemberId:   first.MemberId,
+		Generation: first.Generation,
+	}
+	require.Equal(t, api.ErrStaleGeneration{
+		Group:      "billing",
+		Generation: first.Generation,
+		Current:    second.Generation,
+	}, leader.CommitOffset(commit))
+	commit.Generation = hb.Generation
+	require.NoError(t, leader.CommitOffset(commit))
+
+	// members that stop heartbeating are dropped
+	time.Sleep(300 * time.Millisecond)
+	hb = heartbeat(first)
+	require.Greater(t, hb.Generation, second.Generation)
+	require.Equal(t, []uint32{0, 1, 2}, hb.Assignment.Partitions)
+	// heartbeats from generations the coordinator hasn't reached are
+	// meant for a newer one
+	_, err := leader.Heartbeat(&api.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   first.MemberId,
+		Generation: hb.Generation + 1,
+	})
+	require.IsType(t, api.ErrNotLeader{}, err)
+	_, err = leader.Heartbeat(&api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.Equal(t, api.ErrUnknownMember{
+		Group:    "billing",
+		MemberID: second.MemberId,
+	}, err)
+
+	_, err = leader.JoinGroup(&api.JoinGroupRequest{
+		Group: "billing",
+		Log:   "orders",
+	})
+	require.Equal(t, api.ErrGroupMismatch{Group: "billing"}, err)
+	_, err = logs[1].JoinGroup(&api.JoinGroupRequest{
+		Group: "billing",
+		Topic: "payments",
+	})
+	require.IsType(t, api.ErrNotLeader{}, err)
+
+	// the members of a log's group take turns at its ranges
+	audit := []*api.JoinGroupResponse{
+		join(&api.JoinGroupRequest{Group: "audit", Log: "orders", RangeSize: 10}),
+		join(&api.JoinGroupRequest{Group: "audit", Log: "orders", RangeSize: 10}),
+	}
+	a, err := leader.Heartbeat(&api.HeartbeatRequest{
+		Group:    "audit",
+		MemberId: audit[0].MemberId,
+	})
+	require.NoError(t, err)
+	b := audit[1].Assignment
+	for _, offset := range []uint64{0, 9, 10, 25} {
+		require.NotEqual(t, a.Assignment.OwnsOffset(offset), b.OwnsOffset(offset))
+	}
+
+	require.NoError(t, leader.LeaveGroup(&api.LeaveGroupRequest{
+		Group:    "audit",
+		MemberId: audit[0].MemberId,
+	}))
+	require.NoError(t, leader.LeaveGroup(&api.LeaveGroupRequest{
+		Group:    "audit",
+		MemberId: audit[0].MemberId,
+	}))
+	last, err := leader.Heartbeat(&api.HeartbeatRequest{
+		Group:    "audit",
+		MemberId: audit[1].MemberId,
+	})
+	require.NoError(t, err)
+	require.True(t, last.Assignment.OwnsOffset(0))
+	require.True(t, last.Assignment.OwnsOffset(10))
+}
+
+func TestClusterAdmin(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+
+	ports := discovery.GetPorts(1)
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[0]))
+	require.NoError(t, err)
+	logs = append(logs, newTestNode(t, "2", ln, false, nil))
+
+	// non-voters replicate but don't get a vote
+	err = logs[0].AddNonvoter("2", ln.Addr().String())
+	require.NoError(t, err)
+
+	peers, err := logs[0].GetPeers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(peers))
+	require.True(t, peers[0].IsLeader)
+	require.Equal(t, raft.Voter.String(), peers[1].Suffrage)
+	require.Equal(t, raft.Nonvoter.String(), peers[2].Suffrage)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := logs[2].Read(off)
+		return err == nil && string(got.Value) == "first"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// promote the non-voter in place
+	err = logs[0].AddVoter("2", ln.Addr().String())
+	require.NoError(t, err)
+	peers, err = logs[0].GetPeers()
+	require.NoError(t, err)
+	require.Equal(t, raft.Voter.String(), peers[2].Suffrage)
+
+	// raft refuses to snapshot until the fsm has applied an entry past
+	// the latest configuration change
+	_, err = logs[0].Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+
+	snapshot, err := logs[0].Snapshot()
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshot.Id)
+	require.NotZero(t, snapshot.Index)
+
+	stats := logs[0].Stats()
+	require.Equal(t, raft.Leader.String(), stats["state"])
+
+	err = logs[0].TransferLeadership("1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return logs[1].Stats()["state"] == raft.Leader.String()
+	}, 3*time.Second, 50*time.Millisecond)
+
+	err = logs[1].RemoveServer("2")
+	require.NoError(t, err)
+	peers, err = logs[1].GetPeers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(peers))
+}
+
+func TestClusterID(t *testing.T) {
+	withClusterID := func(id string) func(*log.Config) {
+		return func(c *log.Config) {
+			dir, err := ioutil.TempDir("", "cluster-id-test")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = os.RemoveAll(dir)
+			})
+			c.Raft.ClusterID, err = log.LoadClusterID(dir)
+			require.NoError(t, err)
+			require.NoError(t, c.Raft.ClusterID.Set(id))
+		}
+	}
+	logs := setupCluster(t, 1, withClusterID("production"))
+
+	ports := discovery.GetPorts(2)
+	for i, id := range []string{"production", "staging"} {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		name := fmt.Sprintf("%d", i+1)
+		logs = append(logs, newTestNode(t, name, ln, false, withClusterID(id)))
+		// non-voters don't count towards the quorum, so the leader
+		// commits the configuration without hearing from them
+		err = logs[0].AddNonvoter(name, ln.Addr().String())
+		require.NoError(t, err)
+	}
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := logs[1].Read(off)
+		return err == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// the staging server refuses the production leader's RPCs
+	time.Sleep(500 * time.Millisecond)
+	_, err = logs[2].Read(off)
+	require.Error(t, err)
+}
+
+func TestStreamLayerSlowHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer := log.NewStreamLayer(ln, nil, nil)
+	defer layer.Close()
+
+	// a connection that never says anything doesn't hold up the next
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer stalled.Close()
+	go func() {
+		addr := raft.ServerAddress(ln.Addr().String())
+		conn, err := log.NewStreamLayer(nil, nil, nil).Dial(addr, time.Second)
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := layer.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled connection held up accepting")
+	}
+}
+
+func TestStreamLayerOlderServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer := log.NewStreamLayer(ln, nil, nil)
+	defer layer.Close()
+
+	// servers of older versions send Raft's RPCs without handshaking
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{log.RaftRPC, 0, 'r', 'p', 'c'})
+	require.NoError(t, err)
+	accepted, err := layer.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	b := make([]byte, 4)
+	_, err = io.ReadFull(accepted, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 'r', 'p', 'c'}, b)
+
+	// and close connections that start with a handshake, they're dialed
+	// again without one
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer old.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := old.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err == nil && b[1] < 4 {
+				received <- b[1:]
+			}
+			conn.Close()
+		}
+	}()
+	addr := raft.ServerAddress(old.Addr().String())
+	dialed, err := log.NewStreamLayer(nil, nil, nil).Dial(addr, time.Second)
+	require.NoError(t, err)
+	defer dialed.Close()
+	_, err = dialed.Write([]byte{0})
+	require.NoError(t, err)
+	select {
+	case b := <-received:
+		require.Equal(t, []byte{0}, b)
+	case <-time.After(2 * time.Second):
+		t.Fatal("older server didn't get the rpc")
+	}
+}
+
+func TestStreamLayerAdvertise(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	layer := log.NewStreamLayer(ln, nil, nil)
+	defer layer.Close()
+	require.Equal(t, ln.Addr(), layer.Addr())
+
+	// servers listening on every interface are known by the address the
+	// others dial
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	advertise, err := net.ResolveTCPAddr("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	layer.Advertise(advertise)
+	require.Equal(t, "127.0.0.1:"+port, layer.Addr().String())
+}
+
+func TestAutopilot(t *testing.T) {
+	fetcher := &statsFetcher{logs: make(map[string]*log.DistributedLog)}
+	logs := setupCluster(t, 2, func(c *log.Config) {
+		c.Autopilot.Enabled = true
+		c.Raft.StatsFetcher = fetcher
+		c.Autopilot.ServerStabilizationTime = 500 * time.Millisecond
+		c.Autopilot.Interval = 50 * time.Millisecond
+	})
+	peers, err := logs[0].GetPeers()
+	require.NoError(t, err)
+	for i, peer := range peers {
+		fetcher.add(peer.Address, logs[i])
+	}
+
+	// joined as a non-voter, promoted once it's been healthy for the
+	// stabilization time
+	require.Equal(t, raft.Nonvoter.String(), peers[1].Suffrage)
+	require.Eventually(t, func() bool {
+		health, err := logs[0].Health()
+		return err == nil && health.Healthy && len(health.Servers) == 2
+	}, time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		peers, err := logs[0].GetPeers()
+		require.NoError(t, err)
+		return peers[1].Suffrage == raft.Voter.String()
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// followers don't keep a health report
+	_, err = logs[1].Health()
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// a voter that stays unreachable is demoted, the leader on its own
+	// is still a quorum of the remaining voters
+	fetcher.fail(peers[1].Address)
+	require.Eventually(t, func() bool {
+		health, err := logs[0].Health()
+		return err == nil && !health.Servers[1].Healthy
+	}, time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		peers, err := logs[0].GetPeers()
+		require.NoError(t, err)
+		return peers[1].Suffrage == raft.Nonvoter.String()
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestGetServers(t *testing.T) {
+	fetcher := &statsFetcher{logs: make(map[string]*log.DistributedLog)}
+	logs := setupCluster(t, 3, func(c *log.Config) {
+		c.Raft.StatsFetcher = fetcher
+	})
+	peers, err := logs[0].GetPeers()
+	require.NoError(t, err)
+	for i, peer := range peers {
+		fetcher.add(peer.Address, logs[i])
+	}
+
+	_, err = logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// any server describes every server's progress
+	require.Eventually(t, func() bool {
+		servers, err := logs[1].GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			if !server.Healthy ||
+				server.AppliedIndex != servers[0].LastIndex {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+
+	// servers that can't be reached are only described by their place in
+	// the configuration
+	fetcher.fail(peers[2].Address)
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.True(t, servers[0].IsLeader)
+	require.NotZero(t, servers[0].Term)
+	require.NotZero(t, servers[0].CommitIndex)
+	require.Equal(t, raft.Voter.String(), servers[2].Suffrage)
+	require.False(t, servers[2].Healthy)
+	require.Zero(t, servers[2].Term)
+
+	// and aren't asked again right away, so callers don't wait on them
+	// every time
+	fetches := fetcher.fetched(peers[2].Address)
+	_, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, fetches, fetcher.fetched(peers[2].Address))
+}
+
+func TestWatchServers(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+	// the last server to join has to catch up with the configuration
+	require.Eventually(t, func() bool {
+		servers, err := logs[2].GetServers()
+		return err == nil && len(servers) == 3 && servers[0].IsLeader
+	}, 3*time.Second, 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := logs[2].WatchServers(ctx)
+
+	// watchers start with the current servers
+	servers := <-watch
+	require.Equal(t, 3, len(servers))
+	require.True(t, servers[0].IsLeader)
+
+	// and are told about the new leader as soon as it's elected
+	err := logs[0].TransferLeadership("1")
+	require.NoError(t, err)
+	timeout := time.After(3 * time.Second)
+	for !servers[1].IsLeader {
+		select {
+		case servers = <-watch:
+		case <-timeout:
+			t.Fatal("leader change wasn't sent")
+		}
+	}
+	require.False(t, servers[0].IsLeader)
+
+	// the channel closes with the context
+	cancel()
+	for range watch {
+	}
+}
+
+type statsFetcher struct {
+	mu      sync.Mutex
+	logs    map[string]*log.DistributedLog
+	failed  map[string]bool
+	fetches map[string]int
+}
+
+func (f *statsFetcher) add(addr string, l *log.DistributedLog) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs[addr] = l
+}
+
+func (f *statsFetcher) fail(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = map[string]bool{addr: true}
+}
+
+func (f *statsFetcher) fetched(addr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches[addr]
+}
+
+func (f *statsFetcher) FetchStats(
+	ctx context.Context,
+	addr string,
+) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fetches == nil {
+		f.fetches = make(map[string]int)
+	}
+	f.fetches[addr]++
+	l, ok := f.logs[addr]
+	if !ok || f.failed[addr] {
+		return nil, fmt.Errorf("unreachable: %s", addr)
+	}
+	return l.Stats(), nil
+}
+
+func TestRecover(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ports := discovery.GetPorts(3)
+	var logs []*log.DistributedLog
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		addrs = append(addrs, ln.Addr().String())
+		var l *log.DistributedLog
+		if i == 0 {
+			l = openTestNode(t, dataDir, "0", ln, true, nil)
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			l = newTestNode(t, fmt.Sprintf("%d", i), ln, false, nil)
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), addrs[i]))
+		}
+		logs = append(logs, l)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		_, err := logs[0].Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	// lose every server, only the first one's disk survives
+	for _, l := range logs {
+		require.NoError(t, l.Close())
+	}
+
+	state, err := log.ReadRecoveryState(dataDir, log.Config{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(state.Configuration.Servers))
+	require.NotZero(t, state.LastIndex)
+
+	config := raft.Configuration{Servers: []raft.Server{{
+		ID:      "0",
+		Address: raft.ServerAddress(addrs[0]),
+	}}}
+	c := log.Config{}
+	c.Raft.LocalID = "0"
+	require.NoError(t, log.Recover(dataDir, c, config))
+
+	state, err = log.ReadRecoveryState(dataDir, log.Config{})
+	require.NoError(t, err)
+	require.Equal(t, config.Servers, state.Configuration.Servers)
+
+	// the survivor elects itself without the lost servers and kept
+	// every record exactly once
+	ln, err := net.Listen("tcp", addrs[0])
+	require.NoError(t, err)
+	l := openTestNode(t, dataDir, "0", ln, false, nil)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	for i, value := range []string{"first", "second"} {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, value, string(record.Value))
+	}
+	_, err = l.Read(2)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	off, err := l.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// a running server is refused before its logs are touched
+	err = log.Recover(dataDir, c, config)
+	require.EqualError(
+		t,
+		err,
+		fmt.Sprintf("the server owning %s is still running", dataDir),
+	)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(record.Value))
+}
+
+// setupCluster starts n nodes with the first one bootstrapping the
+// cluster and the rest joined through it as voters.
+func setupCluster(
+	t *testing.T,
+	n int,
+	fn func(*log.Config),
+) []*log.DistributedLog {
+	t.Helper()
+
+	var logs []*log.DistributedLog
+	ports := discovery.GetPorts(n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		l := newTestNode(t, fmt.Sprintf("%d", i), ln, i == 0, fn)
+		if i == 0 {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		} else {
+			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+// setupTopicsCluster starts a cluster whose servers run topics'
+// partitions, their Raft groups share the servers' listeners
+func setupTopicsCluster(t *testing.T, n int) []*log.DistributedLog {
+	t.Helper()
+
+	var logs []*log.DistributedLog
+	ports := discovery.GetPorts(n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%d", i)
+		l, addr := newTopicsNode(t, id, ports[i], i == 0)
+		if i == 0 {
+			err := l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		} else {
+			err := logs[0].Join(id, addr)
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+// newTopicsNode starts a node running topics' partitions on the port,
+// and returns it with its address
+func newTopicsNode(
+	t *testing.T,
+	id string,
+	port int,
+	bootstrap bool,
+) (*log.DistributedLog, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	mux := cmux.New(ln)
+	raftLn := mux.Match(firstByte(log.RaftRPC))
+	groupLn := mux.Match(firstByte(log.RaftGroupRPC))
+	go mux.Serve()
+
+	l := newTestNode(t, id, raftLn, bootstrap, func(c *log.Config) {
+		c.Topics.Mux = log.NewStreamMux(groupLn, nil, nil)
+		c.Topics.BalanceInterval = 100 * time.Millisecond
+	})
+	return l, ln.Addr().String()
+}
+
+func firstByte(b byte) cmux.Matcher {
+	return func(r io.Reader) bool {
+		got := make([]byte, 1)
+		if _, err := r.Read(got); err != nil {
+			return false
+		}
+		return got[0] == b
+	}
+}
+
+func newTestNode(
+	t *testing.T,
+	id string,
+	ln net.Listener,
+	bootstrap bool,
+	fn func(*log.Config),
+) *log.DistributedLog {
+	t.Helper()
+
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dataDir)
+	})
+	return openTestNode(t, dataDir, id, ln, bootstrap, fn)
+}
+
+func openTestNode(
+	t *testing.T,
+	dataDir string,
+	id string,
+	ln net.Listener,
+	bootstrap bool,
+	fn func(*log.Config),
+) *log.DistributedLog {
+	t.Helper()
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(id)
+
+	baseTimeout := 200 * time.Millisecond
+	config.Raft.HeartbeatTimeout = baseTimeout
+	config.Raft.ElectionTimeout = baseTimeout
+	config.Raft.LeaderLeaseTimeout = baseTimeout
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = bootstrap
+	if fn != nil {
+		fn(&config)
+	}
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l
+}
@@ -0,0 +1,175 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var groupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// The offsets the consumer groups committed, by group and then by the
+// log or partition they consume
+type groupOffsets map[string]map[string]*api.GroupOffset
+
+// Identifies the log or partition an offset is for among the group's
+func offsetKey(log, topic string, partition uint32) string {
+	if topic != "" {
+		return fmt.Sprintf("topic/%s/%d", topic, partition)
+	}
+	return "log/" + log
+}
+
+func (f *fsm) applyCommitOffset(b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if !groupNameRegexp.MatchString(req.Group) {
+		return api.ErrInvalidGroupName{Name: req.Group}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Topic != "" {
+		topic, ok := f.topics[req.Topic]
+		if !ok {
+			return api.ErrTopicNotFound{Name: req.Topic}
+		}
+		if req.Partition >= topic.Partitions {
+			return api.ErrPartitionNotFound{
+				Topic:     req.Topic,
+				Partition: req.Partition,
+			}
+		}
+	} else if _, ok := f.logs[req.Log]; !ok {
+		return api.ErrLogNotFound{Name: req.Log}
+	}
+	offsets, ok := f.groups[req.Group]
+	if !ok {
+		offsets = make(map[string]*api.GroupOffset)
+		f.groups[req.Group] = offsets
+	}
+	offsets[offsetKey(req.Log, req.Topic, req.Partition)] = &api.GroupOffset{
+		Log:       req.Log,
+		Topic:     req.Topic,
+		Partition: req.Partition,
+		Offset:    req.Offset,
+	}
+	return &api.CommitOffsetResponse{}
+}
+
+// Drops the offsets committed in a deleted log or topic, so groups start
+// over if it's created again. The caller holds the lock.
+func (f *fsm) forgetOffsets(deleted func(*api.GroupOffset) bool) {
+	for group, offsets := range f.groups {
+		for key, offset := range offsets {
+			if deleted(offset) {
+				delete(offsets, key)
+			}
+		}
+		if len(offsets) == 0 {
+			delete(f.groups, group)
+		}
+	}
+}
+
+// The offset the group committed, with its lag, nil if it hasn't
+// committed one
+func (f *fsm) fetchOffset(
+	group, log, topic string,
+	partition uint32,
+) *api.GroupOffset {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	offset, ok := f.groups[group][offsetKey(log, topic, partition)]
+	if !ok {
+		return nil
+	}
+	return f.withLag(offset)
+}
+
+// The caller holds the lock
+func (f *fsm) withLag(offset *api.GroupOffset) *api.GroupOffset {
+	offset = proto.Clone(offset).(*api.GroupOffset)
+	var next uint64
+	if offset.Topic != "" {
+		if f.partitions == nil {
+			return offset
+		}
+		p, err := f.partitions.get(offset.Topic, offset.Partition)
+		if err != nil {
+			return offset
+		}
+		next = p.nextOffset()
+	} else if l, ok := f.logs[offset.Log]; ok {
+		next = l.log.nextOffset()
+	}
+	if next > offset.Offset {
+		offset.Lag = next - offset.Offset
+	}
+	return offset
+}
+
+func (f *fsm) sortedGroups() []*api.ConsumerGroup {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	groups := make([]*api.ConsumerGroup, 0, len(f.groups))
+	for name, offsets := range f.groups {
+		keys := make([]string, 0, len(offsets))
+		for key := range offsets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		group := &api.ConsumerGroup{Name: name}
+		for _, key := range keys {
+			group.Offsets = append(group.Offsets, f.withLag(offsets[key]))
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// The offset the default log's next record gets. Partitions' fsms are
+// locked apart from the cluster's, restores replace their logs.
+func (l *DistributedLog) nextOffset() uint64 {
+	l.fsm.mu.RLock()
+	defer l.fsm.mu.RUnlock()
+	return l.fsm.logs[""].log.nextOffset()
+}
+
+// CommitOffset stores the offset of the next record the group consumes
+// in the log or partition the request names. Offsets committed by a
+// group's member are refused once the member's dropped or the group's
+// rebalanced, the partition may be some other member's by now.
+func (l *DistributedLog) CommitOffset(req *api.CommitOffsetRequest) error {
+	if req.MemberId != "" {
+		return l.coordinator.commit(req)
+	}
+	_, err := l.apply(CommitOffsetRequestType, req)
+	return err
+}
+
+// FetchOffset returns the offset the group committed in the log or
+// partition, nil if it hasn't committed one. Followers may not have
+// applied the latest commits yet.
+func (l *DistributedLog) FetchOffset(
+	req *api.FetchOffsetRequest,
+) (*api.GroupOffset, error) {
+	return l.fsm.fetchOffset(
+		req.Group,
+		req.Log,
+		req.Topic,
+		req.Partition,
+	), nil
+}
+
+// ListGroups lists the groups with the offsets they committed
+func (l *DistributedLog) ListGroups() ([]*api.ConsumerGroup, error) {
+	return l.fsm.sortedGroups(), nil
+}
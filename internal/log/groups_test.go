@@ -0,0 +1,103 @@
+package log
+
+import (
+	"io/ioutil"
+	"testing"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGroupOffsets(t *testing.T) {
+	f := newTestFSM(t)
+
+	commit := func(f *fsm, req *api.CommitOffsetRequest) interface{} {
+		return apply(t, f, CommitOffsetRequestType, req)
+	}
+	for i := 0; i < 5; i++ {
+		apply(t, f, AppendRequestType, &api.AppendRequest{
+			Record: &api.Record{Value: []byte("order placed")},
+		})
+	}
+	apply(t, f, CreateLogRequestType, &api.CreateLogRequest{Name: "orders"})
+	apply(t, f, CreateTopicRequestType, &api.Topic{
+		Name:       "payments",
+		Partitions: 2,
+	})
+
+	res := commit(f, &api.CommitOffsetRequest{Group: "billing", Offset: 3})
+	require.Equal(t, &api.CommitOffsetResponse{}, res)
+	res = commit(f, &api.CommitOffsetRequest{
+		Group:     "billing",
+		Topic:     "payments",
+		Partition: 1,
+		Offset:    7,
+	})
+	require.Equal(t, &api.CommitOffsetResponse{}, res)
+	res = commit(f, &api.CommitOffsetRequest{
+		Group: "shipping",
+		Log:   "orders",
+	})
+	require.Equal(t, &api.CommitOffsetResponse{}, res)
+
+	res = commit(f, &api.CommitOffsetRequest{Group: ""})
+	require.Equal(t, api.ErrInvalidGroupName{Name: ""}, res)
+	res = commit(f, &api.CommitOffsetRequest{Group: "billing", Log: "refunds"})
+	require.Equal(t, api.ErrLogNotFound{Name: "refunds"}, res)
+	res = commit(f, &api.CommitOffsetRequest{
+		Group:     "billing",
+		Topic:     "payments",
+		Partition: 2,
+	})
+	require.Equal(t, api.ErrPartitionNotFound{
+		Topic:     "payments",
+		Partition: 2,
+	}, res)
+
+	// the lag counts the records past the committed offset
+	requireOffsets(
+		t,
+		[]*api.GroupOffset{{Offset: 3, Lag: 2}},
+		[]*api.GroupOffset{f.fetchOffset("billing", "", "", 0)},
+	)
+	require.Nil(t, f.fetchOffset("billing", "orders", "", 0))
+	require.Nil(t, f.fetchOffset("billing", "", "payments", 0))
+
+	// the offsets are restored with the snapshot
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	restored := newTestFSM(t)
+	commit(restored, &api.CommitOffsetRequest{Group: "stale"})
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+	groups := restored.sortedGroups()
+	require.Equal(t, 2, len(groups))
+	require.Equal(t, "billing", groups[0].Name)
+	requireOffsets(t, []*api.GroupOffset{
+		{Offset: 3, Lag: 2},
+		{Topic: "payments", Partition: 1, Offset: 7},
+	}, groups[0].Offsets)
+	require.Equal(t, "shipping", groups[1].Name)
+
+	// and forgotten with the log or topic they were committed in
+	apply(t, f, DeleteLogRequestType, &api.DeleteLogRequest{Name: "orders"})
+	apply(t, f, DeleteTopicRequestType, &api.DeleteTopicRequest{
+		Name: "payments",
+	})
+	groups = f.sortedGroups()
+	require.Equal(t, 1, len(groups))
+	requireOffsets(t, []*api.GroupOffset{{Offset: 3, Lag: 2}}, groups[0].Offsets)
+}
+
+func requireOffsets(t *testing.T, want, got []*api.GroupOffset) {
+	t.Helper()
+	require.Equal(t, len(want), len(got))
+	for i := range want {
+		require.True(t, proto.Equal(want[i], got[i]), "%v != %v", want[i], got[i])
+	}
+}
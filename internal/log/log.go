@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -82,6 +83,11 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	return l.append(record)
+}
+
+// The caller holds the lock
+func (l *Log) append(record *api.Record) (uint64, error) {
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
@@ -94,6 +100,57 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	return off, err
 }
 
+// AppendBatch appends the records in order. If one of them fails, the
+// records appended before it are cut off the log again, so the batch is
+// appended whole or not at all.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments := len(l.segments)
+	storeSize, indexSize := l.activeSegment.store.size, l.activeSegment.index.size
+	next := l.activeSegment.nextOffset
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		off, err := l.append(record)
+		if err != nil {
+			rollbackErr := l.rollback(segments, storeSize, indexSize, next)
+			if rollbackErr != nil {
+				return nil, fmt.Errorf(
+					"%v, and failed to roll back the batch: %v",
+					err,
+					rollbackErr,
+				)
+			}
+			return nil, err
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// Cuts the log back to where it was before a batch: the segments the
+// batch rolled over to are removed, and the one that was active is cut
+// back to its sizes and next offset. The caller holds the lock.
+func (l *Log) rollback(
+	segments int,
+	storeSize, indexSize, next uint64,
+) error {
+	for _, s := range l.segments[segments:] {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:segments]
+	l.activeSegment = l.segments[segments-1]
+	if err := l.activeSegment.store.truncate(storeSize); err != nil {
+		return err
+	}
+	l.activeSegment.index.size = indexSize
+	l.activeSegment.nextOffset = next
+	return nil
+}
+
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -135,6 +192,10 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
 	return l.setup()
 }
 
@@ -157,6 +218,15 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// The offset the next record appended gets, HighestOffset doesn't tell
+// an empty log from one holding a single record
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[len(l.segments)-1].nextOffset
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -171,6 +241,11 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	// Keep an empty segment around after truncating everything, so the
+	// log still knows where it's at
+	if len(l.segments) == 0 {
+		return l.newSegment(lowest + 1)
+	}
 	return nil
 }
 
@@ -179,18 +254,38 @@ func (l *Log) Reader() io.Reader {
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{store: segment.store}
 	}
 	return io.MultiReader(readers...)
 }
 
+// Reads the records the log holds now, stopping short of those appended
+// after, and returns how many bytes it reads
+func (l *Log) snapshotReader() (io.Reader, uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var size uint64
+	readers := make([]io.Reader, len(l.segments))
+	for i, segment := range l.segments {
+		readers[i] = io.LimitReader(
+			&originReader{store: segment.store},
+			int64(segment.store.size),
+		)
+		size += segment.store.size
+	}
+	return io.MultiReader(readers...), size
+}
+
+// Only reads through the store, which flushes its buffer first. An
+// embedded store would promote its file's WriteTo, and io.Copy would
+// read the file from its current position instead.
 type originReader struct {
-	*store
-	off int64
+	store *store
+	off   int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
 	return n, err
 }
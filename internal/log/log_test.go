@@ -19,6 +19,8 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"headers are kept":                  testHeaders,
+		"failed batch is rolled back":       testBatchRollback,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -122,3 +124,56 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testHeaders(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value:       []byte(`{"id": 1}`),
+		Headers:     []*api.Header{{Key: "trace-id", Value: []byte("abc")}},
+		ContentType: "application/json",
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(append, read))
+	require.NoError(t, log.Close())
+}
+
+func testBatchRollback(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// the batch rolls over to new segments before its last record fails
+	// to marshal
+	batch := []*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		{TransactionId: "\xff"},
+	}
+	_, err = log.AppendBatch(batch)
+	require.Error(t, err)
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// the files are cut back too
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	for i, value := range []string{"first", "second"} {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, value, string(read.Value))
+	}
+	_, err = log.Read(2)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,396 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Names of the named logs, they're used as directory names
+var logNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// Segment config of a named log, unset fields fall back on the server's
+// own. It's saved next to the log's segments.
+type logConfig struct {
+	MaxStoreBytes uint64 `json:"max_store_bytes,omitempty"`
+	MaxIndexBytes uint64 `json:"max_index_bytes,omitempty"`
+}
+
+func newLogConfig(c *api.LogConfig) logConfig {
+	return logConfig{
+		MaxStoreBytes: c.GetMaxStoreBytes(),
+		MaxIndexBytes: c.GetMaxIndexBytes(),
+	}
+}
+
+func (c logConfig) proto() *api.LogConfig {
+	return &api.LogConfig{
+		MaxStoreBytes: c.MaxStoreBytes,
+		MaxIndexBytes: c.MaxIndexBytes,
+	}
+}
+
+// Opens the default log under dataDir/log and the named logs under
+// dataDir/logs
+func newFSM(dataDir string, config Config) (*fsm, error) {
+	f := &fsm{
+		dataDir: dataDir,
+		config:  config,
+		logs:    make(map[string]*fsmLog),
+		topics:  make(map[string]*api.Topic),
+		groups:  make(groupOffsets),
+
+		snapshots: make(map[*Log]int),
+		retired:   make(map[*Log]string),
+	}
+	// logs retired before the server stopped
+	if err := os.RemoveAll(f.retiredDir()); err != nil {
+		return nil, err
+	}
+	l, err := f.openLog("", logConfig{}, config.Segment.InitialOffset)
+	if err != nil {
+		return nil, err
+	}
+	f.logs[""] = l
+
+	dirs, err := ioutil.ReadDir(filepath.Join(dataDir, "logs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		b, err := ioutil.ReadFile(
+			filepath.Join(f.logDir(dir.Name()), "config.json"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		var c logConfig
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, err
+		}
+		l, err := f.openLog(dir.Name(), c, 0)
+		if err != nil {
+			return nil, err
+		}
+		f.logs[dir.Name()] = l
+	}
+	if config.Topics.Mux != nil {
+		f.partitions = newPartitions(dataDir, config, f.sortedTopics)
+	}
+	return f, nil
+}
+
+// The named log's directory, holding its config and segments
+func (f *fsm) logDir(name string) string {
+	return filepath.Join(f.dataDir, "logs", name)
+}
+
+func (f *fsm) segmentsDir(name string) string {
+	if name == "" {
+		return filepath.Join(f.dataDir, "log")
+	}
+	return filepath.Join(f.logDir(name), "log")
+}
+
+// Opens the log's segments, new logs start at the offset
+func (f *fsm) openLog(name string, c logConfig, offset uint64) (*fsmLog, error) {
+	log, err := f.newLog(name, c, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &fsmLog{
+		name:         name,
+		config:       c,
+		log:          log,
+		producers:    newProducers(),
+		transactions: newTransactions(),
+	}, nil
+}
+
+func (f *fsm) newLog(name string, c logConfig, offset uint64) (*Log, error) {
+	dir := f.segmentsDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	config := f.config
+	if c.MaxStoreBytes != 0 {
+		config.Segment.MaxStoreBytes = c.MaxStoreBytes
+	}
+	if c.MaxIndexBytes != 0 {
+		config.Segment.MaxIndexBytes = c.MaxIndexBytes
+	}
+	config.Segment.InitialOffset = offset
+	return NewLog(dir, config)
+}
+
+// Creates the named log's directory with its config, and opens it
+func (f *fsm) createLog(name string, c logConfig, offset uint64) error {
+	if err := os.MkdirAll(f.logDir(name), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(f.logDir(name), "config.json"), b, 0644)
+	if err != nil {
+		return err
+	}
+	l, err := f.openLog(name, c, offset)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs[name] = l
+	return nil
+}
+
+func (f *fsm) applyCreateLog(b []byte) interface{} {
+	var req api.CreateLogRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if !logNameRegexp.MatchString(req.Name) {
+		return api.ErrInvalidLogName{Name: req.Name}
+	}
+	if _, ok := f.logs[req.Name]; ok {
+		return api.ErrLogExists{Name: req.Name}
+	}
+	if err := f.createLog(req.Name, newLogConfig(req.Config), 0); err != nil {
+		return err
+	}
+	return &api.CreateLogResponse{}
+}
+
+func (f *fsm) applyDeleteLog(b []byte) interface{} {
+	var req api.DeleteLogRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return api.ErrInvalidLogName{Name: req.Name}
+	}
+	f.mu.Lock()
+	l, ok := f.logs[req.Name]
+	if !ok {
+		f.mu.Unlock()
+		return api.ErrLogNotFound{Name: req.Name}
+	}
+	delete(f.logs, req.Name)
+	f.forgetOffsets(func(offset *api.GroupOffset) bool {
+		return offset.Topic == "" && offset.Log == req.Name
+	})
+	f.mu.Unlock()
+	if err := f.retire(l.log, f.logDir(req.Name)); err != nil {
+		return err
+	}
+	return &api.DeleteLogResponse{}
+}
+
+// Deletes the named logs before a snapshot is restored
+func (f *fsm) deleteNamedLogs() error {
+	f.mu.Lock()
+	var deleted []*fsmLog
+	for name, l := range f.logs {
+		if name == "" {
+			continue
+		}
+		delete(f.logs, name)
+		deleted = append(deleted, l)
+	}
+	f.mu.Unlock()
+	for _, l := range deleted {
+		if err := f.retire(l.log, f.logDir(l.name)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(f.dataDir, "logs"))
+}
+
+// Starts the log over from the snapshot's header, the default log is
+// emptied and the named logs created again
+func (f *fsm) restoreLog(header logHeader) (*fsmLog, error) {
+	if header.Name != "" {
+		err := f.createLog(header.Name, header.Config, header.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return f.logs[header.Name], nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l := f.logs[""]
+	// snapshots may still read the segments, so the log is retired
+	// rather than reset
+	if err := f.retire(l.log, f.segmentsDir("")); err != nil {
+		return nil, err
+	}
+	log, err := f.newLog("", logConfig{}, header.Offset)
+	if err != nil {
+		return nil, err
+	}
+	l.log = log
+	l.producers = newProducers()
+	// reads go on, so the transactions are reset rather than replaced
+	l.transactions.reset()
+	return l, nil
+}
+
+// Where retired logs' directories wait for the snapshots reading them
+func (f *fsm) retiredDir() string {
+	return filepath.Join(f.dataDir, "retired")
+}
+
+// Keeps the log open until the snapshot reading it is released
+func (f *fsm) hold(log *Log) {
+	f.snapshotsMu.Lock()
+	defer f.snapshotsMu.Unlock()
+	f.snapshots[log]++
+}
+
+// Releases a snapshot's logs, closing those retired while it was read
+func (f *fsm) release(logs []*Log) error {
+	f.snapshotsMu.Lock()
+	closing := make(map[*Log]string)
+	for _, log := range logs {
+		if f.snapshots[log]--; f.snapshots[log] != 0 {
+			continue
+		}
+		delete(f.snapshots, log)
+		if dir, ok := f.retired[log]; ok {
+			delete(f.retired, log)
+			closing[log] = dir
+		}
+	}
+	f.snapshotsMu.Unlock()
+	for log, dir := range closing {
+		if err := removeLog(log, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the log's directory out of the way, so a log can take its place
+// right away, and removes it once no snapshot reads the log
+func (f *fsm) retire(log *Log, dir string) error {
+	if err := os.MkdirAll(f.retiredDir(), 0755); err != nil {
+		return err
+	}
+	retired, err := ioutil.TempDir(f.retiredDir(), "log")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dir, filepath.Join(retired, "log")); err != nil {
+		return err
+	}
+	f.snapshotsMu.Lock()
+	if f.snapshots[log] != 0 {
+		f.retired[log] = retired
+		f.snapshotsMu.Unlock()
+		return nil
+	}
+	f.snapshotsMu.Unlock()
+	return removeLog(log, retired)
+}
+
+func removeLog(log *Log, dir string) error {
+	if err := log.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// The logs by name, the default log first
+func (f *fsm) sortedLogs() []*fsmLog {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	logs := make([]*fsmLog, 0, len(f.logs))
+	for _, l := range f.logs {
+		logs = append(logs, l)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].name < logs[j].name
+	})
+	return logs
+}
+
+func (f *fsm) has(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.logs[name]
+	return ok
+}
+
+func (f *fsm) close() error {
+	if f.partitions != nil {
+		if err := f.partitions.close(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range f.logs {
+		if err := l.log.Close(); err != nil {
+			return err
+		}
+	}
+	// the retired logs' directories are removed when the fsm opens again
+	f.snapshotsMu.Lock()
+	defer f.snapshotsMu.Unlock()
+	for log := range f.retired {
+		if err := log.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateLog creates the named log on every server. Fields of the config
+// that aren't set fall back on the servers' segment config.
+func (l *DistributedLog) CreateLog(name string, config *api.LogConfig) error {
+	if !logNameRegexp.MatchString(name) {
+		return api.ErrInvalidLogName{Name: name}
+	}
+	_, err := l.apply(
+		CreateLogRequestType,
+		&api.CreateLogRequest{Name: name, Config: config},
+	)
+	return err
+}
+
+// DeleteLog deletes the named log and its records on every server
+func (l *DistributedLog) DeleteLog(name string) error {
+	_, err := l.apply(DeleteLogRequestType, &api.DeleteLogRequest{Name: name})
+	return err
+}
+
+// ListLogs describes the named logs, the default log isn't listed
+func (l *DistributedLog) ListLogs() ([]*api.LogInfo, error) {
+	var logs []*api.LogInfo
+	for _, log := range l.fsm.sortedLogs() {
+		if log.name == "" {
+			continue
+		}
+		logs = append(logs, &api.LogInfo{
+			Name:   log.name,
+			Config: log.config.proto(),
+		})
+	}
+	return logs, nil
+}
+
+// Log returns the named log, or the default log for the empty name
+func (l *DistributedLog) Log(name string) (*NamedLog, error) {
+	if !l.fsm.has(name) {
+		return nil, api.ErrLogNotFound{Name: name}
+	}
+	return &NamedLog{dlog: l, name: name}, nil
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"io/ioutil"
+	"testing"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamedLogs(t *testing.T) {
+	f := newTestFSM(t)
+
+	append := func(f *fsm, name, value string) interface{} {
+		return apply(t, f, AppendRequestType, &api.AppendRequest{
+			Log:    name,
+			Record: &api.Record{Value: []byte(value)},
+		})
+	}
+	read := func(f *fsm, name string, offset uint64) string {
+		record, err := f.read(name, offset, false)
+		require.NoError(t, err)
+		return string(record.Value)
+	}
+
+	res := apply(t, f, CreateLogRequestType, &api.CreateLogRequest{
+		Name:   "orders",
+		Config: &api.LogConfig{MaxStoreBytes: 1024},
+	})
+	require.Equal(t, &api.CreateLogResponse{}, res)
+	res = apply(t, f, CreateLogRequestType, &api.CreateLogRequest{
+		Name: "orders",
+	})
+	require.Equal(t, api.ErrLogExists{Name: "orders"}, res)
+	res = apply(t, f, CreateLogRequestType, &api.CreateLogRequest{
+		Name: "../orders",
+	})
+	require.Equal(t, api.ErrInvalidLogName{Name: "../orders"}, res)
+	res = append(f, "payments", "paid")
+	require.Equal(t, api.ErrLogNotFound{Name: "payments"}, res)
+
+	// every log has its own offsets
+	append(f, "", "default")
+	res = append(f, "orders", "order placed")
+	require.Equal(t, uint64(0), res.(*api.AppendResponse).Offset)
+	require.Equal(t, "default", read(f, "", 0))
+	require.Equal(t, "order placed", read(f, "orders", 0))
+
+	// the logs are restored with the snapshot
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	restored := newTestFSM(t)
+	apply(t, restored, CreateLogRequestType, &api.CreateLogRequest{
+		Name: "stale",
+	})
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+	require.Equal(t, "default", read(restored, "", 0))
+	require.Equal(t, "order placed", read(restored, "orders", 0))
+	require.False(t, restored.has("stale"))
+	require.Equal(t, logConfig{MaxStoreBytes: 1024}, restored.logs["orders"].config)
+
+	// and kept on disk
+	require.NoError(t, f.close())
+	f, err = newFSM(f.dataDir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, "order placed", read(f, "orders", 0))
+	require.Equal(t, logConfig{MaxStoreBytes: 1024}, f.logs["orders"].config)
+
+	res = apply(t, f, DeleteLogRequestType, &api.DeleteLogRequest{Name: "orders"})
+	require.Equal(t, &api.DeleteLogResponse{}, res)
+	_, err = f.read("orders", 0, false)
+	require.Equal(t, api.ErrLogNotFound{Name: "orders"}, err)
+	res = apply(t, f, DeleteLogRequestType, &api.DeleteLogRequest{Name: ""})
+	require.Equal(t, api.ErrInvalidLogName{Name: ""}, res)
+	require.NoError(t, f.close())
+}
+
+func TestRetireLogsDuringSnapshot(t *testing.T) {
+	f := newTestFSM(t)
+	apply(t, f, CreateLogRequestType, &api.CreateLogRequest{Name: "orders"})
+	apply(t, f, AppendRequestType, &api.AppendRequest{
+		Log:    "orders",
+		Record: &api.Record{Value: []byte("order placed")},
+	})
+	apply(t, f, AppendRequestType, &api.AppendRequest{
+		Record: &api.Record{Value: []byte("default")},
+	})
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+
+	// deleting a log and resetting the default log don't wait for the
+	// snapshot reading them
+	res := apply(t, f, DeleteLogRequestType, &api.DeleteLogRequest{
+		Name: "orders",
+	})
+	require.Equal(t, &api.DeleteLogResponse{}, res)
+	apply(t, f, CreateLogRequestType, &api.CreateLogRequest{Name: "orders"})
+	_, err = f.restoreLog(logHeader{Offset: 10})
+	require.NoError(t, err)
+	res = apply(t, f, AppendRequestType, &api.AppendRequest{
+		Record: &api.Record{Value: []byte("reset")},
+	})
+	require.Equal(t, uint64(10), res.(*api.AppendResponse).Offset)
+
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	retired, err := ioutil.ReadDir(f.retiredDir())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(retired))
+	// and they're removed once it's released
+	snapshot.Release()
+	retired, err = ioutil.ReadDir(f.retiredDir())
+	require.NoError(t, err)
+	require.Equal(t, 0, len(retired))
+
+	restored := newTestFSM(t)
+	require.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	record, err := restored.read("orders", 0, false)
+	require.NoError(t, err)
+	require.Equal(t, "order placed", string(record.Value))
+	record, err = restored.read("", 0, false)
+	require.NoError(t, err)
+	require.Equal(t, "default", string(record.Value))
+	require.NoError(t, f.close())
+}
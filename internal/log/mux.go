@@ -0,0 +1,184 @@
+package log
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Starts the connections of the Raft groups a StreamMux multiplexes, the
+// group's name follows
+const RaftGroupRPC = 2
+
+// StreamMux multiplexes the connections of several Raft groups, like the
+// partitions of topics, over one listener. Dialers name the group after
+// the RaftGroupRPC byte, and the mux hands the connection to the group's
+// stream layer, which goes on with TLS and the handshake.
+type StreamMux struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+	logger          *zap.Logger
+	// Reported by the groups' stream layers instead of the listener's
+	// address
+	advertise net.Addr
+
+	mu     sync.Mutex
+	groups map[string]*groupListener
+}
+
+func NewStreamMux(
+	ln net.Listener,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
+) *StreamMux {
+	m := &StreamMux{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+		logger:          zap.L().Named("stream-mux"),
+		groups:          make(map[string]*groupListener),
+	}
+	go m.serve()
+	return m
+}
+
+// Advertise makes the groups' stream layers report the address the other
+// servers dial, like StreamLayer.Advertise. Set it before the log starts.
+func (m *StreamMux) Advertise(addr net.Addr) {
+	m.advertise = addr
+}
+
+// StreamLayer returns the group's stream layer. Connections for groups
+// without one are closed, their servers dial again later.
+func (m *StreamMux) StreamLayer(group string) *StreamLayer {
+	ln := &groupListener{
+		mux:    m,
+		group:  group,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.groups[group] = ln
+	m.mu.Unlock()
+	s := NewStreamLayer(ln, m.serverTLSConfig, m.peerTLSConfig)
+	s.group = group
+	return s
+}
+
+func (m *StreamMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.route(conn)
+	}
+}
+
+// Reads which group the connection is for and hands it to the group's
+// stream layer
+func (m *StreamMux) route(conn net.Conn) {
+	group, err := readGroup(conn)
+	if err != nil {
+		m.logger.Warn(
+			"refused raft connection",
+			zap.Error(err),
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+		)
+		conn.Close()
+		return
+	}
+	m.mu.Lock()
+	ln, ok := m.groups[group]
+	m.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	select {
+	case ln.conns <- conn:
+	case <-ln.closed:
+		conn.Close()
+	}
+}
+
+func readGroup(conn net.Conn) (string, error) {
+	if err := conn.SetDeadline(
+		time.Now().Add(handshakeTimeout),
+	); err != nil {
+		return "", err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	if b[0] != RaftGroupRPC {
+		return "", fmt.Errorf("not a raft group rpc")
+	}
+	group := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, group); err != nil {
+		return "", err
+	}
+	return string(group), conn.SetDeadline(time.Time{})
+}
+
+// The header of connections to the group
+func groupHeader(group string) []byte {
+	if group == "" {
+		return []byte{byte(RaftRPC)}
+	}
+	return append([]byte{RaftGroupRPC, byte(len(group))}, group...)
+}
+
+// Closing the listener of a cmux closes the one it shares with the
+// log's stream layer, whichever goes second finds it closed
+func (m *StreamMux) Close() error {
+	if err := m.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Hands out the connections the mux routes to a group
+type groupListener struct {
+	mux    *StreamMux
+	group  string
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *groupListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("raft group closed: %s", l.group)
+	}
+}
+
+func (l *groupListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.mux.mu.Lock()
+		defer l.mux.mu.Unlock()
+		if l.mux.groups[l.group] == l {
+			delete(l.mux.groups, l.group)
+		}
+	})
+	return nil
+}
+
+func (l *groupListener) Addr() net.Addr {
+	if l.mux.advertise != nil {
+		return l.mux.advertise
+	}
+	return l.mux.ln.Addr()
+}
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+)
+
+const (
+	// Appends remembered per producer, retries of older ones are refused
+	producerWindow = 5
+	// Producers remembered, the one that appended longest ago is
+	// forgotten first
+	maxProducers = 10000
+)
+
+// producers keeps track of the latest appends of every producer, so an
+// append retried after its response got lost isn't appended twice. It
+// only changes as the fsm applies appends, so every server agrees on it,
+// and it's saved in the snapshots.
+type producers struct {
+	byID map[string]*producer
+	// The producers' IDs, the one that appended longest ago first
+	order *list.List
+}
+
+type producer struct {
+	// Oldest first
+	Appends []producerAppend `json:"appends"`
+	elem    *list.Element
+}
+
+type producerAppend struct {
+	// Of the first record, the others' follow on
+	Sequence uint64   `json:"sequence"`
+	Offsets  []uint64 `json:"offsets"`
+}
+
+func newProducers() *producers {
+	return &producers{byID: make(map[string]*producer), order: list.New()}
+}
+
+// Returns the offsets the records got when they were appended before,
+// nil if they haven't been. Producers start at sequence number zero, an
+// unknown producer past it may have been forgotten along with its
+// appends.
+func (p *producers) check(id string, sequence uint64, n int) ([]uint64, error) {
+	prod, ok := p.byID[id]
+	if !ok {
+		if sequence != 0 {
+			return nil, api.ErrUnknownProducer{
+				ProducerID: id,
+				Sequence:   sequence,
+			}
+		}
+		return nil, nil
+	}
+	last := prod.Appends[len(prod.Appends)-1]
+	next := last.Sequence + uint64(len(last.Offsets))
+	if sequence == next {
+		return nil, nil
+	}
+	if sequence < next {
+		for _, a := range prod.Appends {
+			if a.Sequence == sequence && len(a.Offsets) == n {
+				return a.Offsets, nil
+			}
+		}
+	}
+	return nil, api.ErrOutOfOrderSequence{
+		ProducerID: id,
+		Sequence:   sequence,
+		Expected:   next,
+	}
+}
+
+func (p *producers) record(id string, sequence uint64, offsets []uint64) {
+	prod, ok := p.byID[id]
+	if !ok {
+		if len(p.byID) >= maxProducers {
+			p.forgetOldest()
+		}
+		prod = &producer{elem: p.order.PushBack(id)}
+		p.byID[id] = prod
+	} else {
+		p.order.MoveToBack(prod.elem)
+	}
+	prod.Appends = append(prod.Appends, producerAppend{
+		Sequence: sequence,
+		Offsets:  offsets,
+	})
+	if len(prod.Appends) > producerWindow {
+		prod.Appends = prod.Appends[1:]
+	}
+}
+
+func (p *producers) forgetOldest() {
+	if oldest := p.order.Front(); oldest != nil {
+		delete(p.byID, p.order.Remove(oldest).(string))
+	}
+}
+
+func (p *producers) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.byID)
+}
+
+func (p *producers) UnmarshalJSON(b []byte) error {
+	byID := make(map[string]*producer)
+	if err := json.Unmarshal(b, &byID); err != nil {
+		return err
+	}
+	// the producers are ordered by their latest appends' offsets again,
+	// which grow with every append
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return byID[ids[i]].lastOffset() < byID[ids[j]].lastOffset()
+	})
+	p.byID, p.order = byID, list.New()
+	for _, id := range ids {
+		byID[id].elem = p.order.PushBack(id)
+	}
+	return nil
+}
+
+func (p *producer) lastOffset() uint64 {
+	offsets := p.Appends[len(p.Appends)-1].Offsets
+	return offsets[len(offsets)-1]
+}
@@ -0,0 +1,198 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProducers(t *testing.T) {
+	f := newTestFSM(t)
+
+	append := func(f *fsm, sequence uint64, value string) interface{} {
+		return apply(t, f, AppendRequestType, &api.AppendRequest{
+			Record:     &api.Record{Value: []byte(value)},
+			ProducerId: "billing",
+			Sequence:   sequence,
+		})
+	}
+
+	// unknown producers start at sequence zero
+	res := append(f, 7, "first")
+	require.Equal(t, api.ErrUnknownProducer{
+		ProducerID: "billing",
+		Sequence:   7,
+	}, res)
+	res = append(f, 0, "first")
+	require.Equal(t, uint64(0), res.(*api.AppendResponse).Offset)
+	res = apply(t, f, AppendBatchRequestType, &api.AppendBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("second")},
+			{Value: []byte("third")},
+		},
+		ProducerId: "billing",
+		Sequence:   1,
+	})
+	require.Equal(t, []uint64{1, 2}, res.(*api.AppendBatchResponse).Offsets)
+
+	// retries get the original offsets
+	res = append(f, 0, "first")
+	require.Equal(t, uint64(0), res.(*api.AppendResponse).Offset)
+	_, err := f.read("", 3, false)
+	require.Error(t, err)
+
+	// sequences can't skip ahead
+	res = append(f, 4, "fourth")
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: "billing",
+		Sequence:   4,
+		Expected:   3,
+	}, res)
+
+	// records without a producer aren't deduplicated
+	res = apply(t, f, AppendRequestType, &api.AppendRequest{
+		Record: &api.Record{Value: []byte("fourth")},
+	})
+	require.Equal(t, uint64(3), res.(*api.AppendResponse).Offset)
+
+	// the producers are restored with the snapshot
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	restored := newTestFSM(t)
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+	res = append(restored, 0, "first")
+	require.Equal(t, uint64(0), res.(*api.AppendResponse).Offset)
+	res = append(restored, 3, "fifth")
+	require.Equal(t, uint64(4), res.(*api.AppendResponse).Offset)
+	record, err := restored.read("", 3, false)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fourth"), record.Value)
+}
+
+func TestSnapshotRecords(t *testing.T) {
+	f := newTestFSM(t)
+
+	// records keep whatever type clients give them
+	types := []uint32{0, math.MaxUint32}
+	for _, recordType := range types {
+		apply(t, f, AppendRequestType, &api.AppendRequest{
+			Record: &api.Record{Value: []byte("record"), Type: recordType},
+		})
+	}
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+	// records appended after the snapshot was taken aren't in it
+	apply(t, f, AppendRequestType, &api.AppendRequest{
+		Record: &api.Record{Value: []byte("later")},
+	})
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	restored := newTestFSM(t)
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+	for offset, recordType := range types {
+		record, err := restored.read("", uint64(offset), false)
+		require.NoError(t, err)
+		require.Equal(t, "record", string(record.Value))
+		require.Equal(t, recordType, record.Type)
+	}
+	_, err = restored.read("", uint64(len(types)), false)
+	require.Error(t, err)
+
+	// snapshots from before the sections are the default log's records
+	var legacy bytes.Buffer
+	for offset := uint64(5); offset < 7; offset++ {
+		b, err := proto.Marshal(&api.Record{
+			Value:  []byte("old"),
+			Offset: offset,
+		})
+		require.NoError(t, err)
+		size := make([]byte, lenWidth)
+		enc.PutUint64(size, uint64(len(b)))
+		legacy.Write(append(size, b...))
+	}
+	restored = newTestFSM(t)
+	err = restored.Restore(ioutil.NopCloser(&legacy))
+	require.NoError(t, err)
+	record, err := restored.read("", 6, false)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(record.Value))
+}
+
+func TestProducersForgetOldest(t *testing.T) {
+	p := newProducers()
+	p.record("first", 0, []uint64{0})
+	p.record("second", 0, []uint64{1})
+	p.forgetOldest()
+
+	offsets, err := p.check("second", 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, offsets)
+
+	// forgotten producers start over, their retries are refused
+	offsets, err = p.check("first", 0, 1)
+	require.NoError(t, err)
+	require.Nil(t, offsets)
+	_, err = p.check("first", 1, 1)
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: "first", Sequence: 1}, err)
+
+	// the producer that appended longest ago goes first, also after
+	// they're restored
+	p.record("third", 0, []uint64{2})
+	p.record("second", 1, []uint64{3})
+	b, err := json.Marshal(p)
+	require.NoError(t, err)
+	restored := newProducers()
+	require.NoError(t, json.Unmarshal(b, restored))
+	for _, p := range []*producers{p, restored} {
+		p.forgetOldest()
+		require.Equal(t, 1, len(p.byID))
+		require.NotNil(t, p.byID["second"])
+	}
+}
+
+func newTestFSM(t *testing.T) *fsm {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fsm-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	f, err := newFSM(dir, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { f.close() })
+	return f
+}
+
+func apply(
+	t *testing.T,
+	f *fsm,
+	reqType RequestType,
+	req proto.Message,
+) interface{} {
+	t.Helper()
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return f.Apply(&raft.Log{Data: append([]byte{byte(reqType)}, b...)})
+}
+
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
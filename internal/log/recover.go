@@ -0,0 +1,154 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+// RecoveryState is the Raft state found on disk of a stopped server.
+type RecoveryState struct {
+	Configuration raft.Configuration
+	LastIndex     uint64
+	LastTerm      uint64
+}
+
+// ReadRecoveryState reads the latest Raft configuration and last log
+// index of the stopped server owning dataDir, without starting Raft.
+func ReadRecoveryState(dataDir string, config Config) (*RecoveryState, error) {
+	if _, err := os.Stat(filepath.Join(dataDir, "raft")); err != nil {
+		return nil, err
+	}
+	stores, err := openStoppedStores(dataDir, config)
+	if err != nil {
+		return nil, err
+	}
+	defer stores.Close()
+
+	state := &RecoveryState{}
+
+	// The latest snapshot holds the configuration up to its index, log
+	// entries past it may have changed it since
+	snapshots, err := stores.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	var snapshotIndex uint64
+	if len(snapshots) > 0 {
+		state.Configuration = snapshots[0].Configuration
+		state.LastIndex = snapshots[0].Index
+		state.LastTerm = snapshots[0].Term
+		snapshotIndex = snapshots[0].Index
+	}
+
+	first, err := stores.log.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := stores.log.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if first <= snapshotIndex {
+		first = snapshotIndex + 1
+	}
+	for index := first; index <= last; index++ {
+		var entry raft.Log
+		if err := stores.log.GetLog(index, &entry); err != nil {
+			return nil, err
+		}
+		if entry.Type == raft.LogConfiguration {
+			state.Configuration, err = decodeConfiguration(entry.Data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		state.LastIndex = entry.Index
+		state.LastTerm = entry.Term
+	}
+	return state, nil
+}
+
+// Recover rewrites the Raft configuration of the stopped server owning
+// dataDir to the given one, for when a majority of the cluster is lost
+// for good. Every surviving server has to be recovered with the same
+// configuration before any of them is started again.
+func Recover(
+	dataDir string,
+	config Config,
+	configuration raft.Configuration,
+) error {
+	// the stores are opened first, so a running server's logs are left
+	// alone
+	stores, err := openStoppedStores(dataDir, config)
+	if err != nil {
+		return err
+	}
+	defer stores.Close()
+
+	// Raft replays every command past the latest snapshot into the fsm,
+	// so the logs are emptied first instead of getting them twice
+	l, err := NewLog(filepath.Join(dataDir, "log"), config)
+	if err != nil {
+		return err
+	}
+	l.Config.Segment.InitialOffset = 0
+	if err := l.Reset(); err != nil {
+		return err
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dataDir, "logs")); err != nil {
+		return err
+	}
+	config.Segment.InitialOffset = 0
+	fsm, err := newFSM(dataDir, config)
+	if err != nil {
+		return err
+	}
+	defer fsm.close()
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = config.Raft.LocalID
+	_, transport := raft.NewInmemTransport("")
+
+	return raft.RecoverCluster(
+		raftConfig,
+		fsm,
+		stores.log,
+		stores.stable,
+		stores.snapshots,
+		transport,
+		configuration,
+	)
+}
+
+// Opens the Raft stores of a stopped server, failing rather than waiting
+// on a running one's
+func openStoppedStores(dataDir string, config Config) (*raftStores, error) {
+	stores, err := newRaftStores(dataDir, config)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("the server owning %s is still running", dataDir)
+	}
+	return stores, err
+}
+
+// Configuration entries are msgpack encoded by raft
+func decodeConfiguration(b []byte) (raft.Configuration, error) {
+	var configuration raft.Configuration
+	dec := codec.NewDecoder(bytes.NewReader(b), &codec.MsgpackHandle{})
+	if err := dec.Decode(&configuration); err != nil {
+		return configuration, fmt.Errorf(
+			"failed to decode configuration: %v",
+			err,
+		)
+	}
+	return configuration, nil
+}
@@ -0,0 +1,653 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Names of the topics, their partitions' Raft groups are named after
+// them in the stream mux's one byte long header
+var topicNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,199}$`)
+
+// partitions runs this server's replicas of the topics' partitions, each
+// a DistributedLog with its own Raft group multiplexed over the stream
+// mux. They're opened and removed apart from the fsm, which only pokes
+// them when it applies the topics' creation and deletion, so bootstrapping
+// or shutting down Raft groups never holds up the cluster's log.
+type partitions struct {
+	dataDir string
+	// The partitions' config, made from the cluster's
+	config   Config
+	mux      *StreamMux
+	interval time.Duration
+	logger   *zap.Logger
+	// The fsm's topics, the partitions are opened and removed to match
+	topics func() []*api.Topic
+
+	mu   sync.RWMutex
+	logs map[string][]*DistributedLog
+	// The topics the open partitions are of, a topic created again after
+	// it was deleted gets partitions of its own
+	opened map[string]*api.Topic
+	// The cluster's Raft group, the partitions' servers follow its
+	cluster *DistributedLog
+	// Poked when a partition's leader changes
+	watch *serverWatch
+	// Terms in which moving a partition's leadership failed, it isn't
+	// tried again until the partition elects a new leader
+	failed map[string]string
+
+	observations chan raft.Observation
+	changed      chan struct{}
+	shutdown     chan struct{}
+	stopOnce     sync.Once
+	stopped      chan struct{}
+}
+
+func newPartitions(
+	dataDir string,
+	config Config,
+	topics func() []*api.Topic,
+) *partitions {
+	c := Config{}
+	c.Raft.Config = config.Raft.Config
+	c.Raft.ClusterID = config.Raft.ClusterID
+	c.Transactions = config.Transactions
+	c.Segment.MaxStoreBytes = config.Segment.MaxStoreBytes
+	c.Segment.MaxIndexBytes = config.Segment.MaxIndexBytes
+	interval := config.Topics.BalanceInterval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	p := &partitions{
+		dataDir:      dataDir,
+		config:       c,
+		mux:          config.Topics.Mux,
+		interval:     interval,
+		logger:       zap.L().Named("partitions"),
+		topics:       topics,
+		logs:         make(map[string][]*DistributedLog),
+		opened:       make(map[string]*api.Topic),
+		failed:       make(map[string]string),
+		observations: make(chan raft.Observation, 16),
+		changed:      make(chan struct{}, 1),
+		shutdown:     make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func partitionName(topic string, id int) string {
+	return fmt.Sprintf("%s/%d", topic, id)
+}
+
+// Opens the topic's partitions, bootstrapping their Raft groups if this
+// server is one of the topic's servers
+func (p *partitions) open(topic *api.Topic) ([]*DistributedLog, error) {
+	var servers []raft.Server
+	bootstrap := false
+	for _, peer := range topic.Servers {
+		suffrage := raft.Voter
+		if peer.Suffrage == raft.Nonvoter.String() {
+			suffrage = raft.Nonvoter
+		}
+		servers = append(servers, raft.Server{
+			ID:       raft.ServerID(peer.Id),
+			Address:  raft.ServerAddress(peer.Address),
+			Suffrage: suffrage,
+		})
+		if raft.ServerID(peer.Id) == p.config.Raft.LocalID {
+			bootstrap = true
+		}
+	}
+
+	logs := make([]*DistributedLog, 0, topic.Partitions)
+	for i := 0; i < int(topic.Partitions); i++ {
+		config := p.config
+		config.Raft.StreamLayer = p.mux.StreamLayer(
+			partitionName(topic.Name, i),
+		)
+		dir := filepath.Join(p.dataDir, "topics", topic.Name, strconv.Itoa(i))
+		l, err := NewDistributedLog(dir, config)
+		if err == nil && bootstrap {
+			err = l.Bootstrap(servers)
+		}
+		if err != nil {
+			for _, l := range logs {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		l.raft.RegisterObserver(raft.NewObserver(
+			p.observations,
+			false,
+			func(o *raft.Observation) bool {
+				_, ok := o.Data.(raft.LeaderObservation)
+				return ok
+			},
+		))
+		logs = append(logs, l)
+	}
+	return logs, nil
+}
+
+// Closes the topic's partitions and deletes their records
+func (p *partitions) remove(name string, logs []*DistributedLog) error {
+	for _, l := range logs {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(p.dataDir, "topics", name))
+}
+
+// Pokes the partitions to match the fsm's topics
+func (p *partitions) poke() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Opens the partitions of the fsm's topics and removes the others. The
+// topics that fail are tried again the next time.
+func (p *partitions) sync() {
+	topics := make(map[string]*api.Topic)
+	for _, topic := range p.topics() {
+		topics[topic.Name] = topic
+	}
+
+	p.mu.Lock()
+	removed := make(map[string][]*DistributedLog)
+	for name, topic := range p.opened {
+		if topics[name] != topic {
+			removed[name] = p.logs[name]
+			delete(p.logs, name)
+			delete(p.opened, name)
+		}
+	}
+	var added []*api.Topic
+	for name, topic := range topics {
+		if _, ok := p.opened[name]; !ok {
+			added = append(added, topic)
+		}
+	}
+	p.mu.Unlock()
+
+	for name, logs := range removed {
+		if err := p.remove(name, logs); err != nil {
+			p.logger.Error(
+				"failed to remove topic's partitions",
+				zap.Error(err),
+				zap.String("topic", name),
+			)
+		}
+	}
+	for _, topic := range added {
+		logs, err := p.open(topic)
+		if err != nil {
+			p.logger.Error(
+				"failed to open topic's partitions",
+				zap.Error(err),
+				zap.String("topic", topic.Name),
+			)
+			continue
+		}
+		p.mu.Lock()
+		p.logs[topic.Name] = logs
+		p.opened[topic.Name] = topic
+		p.mu.Unlock()
+	}
+}
+
+// Waits for this server's partitions of the topic to open
+func (p *partitions) waitOpen(name string, timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		p.mu.RLock()
+		_, ok := p.logs[name]
+		p.mu.RUnlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out opening partitions of %s", name)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *partitions) get(topic string, id uint32) (*DistributedLog, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	logs, ok := p.logs[topic]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Name: topic}
+	}
+	if int(id) >= len(logs) {
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: id}
+	}
+	return logs[id], nil
+}
+
+// Calls fn with every partition. The lock isn't held meanwhile, fn may
+// wait on Raft, so the partitions may get closed under it.
+func (p *partitions) each(fn func(topic string, id int, l *DistributedLog)) {
+	type partition struct {
+		topic string
+		id    int
+		l     *DistributedLog
+	}
+	p.mu.RLock()
+	names := make([]string, 0, len(p.logs))
+	for name := range p.logs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var all []partition
+	for _, name := range names {
+		for i, l := range p.logs[name] {
+			all = append(all, partition{name, i, l})
+		}
+	}
+	p.mu.RUnlock()
+	for _, partition := range all {
+		fn(partition.topic, partition.id, partition.l)
+	}
+}
+
+// Adds the server to the partitions this server leads, the leaders of
+// the others add it on their servers
+func (p *partitions) join(id, addr string) {
+	p.each(func(topic string, i int, l *DistributedLog) {
+		if l.IsLeader() {
+			p.joinPartition(topic, i, l, id, addr)
+		}
+	})
+}
+
+func (p *partitions) leave(id string) {
+	p.each(func(topic string, i int, l *DistributedLog) {
+		if l.IsLeader() {
+			p.leavePartition(topic, i, l, id)
+		}
+	})
+}
+
+func (p *partitions) joinPartition(
+	topic string,
+	i int,
+	l *DistributedLog,
+	id, addr string,
+) {
+	if err := l.Join(id, addr); err != nil {
+		p.logger.Error(
+			"failed to join partition",
+			zap.Error(err),
+			zap.String("partition", partitionName(topic, i)),
+			zap.String("id", id),
+		)
+	}
+}
+
+func (p *partitions) leavePartition(
+	topic string,
+	i int,
+	l *DistributedLog,
+	id string,
+) {
+	if err := l.Leave(id); err != nil {
+		p.logger.Error(
+			"failed to leave partition",
+			zap.Error(err),
+			zap.String("partition", partitionName(topic, i)),
+			zap.String("id", id),
+		)
+	}
+}
+
+// Describes the partitions with the servers leading them
+func (p *partitions) describe() []*api.Partition {
+	var described []*api.Partition
+	p.each(func(topic string, i int, l *DistributedLog) {
+		described = append(described, &api.Partition{
+			Topic:    topic,
+			Id:       uint32(i),
+			LeaderId: l.leaderID(),
+		})
+	})
+	return described
+}
+
+// Keeps the partitions' servers in step with the cluster's, and pokes
+// its watchers when a partition's leader changes
+func (p *partitions) setCluster(l *DistributedLog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cluster = l
+	p.watch = l.watch
+}
+
+// Opens and removes partitions whenever the topics change. Balances the
+// partitions' leaders whenever one changes, and every interval it also
+// catches up on the topics and servers it missed.
+func (p *partitions) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		case <-p.changed:
+			p.sync()
+			continue
+		case <-p.observations:
+			for len(p.observations) > 0 {
+				<-p.observations
+			}
+			p.mu.RLock()
+			if p.watch != nil {
+				p.watch.poke()
+			}
+			p.mu.RUnlock()
+		case <-ticker.C:
+			p.sync()
+			p.syncServers()
+		}
+		p.balance()
+	}
+}
+
+// Adds the cluster's servers missing from the partitions this server
+// leads and removes those the cluster doesn't have anymore, so servers
+// that joined or left while a partition had no leader are caught up on
+func (p *partitions) syncServers() {
+	p.mu.RLock()
+	cluster := p.cluster
+	p.mu.RUnlock()
+	if cluster == nil {
+		return
+	}
+	future := cluster.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return
+	}
+	servers := future.Configuration().Servers
+	p.each(func(topic string, i int, l *DistributedLog) {
+		if !l.IsLeader() {
+			return
+		}
+		future := l.raft.GetConfiguration()
+		if future.Error() != nil {
+			return
+		}
+		current := make(map[raft.ServerID]raft.ServerAddress)
+		for _, srv := range future.Configuration().Servers {
+			current[srv.ID] = srv.Address
+		}
+		for _, srv := range servers {
+			if addr, ok := current[srv.ID]; ok && addr == srv.Address {
+				delete(current, srv.ID)
+				continue
+			}
+			delete(current, srv.ID)
+			p.joinPartition(topic, i, l, string(srv.ID), string(srv.Address))
+		}
+		for id := range current {
+			p.leavePartition(topic, i, l, string(id))
+		}
+	})
+}
+
+// Hands the leadership of the partitions this server leads to the voter
+// they prefer. The voters take turns by partition, starting at a
+// different one for every topic, so the leaders spread across them.
+func (p *partitions) balance() {
+	type transfer struct {
+		name string
+		l    *DistributedLog
+		id   raft.ServerID
+		term string
+	}
+	var transfers []transfer
+	p.each(func(topic string, i int, l *DistributedLog) {
+		if !l.IsLeader() {
+			return
+		}
+		name := partitionName(topic, i)
+		term := l.raft.Stats()["term"]
+		if p.failed[name] == term {
+			return
+		}
+		future := l.raft.GetConfiguration()
+		if future.Error() != nil {
+			return
+		}
+		var voters []raft.ServerID
+		for _, srv := range future.Configuration().Servers {
+			if srv.Suffrage == raft.Voter {
+				voters = append(voters, srv.ID)
+			}
+		}
+		if len(voters) == 0 {
+			return
+		}
+		sort.Slice(voters, func(i, j int) bool {
+			return voters[i] < voters[j]
+		})
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(topic))
+		preferred := voters[(int(h.Sum32()%uint32(len(voters)))+i)%len(voters)]
+		if preferred != p.config.Raft.LocalID {
+			transfers = append(transfers, transfer{name, l, preferred, term})
+		}
+	})
+	// transfers take up to an election timeout, the lock isn't held
+	// meanwhile
+	for _, t := range transfers {
+		if err := t.l.TransferLeadership(string(t.id)); err != nil {
+			p.logger.Warn(
+				"failed to move partition's leadership",
+				zap.Error(err),
+				zap.String("partition", t.name),
+				zap.String("id", string(t.id)),
+			)
+			p.failed[t.name] = t.term
+		}
+	}
+}
+
+func (p *partitions) close() error {
+	p.stopOnce.Do(func() { close(p.shutdown) })
+	<-p.stopped
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, logs := range p.logs {
+		for _, l := range logs {
+			if err := l.Close(); err != nil {
+				return err
+			}
+		}
+		delete(p.logs, name)
+		delete(p.opened, name)
+	}
+	return p.mux.Close()
+}
+
+func (f *fsm) applyCreateTopic(b []byte) interface{} {
+	topic := &api.Topic{}
+	if err := proto.Unmarshal(b, topic); err != nil {
+		return err
+	}
+	if err := validateTopic(topic.Name, topic.Partitions); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if _, ok := f.topics[topic.Name]; ok {
+		f.mu.Unlock()
+		return api.ErrTopicExists{Name: topic.Name}
+	}
+	f.topics[topic.Name] = topic
+	f.mu.Unlock()
+	if f.partitions != nil {
+		f.partitions.poke()
+	}
+	return &api.CreateTopicResponse{}
+}
+
+func (f *fsm) applyDeleteTopic(b []byte) interface{} {
+	var req api.DeleteTopicRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if _, ok := f.topics[req.Name]; !ok {
+		f.mu.Unlock()
+		return api.ErrTopicNotFound{Name: req.Name}
+	}
+	delete(f.topics, req.Name)
+	f.forgetOffsets(func(offset *api.GroupOffset) bool {
+		return offset.Topic == req.Name
+	})
+	f.mu.Unlock()
+	if f.partitions != nil {
+		f.partitions.poke()
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+// Takes the topics from the snapshot, the partitions are opened and
+// removed to match. The topics the fsm already has keep their partitions.
+func (f *fsm) restoreTopics(topics []*api.Topic) error {
+	f.mu.Lock()
+	byName := make(map[string]*api.Topic, len(topics))
+	for _, topic := range topics {
+		if current, ok := f.topics[topic.Name]; ok && proto.Equal(current, topic) {
+			topic = current
+		}
+		byName[topic.Name] = topic
+	}
+	f.topics = byName
+	f.mu.Unlock()
+	if f.partitions != nil {
+		f.partitions.poke()
+	}
+	return nil
+}
+
+func (f *fsm) sortedTopics() []*api.Topic {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	topics := make([]*api.Topic, 0, len(f.topics))
+	for _, topic := range f.topics {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+func validateTopic(name string, partitions uint32) error {
+	if !topicNameRegexp.MatchString(name) {
+		return api.ErrInvalidTopic{
+			Name:   name,
+			Reason: "use letters, digits, dots, dashes and underscores",
+		}
+	}
+	if partitions == 0 {
+		return api.ErrInvalidTopic{Name: name, Reason: "no partitions"}
+	}
+	return nil
+}
+
+var errNoPartitions = fmt.Errorf("server doesn't run topics' partitions")
+
+// CreateTopic creates the topic's partitions on every server. Each is
+// replicated by its own Raft group, bootstrapped with the cluster's
+// current servers.
+func (l *DistributedLog) CreateTopic(name string, partitions uint32) error {
+	if l.fsm.partitions == nil {
+		return errNoPartitions
+	}
+	if err := validateTopic(name, partitions); err != nil {
+		return err
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	topic := &api.Topic{Name: name, Partitions: partitions}
+	for _, srv := range future.Configuration().Servers {
+		topic.Servers = append(topic.Servers, &api.Peer{
+			Id:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+	if _, err := l.apply(CreateTopicRequestType, topic); err != nil {
+		return err
+	}
+	// the partitions open apart from the fsm, this server's are ready
+	// for the caller once it returns
+	return l.fsm.partitions.waitOpen(name, 10*time.Second)
+}
+
+// DeleteTopic deletes the topic's partitions and their records on every
+// server
+func (l *DistributedLog) DeleteTopic(name string) error {
+	_, err := l.apply(DeleteTopicRequestType, &api.DeleteTopicRequest{Name: name})
+	return err
+}
+
+func (l *DistributedLog) ListTopics() ([]*api.Topic, error) {
+	return l.fsm.sortedTopics(), nil
+}
+
+// Partition returns this server's replica of the topic's partition
+func (l *DistributedLog) Partition(topic string, id uint32) (*DistributedLog, error) {
+	if l.fsm.partitions == nil {
+		return nil, errNoPartitions
+	}
+	return l.fsm.partitions.get(topic, id)
+}
+
+// Partitions describes every topic's partitions with their leaders, as
+// far as this server knows
+func (l *DistributedLog) Partitions() []*api.Partition {
+	if l.fsm.partitions == nil {
+		return nil
+	}
+	return l.fsm.partitions.describe()
+}
+
+// Empty while there's no leader
+func (l *DistributedLog) leaderID() string {
+	future := l.raft.GetConfiguration()
+	if future.Error() != nil {
+		return ""
+	}
+	for _, srv := range future.Configuration().Servers {
+		if l.isLeader(srv) {
+			return string(srv.ID)
+		}
+	}
+	return ""
+}
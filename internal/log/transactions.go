@@ -0,0 +1,271 @@
+package log
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"go.uber.org/zap"
+)
+
+const (
+	// How long a transaction stays open before the leader aborts it
+	defaultTransactionTimeout = time.Minute
+	// Ended transactions remembered, the one that ended first is
+	// forgotten first
+	maxEndedTransactions = 10000
+)
+
+// transactions keeps track of the open transactions and the aborted ones,
+// so committed reads stop at the first open transaction and skip the
+// aborted transactions' records. The fsm changes it as it applies
+// transactions' markers, while reads go on concurrently.
+type transactions struct {
+	mu sync.RWMutex
+	// Offsets of the open transactions' begin markers
+	open map[string]uint64
+	// Offsets of the aborted transactions' markers, IDs can be used
+	// again once a transaction ended
+	aborted map[string][]abortedTransaction
+	// How the latest transactions ended, so an end retried after its
+	// response got lost gets the same answer
+	ended map[string]endedTransaction
+	// When this server applied the open transactions' begin markers, or
+	// restored them. It isn't in the snapshots, the servers only need it
+	// while they lead.
+	began map[string]time.Time
+}
+
+type endedTransaction struct {
+	// Of the commit or abort marker
+	Offset   uint64 `json:"offset"`
+	Abort    bool   `json:"abort"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+}
+
+type abortedTransaction struct {
+	Begin uint64 `json:"begin"`
+	Abort uint64 `json:"abort"`
+}
+
+func newTransactions() *transactions {
+	t := &transactions{}
+	t.reset()
+	return t
+}
+
+func (t *transactions) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open = make(map[string]uint64)
+	t.aborted = make(map[string][]abortedTransaction)
+	t.ended = make(map[string]endedTransaction)
+	t.began = make(map[string]time.Time)
+}
+
+func (t *transactions) empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.open) == 0 && len(t.aborted) == 0 && len(t.ended) == 0
+}
+
+func (t *transactions) isOpen(id string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.open[id]
+	return ok
+}
+
+// Records how the transaction ended, forgetting the one that ended first
+// if there are too many. The caller holds the lock.
+func (t *transactions) end(id string, ended endedTransaction) {
+	delete(t.open, id)
+	delete(t.began, id)
+	if _, ok := t.ended[id]; !ok && len(t.ended) >= maxEndedTransactions {
+		var oldest string
+		for id, e := range t.ended {
+			if oldest == "" || e.Offset < t.ended[oldest].Offset {
+				oldest = id
+			}
+		}
+		delete(t.ended, oldest)
+	}
+	t.ended[id] = ended
+}
+
+// Answers an end of a transaction that isn't open. Ending it the way it
+// ended again gets the offset of its marker, so retries succeed. The
+// caller holds the lock.
+func (t *transactions) endedAgain(req *api.EndTransactionRequest) interface{} {
+	e, ok := t.ended[req.TransactionId]
+	switch {
+	case !ok:
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "not open",
+		}
+	case e.Abort == req.Abort:
+		return &api.EndTransactionResponse{Offset: e.Offset}
+	case e.TimedOut:
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "timed out",
+		}
+	case e.Abort:
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "aborted",
+		}
+	default:
+		return api.ErrTransaction{
+			TransactionID: req.TransactionId,
+			Reason:        "committed",
+		}
+	}
+}
+
+// Forgets the ended transactions whose markers aren't in the log anymore,
+// the log starts at the lowest offset. The caller holds the lock.
+func (t *transactions) prune(lowest uint64) {
+	for id, aborted := range t.aborted {
+		var kept []abortedTransaction
+		for _, a := range aborted {
+			if a.Abort >= lowest {
+				kept = append(kept, a)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.aborted, id)
+		} else {
+			t.aborted[id] = kept
+		}
+	}
+	for id, e := range t.ended {
+		if e.Offset < lowest {
+			delete(t.ended, id)
+		}
+	}
+}
+
+// The IDs and begin offsets of the transactions that have been open for
+// longer than the timeout
+func (t *transactions) timedOut(timeout time.Duration) map[string]uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ids map[string]uint64
+	for id, began := range t.began {
+		if time.Since(began) <= timeout {
+			continue
+		}
+		if ids == nil {
+			ids = make(map[string]uint64)
+		}
+		ids[id] = t.open[id]
+	}
+	return ids
+}
+
+// The offset committed reads stop at, next is the offset the log's next
+// record gets. The caller holds the lock.
+func (t *transactions) stableOffset(next uint64) uint64 {
+	stable := next
+	for _, begin := range t.open {
+		if begin < stable {
+			stable = begin
+		}
+	}
+	return stable
+}
+
+// Whether committed reads get the record, which is before the stable
+// offset. The caller holds the lock.
+func (t *transactions) committed(record *api.Record) bool {
+	if record.Marker != api.Record_NONE {
+		return false
+	}
+	for _, a := range t.aborted[record.TransactionId] {
+		if a.Begin <= record.Offset && record.Offset <= a.Abort {
+			return false
+		}
+	}
+	return true
+}
+
+type transactionsJSON struct {
+	Open    map[string]uint64               `json:"open"`
+	Aborted map[string][]abortedTransaction `json:"aborted"`
+	Ended   map[string]endedTransaction     `json:"ended,omitempty"`
+}
+
+func (t *transactions) MarshalJSON() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return json.Marshal(transactionsJSON{
+		Open:    t.open,
+		Aborted: t.aborted,
+		Ended:   t.ended,
+	})
+}
+
+// The restored open transactions' timeouts start over
+func (t *transactions) UnmarshalJSON(b []byte) error {
+	v := transactionsJSON{
+		Open:    make(map[string]uint64),
+		Aborted: make(map[string][]abortedTransaction),
+		Ended:   make(map[string]endedTransaction),
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open, t.aborted, t.ended = v.Open, v.Aborted, v.Ended
+	t.began = make(map[string]time.Time, len(t.open))
+	now := time.Now()
+	for id := range t.open {
+		t.began[id] = now
+	}
+	return nil
+}
+
+// Aborts the transactions that stayed open for longer than the timeout
+// while this server leads. The aborts go through Raft like the clients'
+// ends, a client ending the transaction first wins.
+func (l *DistributedLog) expireTransactions() {
+	logger := zap.L().Named("transactions")
+	timeout := l.config.Transactions.Timeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.shutdown:
+			return
+		case <-ticker.C:
+		}
+		if !l.IsLeader() {
+			continue
+		}
+		for _, log := range l.fsm.sortedLogs() {
+			for id, begin := range log.transactions.timedOut(timeout) {
+				begin := begin
+				_, err := l.apply(
+					EndTransactionRequestType,
+					&api.EndTransactionRequest{
+						Log:           log.name,
+						TransactionId: id,
+						Abort:         true,
+						TimedOutBegin: &begin,
+					},
+				)
+				if _, ended := err.(api.ErrTransaction); err != nil && !ended {
+					logger.Error(
+						"failed to abort timed out transaction",
+						zap.Error(err),
+						zap.String("transaction_id", id),
+					)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package log
+
+import (
+	"io/ioutil"
+	"testing"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactions(t *testing.T) {
+	f := newTestFSM(t)
+
+	append := func(f *fsm, id, value string) interface{} {
+		return apply(t, f, AppendRequestType, &api.AppendRequest{
+			Record:        &api.Record{Value: []byte(value)},
+			TransactionId: id,
+		})
+	}
+	end := func(f *fsm, id string, abort bool) interface{} {
+		return apply(t, f, EndTransactionRequestType, &api.EndTransactionRequest{
+			TransactionId: id,
+			Abort:         abort,
+		})
+	}
+	readCommitted := func(f *fsm, offset uint64) string {
+		record, err := f.read("", offset, true)
+		if err != nil {
+			require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+			return ""
+		}
+		return string(record.Value)
+	}
+
+	append(f, "", "before")
+	res := apply(t, f, BeginTransactionRequestType, &api.BeginTransactionRequest{
+		TransactionId: "order",
+	})
+	require.Equal(t, uint64(1), res.(*api.BeginTransactionResponse).Offset)
+	append(f, "order", "order placed")
+	append(f, "", "after")
+
+	// the open transaction holds up committed reads
+	require.Equal(t, "before", readCommitted(f, 0))
+	require.Equal(t, "", readCommitted(f, 1))
+	record, err := f.read("", 3, false)
+	require.NoError(t, err)
+	require.Equal(t, "after", string(record.Value))
+
+	res = end(f, "order", false)
+	require.Equal(t, uint64(4), res.(*api.EndTransactionResponse).Offset)
+	// ends retried after their response got lost get the same answer
+	res = end(f, "order", false)
+	require.Equal(t, uint64(4), res.(*api.EndTransactionResponse).Offset)
+	res = end(f, "order", true)
+	require.Equal(t, api.ErrTransaction{
+		TransactionID: "order",
+		Reason:        "committed",
+	}, res)
+	require.Equal(t, "order placed", readCommitted(f, 1))
+	require.Equal(t, "after", readCommitted(f, 3))
+	require.Equal(t, "", readCommitted(f, 4))
+
+	// aborted transactions' records are skipped
+	apply(t, f, BeginTransactionRequestType, &api.BeginTransactionRequest{
+		TransactionId: "reservation",
+	})
+	append(f, "reservation", "stock reserved")
+	end(f, "reservation", true)
+	append(f, "", "last")
+	require.Equal(t, "last", readCommitted(f, 5))
+
+	// only open transactions take appends
+	res = append(f, "reservation", "too late")
+	require.Equal(t, api.ErrTransaction{
+		TransactionID: "reservation",
+		Reason:        "not open",
+	}, res)
+
+	// records can't pass themselves off as markers
+	apply(t, f, AppendRequestType, &api.AppendRequest{
+		Record: &api.Record{
+			Value:         []byte("forged"),
+			TransactionId: "order",
+			Marker:        api.Record_ABORT,
+		},
+	})
+	require.Equal(t, "forged", readCommitted(f, 9))
+
+	// transactions in one request are appended between markers
+	res = apply(t, f, AppendTransactionRequestType, &api.AppendTransactionRequest{
+		TransactionId: "batch",
+		Records:       []*api.Record{{Value: []byte("a")}, {Value: []byte("b")}},
+	})
+	require.Equal(t, []uint64{11, 12}, res.(*api.AppendTransactionResponse).Offsets)
+	require.Equal(t, "a", readCommitted(f, 10))
+
+	// the transactions are restored with the snapshot
+	apply(t, f, BeginTransactionRequestType, &api.BeginTransactionRequest{
+		TransactionId: "open",
+	})
+	snapshot, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	restored := newTestFSM(t)
+	err = restored.Restore(ioutil.NopCloser(&sink.Buffer))
+	require.NoError(t, err)
+	require.Equal(t, "last", readCommitted(restored, 5))
+	require.Equal(t, "", readCommitted(restored, 14))
+	res = end(restored, "open", false)
+	require.Equal(t, uint64(15), res.(*api.EndTransactionResponse).Offset)
+	res = end(restored, "order", false)
+	require.Equal(t, uint64(4), res.(*api.EndTransactionResponse).Offset)
+
+	// the leader's abort of a timed out transaction only aborts the
+	// transaction it saw begin
+	res = apply(t, restored, BeginTransactionRequestType, &api.BeginTransactionRequest{
+		TransactionId: "slow",
+	})
+	begin := res.(*api.BeginTransactionResponse).Offset
+	other := begin + 1
+	res = apply(t, restored, EndTransactionRequestType, &api.EndTransactionRequest{
+		TransactionId: "slow",
+		Abort:         true,
+		TimedOutBegin: &other,
+	})
+	require.IsType(t, api.ErrTransaction{}, res)
+	res = apply(t, restored, EndTransactionRequestType, &api.EndTransactionRequest{
+		TransactionId: "slow",
+		Abort:         true,
+		TimedOutBegin: &begin,
+	})
+	require.IsType(t, &api.EndTransactionResponse{}, res)
+	res = end(restored, "slow", false)
+	require.Equal(t, api.ErrTransaction{
+		TransactionID: "slow",
+		Reason:        "timed out",
+	}, res)
+}
+
+func TestTransactionsPrune(t *testing.T) {
+	tr := newTransactions()
+	tr.aborted["a"] = []abortedTransaction{
+		{Begin: 0, Abort: 2},
+		{Begin: 5, Abort: 8},
+	}
+	tr.aborted["b"] = []abortedTransaction{{Begin: 3, Abort: 4}}
+	tr.end("a", endedTransaction{Offset: 8, Abort: true})
+	tr.end("b", endedTransaction{Offset: 4, Abort: true})
+
+	// transactions whose markers fell off the log are forgotten
+	tr.prune(5)
+	require.Equal(t, map[string][]abortedTransaction{
+		"a": {{Begin: 5, Abort: 8}},
+	}, tr.aborted)
+	require.Equal(t, map[string]endedTransaction{
+		"a": {Offset: 8, Abort: true},
+	}, tr.ended)
+}
@@ -0,0 +1,170 @@
+package log
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"go.uber.org/zap"
+)
+
+// How often watchers are sent the servers when nothing changed, so they
+// keep up with the servers' progress
+const watchInterval = 5 * time.Second
+
+// serverWatch sends the servers to its watchers whenever Raft observes
+// the leader or the configuration changing. The servers are sent right
+// away with the stats last fetched, and again once the other servers
+// have been asked for fresh ones. Observations arriving while the
+// servers are being described are coalesced, watchers only care about
+// the latest servers.
+type serverWatch struct {
+	log    *DistributedLog
+	logger *zap.Logger
+
+	observations chan raft.Observation
+	observer     *raft.Observer
+	refresh      chan struct{}
+
+	mu       sync.Mutex
+	watchers map[chan []*api.Server]struct{}
+
+	shutdown chan struct{}
+	stopOnce sync.Once
+}
+
+func newServerWatch(l *DistributedLog) *serverWatch {
+	w := &serverWatch{
+		log:          l,
+		logger:       zap.L().Named("watch"),
+		observations: make(chan raft.Observation, 16),
+		refresh:      make(chan struct{}, 1),
+		watchers:     make(map[chan []*api.Server]struct{}),
+		shutdown:     make(chan struct{}),
+	}
+	w.observer = raft.NewObserver(
+		w.observations,
+		false,
+		func(o *raft.Observation) bool {
+			switch o.Data.(type) {
+			case raft.LeaderObservation,
+				raft.PeerObservation,
+				raft.RaftState:
+				return true
+			}
+			return false
+		},
+	)
+	l.raft.RegisterObserver(w.observer)
+	return w
+}
+
+func (w *serverWatch) run() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	// the other servers are asked for their stats apart from the loop, so
+	// a server that doesn't answer doesn't hold up the changes
+	fetched := make(chan struct{}, 1)
+	fetching := false
+	for {
+		fetch := true
+		select {
+		case <-w.shutdown:
+			return
+		case <-w.observations:
+		case <-w.refresh:
+		case <-ticker.C:
+		case <-fetched:
+			fetching, fetch = false, false
+		}
+		for len(w.observations) > 0 {
+			<-w.observations
+		}
+		if !w.watched() {
+			continue
+		}
+		servers, err := w.log.getServers(false)
+		if err != nil {
+			w.logger.Error("failed to get servers", zap.Error(err))
+			continue
+		}
+		w.send(servers)
+		if fetch && !fetching {
+			fetching = true
+			go w.fetch(fetched)
+		}
+	}
+}
+
+// Fetches the other servers' stats into the log's cache and lets the
+// loop know to send the servers with them
+func (w *serverWatch) fetch(fetched chan<- struct{}) {
+	if _, err := w.log.GetServers(); err != nil {
+		w.logger.Error("failed to get servers", zap.Error(err))
+	}
+	select {
+	case fetched <- struct{}{}:
+	case <-w.shutdown:
+	}
+}
+
+func (w *serverWatch) watched() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watchers) != 0
+}
+
+// Watchers that haven't received the previous servers yet get the latest
+// ones instead
+func (w *serverWatch) send(servers []*api.Server) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- servers
+	}
+}
+
+func (w *serverWatch) watch(ctx context.Context) <-chan []*api.Server {
+	ch := make(chan []*api.Server, 1)
+	w.mu.Lock()
+	w.watchers[ch] = struct{}{}
+	w.mu.Unlock()
+
+	// the new watcher starts with the current servers
+	w.poke()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.shutdown:
+		}
+		w.mu.Lock()
+		delete(w.watchers, ch)
+		close(ch)
+		w.mu.Unlock()
+	}()
+	return ch
+}
+
+// Sends the watchers the servers again without waiting for Raft to
+// observe a change
+func (w *serverWatch) poke() {
+	select {
+	case w.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Closing the log again must not panic
+func (w *serverWatch) stop() {
+	w.stopOnce.Do(func() {
+		close(w.shutdown)
+		w.log.raft.DeregisterObserver(w.observer)
+	})
+}
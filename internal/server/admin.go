@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+)
+
+type ClusterAdmin interface {
+	GetPeers() ([]*api.Peer, error)
+	AddVoter(id, addr string) error
+	AddNonvoter(id, addr string) error
+	RemoveServer(id string) error
+	TransferLeadership(id string) error
+	Snapshot() (*api.Snapshot, error)
+	Stats() map[string]string
+	Health() (*api.ClusterHealth, error)
+}
+
+// Manages the gossip encryption keys of every member
+type Keyring interface {
+	ListKeys() (*api.Keyring, error)
+	InstallKey(key string) (*api.Keyring, error)
+	UseKey(key string) (*api.Keyring, error)
+	RemoveKey(key string) (*api.Keyring, error)
+}
+
+type MemberLister interface {
+	ListMembers() []*api.Member
+}
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{
+		Config: config,
+	}
+}
+
+func (s *adminServer) ListPeers(
+	ctx context.Context, req *api.ListPeersRequest,
+) (*api.ListPeersResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	peers, err := s.ClusterAdmin.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListPeersResponse{
+		Peers: peers,
+		State: s.ClusterAdmin.Stats()["state"],
+	}, nil
+}
+
+func (s *adminServer) AddVoter(
+	ctx context.Context, req *api.AddVoterRequest,
+) (*api.AddVoterResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.ClusterAdmin.AddVoter(req.Id, req.Address); err != nil {
+		return nil, err
+	}
+	return &api.AddVoterResponse{}, nil
+}
+
+func (s *adminServer) AddNonvoter(
+	ctx context.Context, req *api.AddNonvoterRequest,
+) (*api.AddNonvoterResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.ClusterAdmin.AddNonvoter(req.Id, req.Address); err != nil {
+		return nil, err
+	}
+	return &api.AddNonvoterResponse{}, nil
+}
+
+func (s *adminServer) RemoveServer(
+	ctx context.Context, req *api.RemoveServerRequest,
+) (*api.RemoveServerResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.ClusterAdmin.RemoveServer(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+func (s *adminServer) TransferLeadership(
+	ctx context.Context, req *api.TransferLeadershipRequest,
+) (*api.TransferLeadershipResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.ClusterAdmin.TransferLeadership(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+func (s *adminServer) Snapshot(
+	ctx context.Context, req *api.SnapshotRequest,
+) (*api.SnapshotResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	snapshot, err := s.ClusterAdmin.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{Snapshot: snapshot}, nil
+}
+
+func (s *adminServer) GetStats(
+	ctx context.Context, req *api.GetStatsRequest,
+) (*api.GetStatsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	return &api.GetStatsResponse{Stats: s.ClusterAdmin.Stats()}, nil
+}
+
+func (s *adminServer) GetHealth(
+	ctx context.Context, req *api.GetHealthRequest,
+) (*api.GetHealthResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	health, err := s.ClusterAdmin.Health()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetHealthResponse{Health: health}, nil
+}
+
+// Listing the keys hands them out, so it takes the same permission as
+// changing them
+func (s *adminServer) ListKeys(
+	ctx context.Context, req *api.ListKeysRequest,
+) (*api.ListKeysResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	keyring, err := s.Keyring.ListKeys()
+	if keyring == nil {
+		return nil, err
+	}
+	return &api.ListKeysResponse{Keyring: keyring}, nil
+}
+
+func (s *adminServer) InstallKey(
+	ctx context.Context, req *api.InstallKeyRequest,
+) (*api.InstallKeyResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	keyring, err := s.Keyring.InstallKey(req.Key)
+	if keyring == nil {
+		return nil, err
+	}
+	return &api.InstallKeyResponse{Keyring: keyring}, nil
+}
+
+func (s *adminServer) UseKey(
+	ctx context.Context, req *api.UseKeyRequest,
+) (*api.UseKeyResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	keyring, err := s.Keyring.UseKey(req.Key)
+	if keyring == nil {
+		return nil, err
+	}
+	return &api.UseKeyResponse{Keyring: keyring}, nil
+}
+
+func (s *adminServer) RemoveKey(
+	ctx context.Context, req *api.RemoveKeyRequest,
+) (*api.RemoveKeyResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	keyring, err := s.Keyring.RemoveKey(req.Key)
+	if keyring == nil {
+		return nil, err
+	}
+	return &api.RemoveKeyResponse{Keyring: keyring}, nil
+}
+
+// Joins serf's members with the Raft configuration, so members gossip
+// considers failed while Raft still counts on them stand out
+func (s *adminServer) ListMembers(
+	ctx context.Context, req *api.ListMembersRequest,
+) (*api.ListMembersResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	peers, err := s.ClusterAdmin.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	members := s.MemberLister.ListMembers()
+
+	known := make(map[string]bool, len(members))
+	for _, member := range members {
+		known[member.Name] = true
+	}
+	for _, peer := range peers {
+		if !known[peer.Id] {
+			members = append(members, &api.Member{
+				Name:   peer.Id,
+				Status: "none",
+				Tags:   map[string]string{"rpc_addr": peer.Address},
+			})
+		}
+	}
+	for _, member := range members {
+		for _, peer := range peers {
+			if peer.Id == member.Name {
+				member.Suffrage = peer.Suffrage
+				member.IsLeader = peer.IsLeader
+			}
+		}
+	}
+	return &api.ListMembersResponse{Members: members}, nil
+}
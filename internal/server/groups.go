@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Stores the offsets consumer groups committed
+type GroupLog interface {
+	CommitOffset(req *api.CommitOffsetRequest) error
+	// Nil if the group hasn't committed an offset
+	FetchOffset(req *api.FetchOffsetRequest) (*api.GroupOffset, error)
+	ListGroups() ([]*api.ConsumerGroup, error)
+}
+
+// Splits the groups' logs and topics among their live members. Only the
+// leader coordinates the groups, the others refuse members like writes.
+type GroupCoordinator interface {
+	JoinGroup(req *api.JoinGroupRequest) (*api.JoinGroupResponse, error)
+	Heartbeat(req *api.HeartbeatRequest) (*api.HeartbeatResponse, error)
+	LeaveGroup(req *api.LeaveGroupRequest) error
+}
+
+var (
+	errNoGroups = status.Error(
+		codes.Unimplemented,
+		"server doesn't support consumer groups",
+	)
+	errNoCoordinator = status.Error(
+		codes.Unimplemented,
+		"server doesn't coordinate consumer groups",
+	)
+)
+
+// Groups are authorized one by one, policies name them like
+// group:billing or group:billing-*
+func groupObject(name string) string {
+	return "group:" + name
+}
+
+// Models that match objects exactly, like those from before groups were
+// authorized one by one, only match the group's object against policies
+// naming it, so the policies for every object are checked too
+func (s *grpcServer) authorizeGroup(ctx context.Context, group string) error {
+	err := s.Authorizer.Authorize(
+		subject(ctx),
+		groupObject(group),
+		consumeAction,
+	)
+	if err == nil {
+		return nil
+	}
+	if s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	) == nil {
+		return nil
+	}
+	return err
+}
+
+func (s *grpcServer) CommitOffset(
+	ctx context.Context,
+	req *api.CommitOffsetRequest,
+) (*api.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if s.GroupLog == nil {
+		return nil, errNoGroups
+	}
+	if req.Log != "" && req.Topic != "" {
+		return nil, errLogAndTopic
+	}
+	if err := s.GroupLog.CommitOffset(req); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(
+	ctx context.Context,
+	req *api.FetchOffsetRequest,
+) (*api.FetchOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if s.GroupLog == nil {
+		return nil, errNoGroups
+	}
+	if req.Log != "" && req.Topic != "" {
+		return nil, errLogAndTopic
+	}
+	offset, err := s.GroupLog.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+// Lists the groups the caller may consume for, the others are left out
+func (s *grpcServer) ListGroups(
+	ctx context.Context,
+	req *api.ListGroupsRequest,
+) (*api.ListGroupsResponse, error) {
+	if s.GroupLog == nil {
+		return nil, errNoGroups
+	}
+	groups, err := s.GroupLog.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.ListGroupsResponse{}
+	for _, group := range groups {
+		if err := s.authorizeGroup(ctx, group.Name); err != nil {
+			continue
+		}
+		res.Groups = append(res.Groups, group)
+	}
+	return res, nil
+}
+
+func (s *grpcServer) JoinGroup(
+	ctx context.Context,
+	req *api.JoinGroupRequest,
+) (*api.JoinGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoCoordinator
+	}
+	if req.Log != "" && req.Topic != "" {
+		return nil, errLogAndTopic
+	}
+	return s.GroupCoordinator.JoinGroup(req)
+}
+
+func (s *grpcServer) Heartbeat(
+	ctx context.Context,
+	req *api.HeartbeatRequest,
+) (*api.HeartbeatResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoCoordinator
+	}
+	return s.GroupCoordinator.Heartbeat(req)
+}
+
+func (s *grpcServer) LeaveGroup(
+	ctx context.Context,
+	req *api.LeaveGroupRequest,
+) (*api.LeaveGroupResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if s.GroupCoordinator == nil {
+		return nil, errNoCoordinator
+	}
+	if err := s.GroupCoordinator.LeaveGroup(req); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
@@ -6,8 +6,16 @@ import (
 )
 
 type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+	Key         []byte   `json:"key,omitempty"`
+	Value       []byte   `json:"value"`
+	Offset      uint64   `json:"offset"`
+	Headers     []Header `json:"headers,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
 }
 
 var ErrOffsetNotFound = fmt.Errorf("offset not found")
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Manages the named logs the cluster keeps besides the default one
+type LogManager interface {
+	CreateLog(name string, config *api.LogConfig) error
+	DeleteLog(name string) error
+	ListLogs() ([]*api.LogInfo, error)
+	// The named log is also a ProducerLog, ConditionalLog or
+	// TransactionLog if it supports them
+	Log(name string) (CommitLog, error)
+}
+
+var (
+	errNoLogs = status.Error(
+		codes.Unimplemented,
+		"server doesn't support named logs",
+	)
+	errNoProducers = status.Error(
+		codes.Unimplemented,
+		"server doesn't deduplicate producers' appends",
+	)
+	errNoConditionalAppends = status.Error(
+		codes.Unimplemented,
+		"server doesn't support conditional appends",
+	)
+	errNoTransactions = status.Error(
+		codes.Unimplemented,
+		"server doesn't support transactions",
+	)
+)
+
+// Requests name the log, or the topic's partition, they're for
+type logRequest interface {
+	GetLog() string
+	GetTopic() string
+	GetPartition() uint32
+}
+
+func isDefaultLog(req logRequest) bool {
+	return req.GetLog() == "" && req.GetTopic() == ""
+}
+
+// The log the request names, the default log if it names none
+func (s *grpcServer) commitLog(req logRequest) (CommitLog, error) {
+	switch {
+	case req.GetLog() != "" && req.GetTopic() != "":
+		return nil, errLogAndTopic
+	case req.GetTopic() != "":
+		if s.TopicManager == nil {
+			return nil, errNoTopics
+		}
+		return s.TopicManager.Partition(req.GetTopic(), req.GetPartition())
+	case req.GetLog() != "":
+		if s.LogManager == nil {
+			return nil, errNoLogs
+		}
+		return s.LogManager.Log(req.GetLog())
+	}
+	return s.CommitLog, nil
+}
+
+func (s *grpcServer) producerLog(req logRequest) (ProducerLog, error) {
+	if isDefaultLog(req) {
+		if s.ProducerLog == nil {
+			return nil, errNoProducers
+		}
+		return s.ProducerLog, nil
+	}
+	clog, err := s.commitLog(req)
+	if err != nil {
+		return nil, err
+	}
+	producers, ok := clog.(ProducerLog)
+	if !ok {
+		return nil, errNoProducers
+	}
+	return producers, nil
+}
+
+func (s *grpcServer) conditionalLog(req logRequest) (ConditionalLog, error) {
+	if isDefaultLog(req) {
+		if s.ConditionalLog == nil {
+			return nil, errNoConditionalAppends
+		}
+		return s.ConditionalLog, nil
+	}
+	clog, err := s.commitLog(req)
+	if err != nil {
+		return nil, err
+	}
+	conditional, ok := clog.(ConditionalLog)
+	if !ok {
+		return nil, errNoConditionalAppends
+	}
+	return conditional, nil
+}
+
+func (s *grpcServer) transactionLog(req logRequest) (TransactionLog, error) {
+	if isDefaultLog(req) {
+		if s.TransactionLog == nil {
+			return nil, errNoTransactions
+		}
+		return s.TransactionLog, nil
+	}
+	clog, err := s.commitLog(req)
+	if err != nil {
+		return nil, err
+	}
+	transactions, ok := clog.(TransactionLog)
+	if !ok {
+		return nil, errNoTransactions
+	}
+	return transactions, nil
+}
+
+func (s *adminServer) CreateLog(
+	ctx context.Context, req *api.CreateLogRequest,
+) (*api.CreateLogResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.LogManager == nil {
+		return nil, errNoLogs
+	}
+	if err := s.LogManager.CreateLog(req.Name, req.Config); err != nil {
+		return nil, err
+	}
+	return &api.CreateLogResponse{}, nil
+}
+
+func (s *adminServer) DeleteLog(
+	ctx context.Context, req *api.DeleteLogRequest,
+) (*api.DeleteLogResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.LogManager == nil {
+		return nil, errNoLogs
+	}
+	if err := s.LogManager.DeleteLog(req.Name); err != nil {
+		return nil, err
+	}
+	return &api.DeleteLogResponse{}, nil
+}
+
+func (s *adminServer) ListLogs(
+	ctx context.Context, req *api.ListLogsRequest,
+) (*api.ListLogsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.LogManager == nil {
+		return nil, errNoLogs
+	}
+	logs, err := s.LogManager.ListLogs()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListLogsResponse{Logs: logs}, nil
+}
@@ -24,13 +24,39 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// Appends producers' records once, however often they're sent
+type ProducerLog interface {
+	AppendFrom(
+		producerID string,
+		sequence uint64,
+		records []*api.Record,
+	) ([]uint64, error)
+}
+
+// Appends records only at the offset their writer expects
+type ConditionalLog interface {
+	AppendAt(record *api.Record, expectedOffset uint64) (uint64, error)
+}
+
+// Appends records in transactions, committed reads skip the records of
+// open and aborted transactions
+type TransactionLog interface {
+	BeginTransaction(id string) (uint64, error)
+	AppendTo(id string, records []*api.Record) ([]uint64, error)
+	EndTransaction(id string, abort bool) (uint64, error)
+	AppendTransaction(id string, records []*api.Record) ([]uint64, error)
+	ReadCommitted(offset uint64) (*api.Record, error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
@@ -38,15 +64,40 @@ type Authorizer interface {
 var _ api.LogServer = (*grpcServer)(nil)
 
 type Config struct {
-	CommitLog   CommitLog
-	Authorizer  Authorizer
-	GetServerer GetServerer
+	CommitLog CommitLog
+	// Optional, without it appends from producers are refused
+	ProducerLog ProducerLog
+	// Optional, without it conditional appends are refused
+	ConditionalLog ConditionalLog
+	// Optional, without it transactions and committed reads are refused
+	TransactionLog TransactionLog
+	// Optional, without it requests for named logs are refused
+	LogManager LogManager
+	// Optional, without it requests for topics are refused
+	TopicManager TopicManager
+	// Optional, without it consumer groups' offsets are refused
+	GroupLog GroupLog
+	// Optional, without it consumers can't join groups
+	GroupCoordinator GroupCoordinator
+	Authorizer       Authorizer
+	GetServerer      GetServerer
+	ClusterAdmin     ClusterAdmin
+	Keyring          Keyring
+	MemberLister     MemberLister
+	// Optional, without it clients can only poll GetServers
+	ServerWatcher ServerWatcher
+	// Closed when the server starts draining, open streams finish
+	// their current request and end so clients move to another server
+	Drain <-chan struct{}
 }
 
 const (
-	objectWildcard = "*"
-	appendAction   = "append"
-	readAction     = "read"
+	objectWildcard      = "*"
+	appendAction        = "append"
+	readAction          = "read"
+	readClusterAction   = "read-cluster"
+	manageClusterAction = "manage-cluster"
+	consumeAction       = "consume"
 )
 
 func NewGRPCServer(
@@ -101,6 +152,7 @@ func NewGRPCServer(
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	api.RegisterAdminServer(gsrv, newAdminServer(config))
 	return gsrv, nil
 }
 
@@ -124,7 +176,43 @@ func (s *grpcServer) Append(ctx context.Context, req *api.AppendRequest) (*api.A
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if req.TransactionId != "" {
+		if req.ExpectedOffset != nil || req.ProducerId != "" {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"transactions' appends can't be conditional or come from producers",
+			)
+		}
+		offsets, err := s.appendTo(
+			req,
+			req.TransactionId,
+			[]*api.Record{req.Record},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &api.AppendResponse{Offset: offsets[0]}, nil
+	}
+	if req.ExpectedOffset != nil {
+		return s.appendAt(req)
+	}
+	if req.ProducerId != "" {
+		offsets, err := s.appendFrom(
+			req,
+			req.ProducerId,
+			req.Sequence,
+			[]*api.Record{req.Record},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &api.AppendResponse{Offset: offsets[0]}, nil
+	}
+	clog, err := s.commitLog(req)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.Append(req.Record)
 
 	if err != nil {
 		return nil, err
@@ -132,6 +220,79 @@ func (s *grpcServer) Append(ctx context.Context, req *api.AppendRequest) (*api.A
 	return &api.AppendResponse{Offset: offset}, nil
 }
 
+func (s *grpcServer) appendAt(
+	req *api.AppendRequest,
+) (*api.AppendResponse, error) {
+	if req.ProducerId != "" {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"conditional appends can't come from producers",
+		)
+	}
+	conditional, err := s.conditionalLog(req)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := conditional.AppendAt(req.Record, *req.ExpectedOffset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AppendResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) appendFrom(
+	req logRequest,
+	producerID string,
+	sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	producers, err := s.producerLog(req)
+	if err != nil {
+		return nil, err
+	}
+	return producers.AppendFrom(producerID, sequence, records)
+}
+
+func (s *grpcServer) AppendBatch(
+	ctx context.Context,
+	req *api.AppendBatchRequest,
+) (*api.AppendBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	var offsets []uint64
+	var err error
+	switch {
+	case req.TransactionId != "" && req.ProducerId != "":
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"transactions' appends can't come from producers",
+		)
+	case req.TransactionId != "":
+		offsets, err = s.appendTo(req, req.TransactionId, req.Records)
+	case req.ProducerId != "" && len(req.Records) != 0:
+		offsets, err = s.appendFrom(
+			req,
+			req.ProducerId,
+			req.Sequence,
+			req.Records,
+		)
+	default:
+		var clog CommitLog
+		if clog, err = s.commitLog(req); err == nil {
+			offsets, err = clog.AppendBatch(req.Records)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.AppendBatchResponse{Offsets: offsets}, nil
+}
+
 func (s *grpcServer) Read(ctx context.Context, req *api.ReadRequest) (*api.ReadResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
@@ -140,7 +301,19 @@ func (s *grpcServer) Read(ctx context.Context, req *api.ReadRequest) (*api.ReadR
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	var record *api.Record
+	var err error
+	if req.Isolation == api.ReadRequest_READ_COMMITTED {
+		var transactions TransactionLog
+		if transactions, err = s.transactionLog(req); err == nil {
+			record, err = transactions.ReadCommitted(req.Offset)
+		}
+	} else {
+		var clog CommitLog
+		if clog, err = s.commitLog(req); err == nil {
+			record, err = clog.Read(req.Offset)
+		}
+	}
 
 	if err != nil {
 		return nil, err
@@ -148,6 +321,87 @@ func (s *grpcServer) Read(ctx context.Context, req *api.ReadRequest) (*api.ReadR
 	return &api.ReadResponse{Record: record}, nil
 }
 
+func (s *grpcServer) appendTo(
+	req logRequest,
+	id string,
+	records []*api.Record,
+) ([]uint64, error) {
+	transactions, err := s.transactionLog(req)
+	if err != nil {
+		return nil, err
+	}
+	return transactions.AppendTo(id, records)
+}
+
+func (s *grpcServer) BeginTransaction(
+	ctx context.Context,
+	req *api.BeginTransactionRequest,
+) (*api.BeginTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	transactions, err := s.transactionLog(req)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := transactions.BeginTransaction(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) EndTransaction(
+	ctx context.Context,
+	req *api.EndTransactionRequest,
+) (*api.EndTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	transactions, err := s.transactionLog(req)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := transactions.EndTransaction(req.TransactionId, req.Abort)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) AppendTransaction(
+	ctx context.Context,
+	req *api.AppendTransactionRequest,
+) (*api.AppendTransactionResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		appendAction,
+	); err != nil {
+		return nil, err
+	}
+	transactions, err := s.transactionLog(req)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := transactions.AppendTransaction(
+		req.TransactionId,
+		req.Records,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AppendTransactionResponse{Offsets: offsets}, nil
+}
+
 func (s *grpcServer) AppendStream(stream api.Log_AppendStreamServer) error {
 	for {
 		req := &api.AppendRequest{}
@@ -157,6 +411,15 @@ func (s *grpcServer) AppendStream(stream api.Log_AppendStreamServer) error {
 			return err
 		}
 
+		select {
+		case <-s.Drain:
+			return status.Error(
+				codes.Unavailable,
+				"server is shutting down",
+			)
+		default:
+		}
+
 		res, err := s.Append(stream.Context(), req)
 		if err != nil {
 			return err
@@ -176,6 +439,11 @@ func (s *grpcServer) ReadStream(
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.Drain:
+			return status.Error(
+				codes.Unavailable,
+				"server is shutting down",
+			)
 		default:
 			res, err := s.Read(stream.Context(), req)
 			switch err.(type) {
@@ -188,7 +456,8 @@ func (s *grpcServer) ReadStream(
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			// committed reads skip records
+			req.Offset = res.Record.Offset + 1
 		}
 	}
 }
@@ -201,14 +470,81 @@ func (s *grpcServer) GetServers(
 	if err != nil {
 		return nil, err
 	}
+	if s.MemberLister != nil {
+		setServerTags(servers, s.MemberLister.ListMembers())
+	}
+
+	res := &api.GetServersResponse{Servers: servers}
+	if s.TopicManager != nil {
+		res.Partitions = s.TopicManager.Partitions()
+	}
+	return res, nil
+}
 
-	return &api.GetServersResponse{Servers: servers}, nil
+// Fills in the zone and role the servers advertise in serf
+func setServerTags(servers []*api.Server, members []*api.Member) {
+	tags := make(map[string]map[string]string, len(members))
+	for _, member := range members {
+		tags[member.Name] = member.Tags
+	}
+	for _, server := range servers {
+		server.Zone = tags[server.Id]["zone"]
+		server.Role = tags[server.Id]["role"]
+	}
 }
 
 type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+// Sends the servers whenever they change, so clients find the new leader
+// as soon as it's elected rather than the next time they poll.
+func (s *grpcServer) WatchServers(
+	req *api.WatchServersRequest,
+	stream api.Log_WatchServersServer,
+) error {
+	if s.ServerWatcher == nil {
+		return status.Error(
+			codes.Unimplemented,
+			"server doesn't support watching servers",
+		)
+	}
+	updates := s.ServerWatcher.WatchServers(stream.Context())
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.Drain:
+			return nil
+		case servers, ok := <-updates:
+			if !ok {
+				return status.Error(codes.Unavailable, "server closed")
+			}
+			// every watcher is sent the same servers
+			res := &api.WatchServersResponse{}
+			for _, server := range servers {
+				res.Servers = append(
+					res.Servers,
+					proto.Clone(server).(*api.Server),
+				)
+			}
+			if s.MemberLister != nil {
+				setServerTags(res.Servers, s.MemberLister.ListMembers())
+			}
+			if s.TopicManager != nil {
+				res.Partitions = s.TopicManager.Partitions()
+			}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type ServerWatcher interface {
+	WatchServers(ctx context.Context) <-chan []*api.Server
+}
+
 func authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 
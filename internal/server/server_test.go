@@ -1,11 +1,18 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
@@ -16,10 +23,12 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 var debug = flag.Bool("debug", false, "Enable observability for debugging.")
@@ -45,23 +54,973 @@ func TestServer(t *testing.T) {
 	){
 		"append/read a message to/from the log succeeds": testAppendRead,
 		"append/read stream succeeds":                    testAppendReadStream,
+		"append batch succeeds":                          testAppendBatch,
 		"consume past log boundary fails":                testConsumePastBoundary,
 		"unauthorized fails":                             testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
-			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
+			rootConn, nobodyConn, config, teardown := setupTest(t, nil)
 			defer teardown()
-			fn(t, rootClient, nobodyClient, config)
+			fn(
+				t,
+				api.NewLogClient(rootConn),
+				api.NewLogClient(nobodyConn),
+				config,
+			)
 		})
 	}
 }
 
+func TestHTTPServer(t *testing.T) {
+	srv := NewHTTPServer(":0")
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", bytes.NewBufferString(body))
+		srv.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, `{"record": {
+		"value": "eyJpZCI6IDF9",
+		"headers": [{"key": "trace-id", "value": "YWJj"}],
+		"content_type": "application/json"
+	}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"offset": 0}`, w.Body.String())
+
+	// the headers and content type come back with the record
+	w = do(http.MethodGet, `{"offset": 0}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"record": {
+		"value": "eyJpZCI6IDF9",
+		"offset": 0,
+		"headers": [{"key": "trace-id", "value": "YWJj"}],
+		"content_type": "application/json"
+	}}`, w.Body.String())
+	var res ReadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Equal(
+		t,
+		[]Header{{Key: "trace-id", Value: []byte("abc")}},
+		res.Record.Headers,
+	)
+
+	// records without them leave them out
+	do(http.MethodPost, `{"record": {"value": "aGVsbG8="}}`)
+	w = do(http.MethodGet, `{"offset": 1}`)
+	require.JSONEq(
+		t,
+		`{"record": {"value": "aGVsbG8=", "offset": 1}}`,
+		w.Body.String(),
+	)
+
+	w = do(http.MethodGet, `{"offset": 2}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServerDrain(t *testing.T) {
+	drain := make(chan struct{})
+	rootConn, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Drain = drain
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	client := api.NewLogClient(rootConn)
+
+	readStream, err := client.ReadStream(ctx, &api.ReadRequest{Offset: 0})
+	require.NoError(t, err)
+	appendStream, err := client.AppendStream(ctx)
+	require.NoError(t, err)
+
+	close(drain)
+
+	// caught up readers are told to go elsewhere too
+	_, err = readStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// writers are told to go elsewhere
+	err = appendStream.Send(&api.AppendRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = appendStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAdminServer(t *testing.T) {
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(c *Config) {
+		c.ClusterAdmin = &clusterAdmin{}
+		c.Keyring = &keyring{}
+		c.MemberLister = &memberLister{}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	rootClient := api.NewAdminClient(rootConn)
+	nobodyClient := api.NewAdminClient(nobodyConn)
+
+	peers, err := rootClient.ListPeers(ctx, &api.ListPeersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(peers.Peers))
+	require.Equal(t, "Leader", peers.State)
+
+	_, err = rootClient.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.NoError(t, err)
+
+	snapshot, err := rootClient.Snapshot(ctx, &api.SnapshotRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), snapshot.Snapshot.Index)
+
+	health, err := rootClient.GetHealth(ctx, &api.GetHealthRequest{})
+	require.NoError(t, err)
+	require.True(t, health.Health.Healthy)
+
+	keys, err := rootClient.InstallKey(ctx, &api.InstallKeyRequest{Key: "k"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), keys.Keyring.NumNodes)
+
+	// raft servers serf doesn't know about are listed too
+	members, err := rootClient.ListMembers(ctx, &api.ListMembersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(members.Members))
+	require.Equal(t, "failed", members.Members[0].Status)
+	require.Empty(t, members.Members[0].Suffrage)
+	require.Equal(t, "0", members.Members[1].Name)
+	require.Equal(t, "none", members.Members[1].Status)
+	require.True(t, members.Members[1].IsLeader)
+
+	_, err = nobodyClient.ListPeers(ctx, &api.ListPeersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobodyClient.ListKeys(ctx, &api.ListKeysRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobodyClient.TransferLeadership(
+		ctx,
+		&api.TransferLeadershipRequest{},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+type clusterAdmin struct{}
+
+func (c *clusterAdmin) GetPeers() ([]*api.Peer, error) {
+	return []*api.Peer{{Id: "0", IsLeader: true}}, nil
+}
+
+func (c *clusterAdmin) AddVoter(id, addr string) error    { return nil }
+func (c *clusterAdmin) AddNonvoter(id, addr string) error { return nil }
+func (c *clusterAdmin) RemoveServer(id string) error      { return nil }
+func (c *clusterAdmin) TransferLeadership(id string) error {
+	return nil
+}
+
+func (c *clusterAdmin) Snapshot() (*api.Snapshot, error) {
+	return &api.Snapshot{Id: "1-3", Index: 3, Term: 1}, nil
+}
+
+func (c *clusterAdmin) Stats() map[string]string {
+	return map[string]string{"state": "Leader"}
+}
+
+func (c *clusterAdmin) Health() (*api.ClusterHealth, error) {
+	return &api.ClusterHealth{Healthy: true}, nil
+}
+
+func TestGetServers(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, func(c *Config) {
+		c.GetServerer = &getServerer{}
+		c.MemberLister = &memberLister{}
+	})
+	defer teardown()
+
+	// zones and roles come from the serf tags
+	res, err := api.NewLogClient(rootConn).GetServers(
+		context.Background(),
+		&api.GetServersRequest{},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Servers))
+	require.Equal(t, "us-east-1a", res.Servers[1].Zone)
+	require.Equal(t, "reader", res.Servers[1].Role)
+	require.Empty(t, res.Servers[0].Zone)
+}
+
+func TestWatchServers(t *testing.T) {
+	updates := make(chan []*api.Server, 1)
+	rootConn, _, _, teardown := setupTest(t, func(c *Config) {
+		c.ServerWatcher = &serverWatcher{updates: updates}
+		c.MemberLister = &memberLister{}
+	})
+	defer teardown()
+
+	stream, err := api.NewLogClient(rootConn).WatchServers(
+		context.Background(),
+		&api.WatchServersRequest{},
+	)
+	require.NoError(t, err)
+
+	updates <- []*api.Server{{Id: "0", IsLeader: true}, {Id: "1"}}
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, res.Servers[0].IsLeader)
+	require.Equal(t, "us-east-1a", res.Servers[1].Zone)
+
+	updates <- []*api.Server{{Id: "0"}, {Id: "1", IsLeader: true}}
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, res.Servers[1].IsLeader)
+
+	// the stream ends with the watch
+	close(updates)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAppendFromProducer(t *testing.T) {
+	producers := &producerLog{}
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	ctx := context.Background()
+
+	// servers that can't deduplicate refuse producers' appends
+	_, err := client.Append(ctx, &api.AppendRequest{
+		Record:     &api.Record{Value: []byte("hello")},
+		ProducerId: "billing",
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	rootConn, _, _, teardown = setupTest(t, func(c *Config) {
+		c.ProducerLog = producers
+	})
+	defer teardown()
+	client = api.NewLogClient(rootConn)
+	res, err := client.AppendBatch(ctx, &api.AppendBatchRequest{
+		Records:    []*api.Record{{Value: []byte("hello")}},
+		ProducerId: "billing",
+		Sequence:   3,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{42}, res.Offsets)
+	require.Equal(t, "billing", producers.producerID)
+	require.Equal(t, uint64(3), producers.sequence)
+}
+
+func TestConditionalAppend(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	ctx := context.Background()
+	expected := uint64(0)
+
+	// servers that can't check the offset refuse conditional appends
+	_, err := client.Append(ctx, &api.AppendRequest{
+		Record:         &api.Record{Value: []byte("hello")},
+		ExpectedOffset: &expected,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	rootConn, _, _, teardown = setupTest(t, func(c *Config) {
+		c.ConditionalLog = &conditionalLog{next: 3}
+	})
+	defer teardown()
+	client = api.NewLogClient(rootConn)
+	_, err = client.Append(ctx, &api.AppendRequest{
+		Record:         &api.Record{Value: []byte("hello")},
+		ExpectedOffset: &expected,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Equal(
+		t,
+		api.ErrUnexpectedOffset{Expected: 0, Actual: 3}.Error(),
+		err.Error(),
+	)
+
+	expected = 3
+	res, err := client.Append(ctx, &api.AppendRequest{
+		Record:         &api.Record{Value: []byte("hello")},
+		ExpectedOffset: &expected,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+}
+
+func TestNamedLogs(t *testing.T) {
+	rootConn, nobodyConn, _, teardown := setupTest(t, nil)
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	admin := api.NewAdminClient(rootConn)
+	ctx := context.Background()
+
+	// servers without named logs refuse requests naming one
+	_, err := client.Append(ctx, &api.AppendRequest{
+		Log:    "orders",
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = admin.ListLogs(ctx, &api.ListLogsRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	rootConn, nobodyConn, _, teardown = setupTest(t, func(c *Config) {
+		c.LogManager = newLogManager(t)
+	})
+	defer teardown()
+	client = api.NewLogClient(rootConn)
+	admin = api.NewAdminClient(rootConn)
+
+	_, err = admin.CreateLog(ctx, &api.CreateLogRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = admin.CreateLog(ctx, &api.CreateLogRequest{Name: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	logs, err := admin.ListLogs(ctx, &api.ListLogsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "orders", logs.Logs[0].Name)
+
+	_, err = client.Append(ctx, &api.AppendRequest{
+		Record: &api.Record{Value: []byte("default")},
+	})
+	require.NoError(t, err)
+	res, err := client.AppendBatch(ctx, &api.AppendBatchRequest{
+		Log:     "orders",
+		Records: []*api.Record{{Value: []byte("order placed")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, res.Offsets)
+	read, err := client.Read(ctx, &api.ReadRequest{Log: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order placed"), read.Record.Value)
+
+	// named logs that can't deduplicate refuse producers' appends
+	_, err = client.Append(ctx, &api.AppendRequest{
+		Log:        "orders",
+		Record:     &api.Record{Value: []byte("hello")},
+		ProducerId: "billing",
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	_, err = api.NewAdminClient(nobodyConn).DeleteLog(
+		ctx,
+		&api.DeleteLogRequest{Name: "orders"},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = admin.DeleteLog(ctx, &api.DeleteLogRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Read(ctx, &api.ReadRequest{Log: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestTopics(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	// servers without topics refuse requests naming one
+	_, err := api.NewLogClient(rootConn).Read(ctx, &api.ReadRequest{
+		Topic: "orders",
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	rootConn, _, _, teardown = setupTest(t, func(c *Config) {
+		c.TopicManager = newTopicManager(t)
+		c.GetServerer = &getServerer{}
+	})
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	admin := api.NewAdminClient(rootConn)
+
+	_, err = admin.CreateTopic(ctx, &api.CreateTopicRequest{
+		Name:       "orders",
+		Partitions: 2,
+	})
+	require.NoError(t, err)
+	topics, err := admin.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), topics.Topics[0].Partitions)
+
+	// clients learn the partitions' leaders with the servers
+	servers, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers.Partitions))
+	require.Equal(t, "1", servers.Partitions[1].LeaderId)
+
+	// every partition has its own offsets
+	for _, partition := range []uint32{0, 1} {
+		res, err := client.Append(ctx, &api.AppendRequest{
+			Topic:     "orders",
+			Partition: partition,
+			Record:    &api.Record{Value: []byte("order placed")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), res.Offset)
+	}
+	read, err := client.Read(ctx, &api.ReadRequest{
+		Topic:     "orders",
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order placed"), read.Record.Value)
+	_, err = client.Read(ctx, &api.ReadRequest{
+		Topic:     "orders",
+		Partition: 2,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Read(ctx, &api.ReadRequest{
+		Log:   "orders",
+		Topic: "orders",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = admin.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Read(ctx, &api.ReadRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestConsumerGroups(t *testing.T) {
+	// nobody may only consume for the billing groups
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	b, err := ioutil.ReadFile(config.ACLPolicyFile)
+	require.NoError(t, err)
+	b = append(b, "\np, nobody, group:billing-*, consume\n"...)
+	require.NoError(t, ioutil.WriteFile(policy, b, 0644))
+
+	groups := &groupLog{offsets: make(map[string]uint64)}
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(c *Config) {
+		c.GroupLog = groups
+		c.Authorizer = auth.New(config.ACLModelFile, policy)
+	})
+	defer teardown()
+	root := api.NewLogClient(rootConn)
+	nobody := api.NewLogClient(nobodyConn)
+	ctx := context.Background()
+
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "billing-eu",
+		Offset: 42,
+	})
+	require.NoError(t, err)
+	res, err := nobody.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "billing-eu",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), res.Offset.Offset)
+	res, err = nobody.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "billing-us",
+	})
+	require.NoError(t, err)
+	require.Nil(t, res.Offset)
+
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "shipping",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "shipping",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "shipping",
+	})
+	require.NoError(t, err)
+	_, err = root.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "shipping",
+		Log:   "orders",
+		Topic: "orders",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// groups the caller can't consume for are left out
+	list, err := nobody.ListGroups(ctx, &api.ListGroupsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.Groups))
+	require.Equal(t, "billing-eu", list.Groups[0].Name)
+	list, err = root.ListGroups(ctx, &api.ListGroupsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list.Groups))
+
+	// models matching objects exactly still grant the groups to the
+	// policies for every object
+	model := filepath.Join(t.TempDir(), "model.conf")
+	b, err = ioutil.ReadFile(config.ACLModelFile)
+	require.NoError(t, err)
+	b = bytes.Replace(
+		b,
+		[]byte("keyMatch(r.obj, p.obj)"),
+		[]byte("r.obj == p.obj"),
+		1,
+	)
+	require.NoError(t, ioutil.WriteFile(model, b, 0644))
+	exactConn, _, _, exactTeardown := setupTest(t, func(c *Config) {
+		c.GroupLog = groups
+		c.Authorizer = auth.New(model, config.ACLPolicyFile)
+	})
+	defer exactTeardown()
+	_, err = api.NewLogClient(exactConn).CommitOffset(
+		ctx,
+		&api.CommitOffsetRequest{Group: "shipping"},
+	)
+	require.NoError(t, err)
+}
+
+func TestGroupCoordinator(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	// servers without a coordinator refuse members
+	_, err := api.NewLogClient(rootConn).JoinGroup(ctx, &api.JoinGroupRequest{
+		Group: "billing",
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	coordinator := &groupCoordinator{members: make(map[string]bool)}
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(c *Config) {
+		c.GroupCoordinator = coordinator
+	})
+	defer teardown()
+	root := api.NewLogClient(rootConn)
+	nobody := api.NewLogClient(nobodyConn)
+
+	_, err = nobody.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.JoinGroup(ctx, &api.JoinGroupRequest{
+		Group: "billing",
+		Log:   "orders",
+		Topic: "orders",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	joined, err := root.JoinGroup(ctx, &api.JoinGroupRequest{
+		Group: "billing",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "member-1", joined.MemberId)
+	hb, err := root.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: joined.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, joined.Generation, hb.Generation)
+
+	_, err = root.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: joined.MemberId,
+	})
+	require.NoError(t, err)
+
+	// members that left, or were dropped, have to join again
+	_, err = root.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: joined.MemberId,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Equal(t, 1, len(details))
+	require.Equal(t, "UNKNOWN_MEMBER", details[0].(*errdetails.ErrorInfo).Reason)
+}
+
+func TestTransactions(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	ctx := context.Background()
+
+	// servers without transactions refuse them and committed reads
+	_, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{
+		TransactionId: "order",
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Read(ctx, &api.ReadRequest{
+		Isolation: api.ReadRequest_READ_COMMITTED,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	txns := &transactionLog{}
+	rootConn, _, _, teardown = setupTest(t, func(c *Config) {
+		c.TransactionLog = txns
+	})
+	defer teardown()
+	client = api.NewLogClient(rootConn)
+
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{
+		TransactionId: "order",
+	})
+	require.NoError(t, err)
+	res, err := client.Append(ctx, &api.AppendRequest{
+		Record:        &api.Record{Value: []byte("order placed")},
+		TransactionId: "order",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	_, err = client.EndTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: "order",
+		Abort:         true,
+	})
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]string{"begin order", "append order", "abort order"},
+		txns.calls,
+	)
+
+	_, err = client.AppendBatch(ctx, &api.AppendBatchRequest{
+		Records:       []*api.Record{{Value: []byte("hello")}},
+		TransactionId: "order",
+		ProducerId:    "billing",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// committed read streams pick up after the records they get
+	stream, err := client.ReadStream(ctx, &api.ReadRequest{
+		Isolation: api.ReadRequest_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	for _, want := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+}
+
+// Commits every other record
+type transactionLog struct {
+	calls []string
+}
+
+func (l *transactionLog) call(call string) {
+	l.calls = append(l.calls, call)
+}
+
+func (l *transactionLog) BeginTransaction(id string) (uint64, error) {
+	l.call("begin " + id)
+	return 0, nil
+}
+
+func (l *transactionLog) AppendTo(
+	id string,
+	records []*api.Record,
+) ([]uint64, error) {
+	l.call("append " + id)
+	return []uint64{1}, nil
+}
+
+func (l *transactionLog) EndTransaction(id string, abort bool) (uint64, error) {
+	if abort {
+		l.call("abort " + id)
+	} else {
+		l.call("commit " + id)
+	}
+	return 2, nil
+}
+
+func (l *transactionLog) AppendTransaction(
+	id string,
+	records []*api.Record,
+) ([]uint64, error) {
+	l.call("append transaction " + id)
+	return []uint64{1}, nil
+}
+
+func (l *transactionLog) ReadCommitted(offset uint64) (*api.Record, error) {
+	if offset%2 == 1 {
+		offset++
+	}
+	return &api.Record{Offset: offset}, nil
+}
+
+type conditionalLog struct {
+	next uint64
+}
+
+func (l *conditionalLog) AppendAt(
+	record *api.Record,
+	expectedOffset uint64,
+) (uint64, error) {
+	if expectedOffset != l.next {
+		return 0, api.ErrUnexpectedOffset{
+			Expected: expectedOffset,
+			Actual:   l.next,
+		}
+	}
+	l.next++
+	return expectedOffset, nil
+}
+
+type logManager struct {
+	dir  string
+	logs map[string]*log.Log
+}
+
+func newLogManager(t *testing.T) *logManager {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &logManager{dir: dir, logs: make(map[string]*log.Log)}
+}
+
+func (m *logManager) CreateLog(name string, config *api.LogConfig) error {
+	if _, ok := m.logs[name]; ok {
+		return api.ErrLogExists{Name: name}
+	}
+	dir := filepath.Join(m.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	l, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		return err
+	}
+	m.logs[name] = l
+	return nil
+}
+
+func (m *logManager) DeleteLog(name string) error {
+	l, ok := m.logs[name]
+	if !ok {
+		return api.ErrLogNotFound{Name: name}
+	}
+	delete(m.logs, name)
+	return l.Remove()
+}
+
+func (m *logManager) ListLogs() ([]*api.LogInfo, error) {
+	var logs []*api.LogInfo
+	for name := range m.logs {
+		logs = append(logs, &api.LogInfo{Name: name})
+	}
+	return logs, nil
+}
+
+func (m *logManager) Log(name string) (CommitLog, error) {
+	l, ok := m.logs[name]
+	if !ok {
+		return nil, api.ErrLogNotFound{Name: name}
+	}
+	return l, nil
+}
+
+// Keeps every partition in a named log of its own
+type topicManager struct {
+	*logManager
+	topics map[string]uint32
+}
+
+func newTopicManager(t *testing.T) *topicManager {
+	return &topicManager{
+		logManager: newLogManager(t),
+		topics:     make(map[string]uint32),
+	}
+}
+
+func (m *topicManager) CreateTopic(name string, partitions uint32) error {
+	if _, ok := m.topics[name]; ok {
+		return api.ErrTopicExists{Name: name}
+	}
+	for id := uint32(0); id < partitions; id++ {
+		err := m.CreateLog(fmt.Sprintf("%s-%d", name, id), nil)
+		if err != nil {
+			return err
+		}
+	}
+	m.topics[name] = partitions
+	return nil
+}
+
+func (m *topicManager) DeleteTopic(name string) error {
+	partitions, ok := m.topics[name]
+	if !ok {
+		return api.ErrTopicNotFound{Name: name}
+	}
+	for id := uint32(0); id < partitions; id++ {
+		err := m.DeleteLog(fmt.Sprintf("%s-%d", name, id))
+		if err != nil {
+			return err
+		}
+	}
+	delete(m.topics, name)
+	return nil
+}
+
+func (m *topicManager) ListTopics() ([]*api.Topic, error) {
+	var topics []*api.Topic
+	for name, partitions := range m.topics {
+		topics = append(topics, &api.Topic{
+			Name:       name,
+			Partitions: partitions,
+		})
+	}
+	return topics, nil
+}
+
+func (m *topicManager) Partition(topic string, id uint32) (CommitLog, error) {
+	partitions, ok := m.topics[topic]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Name: topic}
+	}
+	if id >= partitions {
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: id}
+	}
+	return m.Log(fmt.Sprintf("%s-%d", topic, id))
+}
+
+// The partitions take turns leading
+func (m *topicManager) Partitions() []*api.Partition {
+	var partitions []*api.Partition
+	for name, n := range m.topics {
+		for id := uint32(0); id < n; id++ {
+			partitions = append(partitions, &api.Partition{
+				Topic:    name,
+				Id:       id,
+				LeaderId: fmt.Sprint(id % 2),
+			})
+		}
+	}
+	return partitions
+}
+
+// Keeps the offsets committed in the default log
+type groupLog struct {
+	offsets map[string]uint64
+}
+
+func (l *groupLog) CommitOffset(req *api.CommitOffsetRequest) error {
+	l.offsets[req.Group] = req.Offset
+	return nil
+}
+
+func (l *groupLog) FetchOffset(
+	req *api.FetchOffsetRequest,
+) (*api.GroupOffset, error) {
+	offset, ok := l.offsets[req.Group]
+	if !ok {
+		return nil, nil
+	}
+	return &api.GroupOffset{Offset: offset}, nil
+}
+
+func (l *groupLog) ListGroups() ([]*api.ConsumerGroup, error) {
+	var groups []*api.ConsumerGroup
+	for name, offset := range l.offsets {
+		groups = append(groups, &api.ConsumerGroup{
+			Name:    name,
+			Offsets: []*api.GroupOffset{{Offset: offset}},
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// Gives every member all of the default log, and a new generation when
+// one joins or leaves
+type groupCoordinator struct {
+	members    map[string]bool
+	joined     int
+	generation uint64
+}
+
+func (c *groupCoordinator) JoinGroup(
+	req *api.JoinGroupRequest,
+) (*api.JoinGroupResponse, error) {
+	c.joined++
+	c.generation++
+	id := fmt.Sprintf("member-%d", c.joined)
+	c.members[id] = true
+	return &api.JoinGroupResponse{
+		MemberId:   id,
+		Generation: c.generation,
+		Assignment: &api.Assignment{RangeSize: 1, Members: 1},
+	}, nil
+}
+
+func (c *groupCoordinator) Heartbeat(
+	req *api.HeartbeatRequest,
+) (*api.HeartbeatResponse, error) {
+	if !c.members[req.MemberId] {
+		return nil, api.ErrUnknownMember{
+			Group:    req.Group,
+			MemberID: req.MemberId,
+		}
+	}
+	return &api.HeartbeatResponse{
+		Generation: c.generation,
+		Assignment: &api.Assignment{RangeSize: 1, Members: 1},
+	}, nil
+}
+
+func (c *groupCoordinator) LeaveGroup(req *api.LeaveGroupRequest) error {
+	delete(c.members, req.MemberId)
+	c.generation++
+	return nil
+}
+
+type producerLog struct {
+	producerID string
+	sequence   uint64
+}
+
+func (p *producerLog) AppendFrom(
+	producerID string,
+	sequence uint64,
+	records []*api.Record,
+) ([]uint64, error) {
+	p.producerID, p.sequence = producerID, sequence
+	return []uint64{42}, nil
+}
+
+type serverWatcher struct {
+	updates chan []*api.Server
+}
+
+func (w *serverWatcher) WatchServers(
+	ctx context.Context,
+) <-chan []*api.Server {
+	return w.updates
+}
+
+type getServerer struct{}
+
+func (g *getServerer) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{Id: "0", IsLeader: true}, {Id: "1"}}, nil
+}
+
+type memberLister struct{}
+
+func (m *memberLister) ListMembers() []*api.Member {
+	return []*api.Member{{
+		Name:   "1",
+		Status: "failed",
+		Tags:   map[string]string{"zone": "us-east-1a", "role": "reader"},
+	}}
+}
+
+type keyring struct{}
+
+func (k *keyring) ListKeys() (*api.Keyring, error) {
+	return &api.Keyring{Keys: map[string]uint32{"k": 3}, NumNodes: 3}, nil
+}
+
+func (k *keyring) InstallKey(key string) (*api.Keyring, error) {
+	return &api.Keyring{NumNodes: 3, NumResponses: 3}, nil
+}
+
+func (k *keyring) UseKey(key string) (*api.Keyring, error) {
+	return &api.Keyring{NumNodes: 3, NumResponses: 3}, nil
+}
+
+func (k *keyring) RemoveKey(key string) (*api.Keyring, error) {
+	return &api.Keyring{NumNodes: 3, NumResponses: 3}, nil
+}
+
 func setupTest(
 	t *testing.T,
 	fn func(*Config),
 ) (
-	client api.LogClient,
-	nobodyClient api.LogClient,
+	rootConn *grpc.ClientConn,
+	nobodyConn *grpc.ClientConn,
 	cfg *Config,
 	teardown func(),
 ) {
@@ -72,7 +1031,6 @@ func setupTest(
 
 	newClient := func(crtPath, keyPath string) (
 		*grpc.ClientConn,
-		api.LogClient,
 		[]grpc.DialOption,
 	) {
 		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
@@ -86,16 +1044,15 @@ func setupTest(
 		opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
 		conn, err := grpc.Dial(l.Addr().String(), opts...)
 		require.NoError(t, err)
-		client := api.NewLogClient(conn)
-		return conn, client, opts
+		return conn, opts
 	}
 
-	rootConn, rootClient, _ := newClient(
+	rootConn, _ = newClient(
 		config.RootClientCertFile,
 		config.RootClientKeyFile,
 	)
 
-	nobodyConn, nobodyClient, _ := newClient(
+	nobodyConn, _ = newClient(
 		config.NobodyClientCertFile,
 		config.NobodyClientKeyFile,
 	)
@@ -151,7 +1108,7 @@ func setupTest(
 		server.Serve(l)
 	}()
 
-	return rootClient, nobodyClient, cfg, func() {
+	return rootConn, nobodyConn, cfg, func() {
 		server.Stop()
 		rootConn.Close()
 		nobodyConn.Close()
@@ -173,7 +1130,9 @@ func testAppendRead(
 	ctx := context.Background()
 
 	want := &api.Record{
-		Value: []byte("hellow world"),
+		Value:       []byte("hellow world"),
+		Headers:     []*api.Header{{Key: "trace-id", Value: []byte("abc")}},
+		ContentType: "text/plain",
 	}
 
 	append, err := client.Append(ctx, &api.AppendRequest{
@@ -187,6 +1146,8 @@ func testAppendRead(
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.True(t, proto.Equal(want.Headers[0], consume.Record.Headers[0]))
+	require.Equal(t, want.ContentType, consume.Record.ContentType)
 }
 
 func testConsumePastBoundary(
@@ -214,6 +1175,28 @@ func testConsumePastBoundary(
 	}
 }
 
+func testAppendBatch(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	cfg *Config,
+) {
+	ctx := context.Background()
+
+	res, err := client.AppendBatch(ctx, &api.AppendBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("first message")},
+			{Value: []byte("second message")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, res.Offsets)
+
+	consume, err := client.Read(ctx, &api.ReadRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("second message"), consume.Record.Value)
+}
+
 func testAppendReadStream(
 	t *testing.T,
 	client api.LogClient,
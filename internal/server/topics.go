@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/nickstrad/dcl_store/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Manages the cluster's topics, each split into partitions replicated
+// apart from each other
+type TopicManager interface {
+	CreateTopic(name string, partitions uint32) error
+	DeleteTopic(name string) error
+	ListTopics() ([]*api.Topic, error)
+	// The partition is also a ProducerLog, ConditionalLog or
+	// TransactionLog if it supports them
+	Partition(topic string, id uint32) (CommitLog, error)
+	// Which server leads each partition, so clients append to it
+	Partitions() []*api.Partition
+}
+
+var (
+	errNoTopics = status.Error(
+		codes.Unimplemented,
+		"server doesn't support topics",
+	)
+	errLogAndTopic = status.Error(
+		codes.InvalidArgument,
+		"requests can name a log or a topic, not both",
+	)
+)
+
+func (s *adminServer) CreateTopic(
+	ctx context.Context, req *api.CreateTopicRequest,
+) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, errNoTopics
+	}
+	err := s.TopicManager.CreateTopic(req.Name, req.Partitions)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *adminServer) DeleteTopic(
+	ctx context.Context, req *api.DeleteTopicRequest,
+) (*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, errNoTopics
+	}
+	if err := s.TopicManager.DeleteTopic(req.Name); err != nil {
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *adminServer) ListTopics(
+	ctx context.Context, req *api.ListTopicsRequest,
+) (*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		readClusterAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.TopicManager == nil {
+		return nil, errNoTopics
+	}
+	topics, err := s.TopicManager.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}